@@ -0,0 +1,87 @@
+package godba
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Error is returned by the datastore when a request fails. Code is one of the error codes in this
+// package, Err is the underlying cause, usually an awserr.Error from dynamodb
+type Error struct {
+	Code    string
+	Op      string // the dynamodb operation, e.g. PutItem
+	Table   string
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return e.Message + " [" + e.Err.Error() + "]"
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is an *Error with the same code, so callers can use
+// errors.Is(err, &Error{Code: ErrorPutItem})
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Code returns the code of the first Error in err's chain, or an empty string if there is none
+func Code(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
+
+// awsCode returns the code of the first awserr.Error in err's chain
+func awsCode(err error) string {
+	var ae awserr.Error
+	if errors.As(err, &ae) {
+		return ae.Code()
+	}
+	return ""
+}
+
+// IsConditionFailed reports whether err was caused by a request condition that did not hold,
+// including a condition on one of the writes of a cancelled transaction
+func IsConditionFailed(err error) bool {
+	if Code(err) == ErrorConditionFailed || awsCode(err) == dynamodb.ErrCodeConditionalCheckFailedException {
+		return true
+	}
+	var tce *dynamodb.TransactionCanceledException
+	if errors.As(err, &tce) {
+		for _, r := range tce.CancellationReasons {
+			if r.Code != nil && *r.Code == "ConditionalCheckFailed" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsNotFound reports whether err was caused by a table or index that does not exist
+func IsNotFound(err error) bool {
+	return awsCode(err) == dynamodb.ErrCodeResourceNotFoundException
+}
+
+// IsThrottled reports whether dynamodb rejected the request because the table's throughput or the
+// account's request limit was exceeded. These requests can be retried later
+func IsThrottled(err error) bool {
+	switch awsCode(err) {
+	case dynamodb.ErrCodeProvisionedThroughputExceededException, dynamodb.ErrCodeRequestLimitExceeded, "ThrottlingException":
+		return true
+	}
+	return false
+}
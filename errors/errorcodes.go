@@ -37,4 +37,31 @@ const (
 
 	// ErrorUpdateOperation error
 	ErrorUpdateOperation = "InvalidUpdateOperation"
+
+	// ErrorScanItem error
+	ErrorScanItem = "ScanFailed"
+
+	// ErrorBatchGet error
+	ErrorBatchGet = "BatchGetFailed"
+
+	// ErrorBatchWrite error
+	ErrorBatchWrite = "BatchWriteFailed"
+
+	// ErrorTransaction error
+	ErrorTransaction = "TransactionFailed"
+
+	// ErrorInvalidRequest error
+	ErrorInvalidRequest = "InvalidRequest"
+
+	// ErrorCursor error
+	ErrorCursor = "InvalidCursor"
+
+	// ErrorProjection error
+	ErrorProjection = "InvalidProjection"
+
+	// ErrorJournal error
+	ErrorJournal = "JournalFailed"
+
+	// ErrorConditionFailed is returned by Put, Update and Delete when the request conditions did not hold
+	ErrorConditionFailed = "ConditionFailed"
 )
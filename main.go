@@ -11,12 +11,15 @@ type Store int32
 
 const (
 	Dynamodb Store = iota
+	Memory
 )
 
 func New(kind Store, config config.Store) (store.Storer, error) {
 	switch kind {
 	case Dynamodb:
 		return store.NewDynamodb(config), nil
+	case Memory:
+		return store.NewMemory(config), nil
 	}
 	return nil, errors.New("unknown store")
 }
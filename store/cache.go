@@ -0,0 +1,176 @@
+package store
+
+import (
+	"container/list"
+	"encoding/json"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultCacheSize is the number of items cached when the CacheSize option is not set
+const defaultCacheSize = 1000
+
+// CacheStats counts the Gets answered from the read cache and the ones that had to go to the database.
+// Gets that skip the cache, because of LiveData, a Projection or CacheOff, are not counted
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int // items in the datastore's cache, not counting the caches of transactions
+}
+
+// cacheCounters are shared by a datastore's cache and the caches of its transactions
+type cacheCounters struct {
+	hits   uint64
+	misses uint64
+}
+
+// readCache holds the results of Gets by table and key. It keeps at most size items, dropping the least
+// recently used one to make room, and items older than ttl are read again. A ttl of 0 keeps items until
+// they are dropped or a write to the same key removes them
+type readCache struct {
+	mu         sync.Mutex
+	size       int
+	ttl        time.Duration
+	order      *list.List // most recently used first
+	entries    map[string]*list.Element
+	counters   *cacheCounters
+	now        func() time.Time
+	generation uint64 // counts removals, so a read that raced one is not added
+}
+
+type cacheEntry struct {
+	key     string
+	result  *dynamodbResult
+	expires time.Time
+}
+
+func newReadCache(size int, ttl time.Duration, counters *cacheCounters) *readCache {
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+	return &readCache{
+		size:     size,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+		counters: counters,
+		now:      time.Now}
+}
+
+// cacheKey identifies an item by its table and encoded key. ok is false if the key can not be encoded,
+// in which case the item is not cached
+func cacheKey(table string, key map[string]interface{}) (string, bool) {
+	av, err := marshalItems(key)
+	if err != nil {
+		return "", false
+	}
+	// json sorts the map by attribute name, so the same key always encodes the same way
+	b, err := json.Marshal(av)
+	if err != nil {
+		return "", false
+	}
+	return table + "\x00" + string(b), true
+}
+
+func (c *readCache) get(key string) *dynamodbResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if ok && c.ttl > 0 && c.now().After(el.Value.(*cacheEntry).expires) {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		ok = false
+	}
+	if !ok {
+		atomic.AddUint64(&c.counters.misses, 1)
+		return nil
+	}
+
+	atomic.AddUint64(&c.counters.hits, 1)
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheEntry).result
+}
+
+// start returns the generation to pass to add for a read that is about to be sent
+func (c *readCache) start() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// add caches the result of a read started at generation. If anything was removed since, the result may be
+// older than the write that removed it and it is not added
+func (c *readCache) add(key string, result *dynamodbResult, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	e := &cacheEntry{key: key, result: result, expires: c.now().Add(c.ttl)}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(e)
+	for c.order.Len() > c.size {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.entries, last.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *readCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+// removeWritten removes the item a write request changes. A request whose Key is empty or can not be
+// encoded, like a Put with the key only in its Item, removes all the table's items
+func (c *readCache) removeWritten(r Request) {
+	if len(r.Key) != 0 {
+		if key, ok := cacheKey(r.Table, r.Key); ok {
+			c.remove(key)
+			return
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	prefix := r.Table + "\x00"
+	for key, el := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.order.Remove(el)
+			delete(c.entries, key)
+		}
+	}
+}
+
+func (c *readCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.generation++
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+func (c *readCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
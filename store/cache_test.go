@@ -0,0 +1,254 @@
+package store
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/sethjback/godba/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheKey(t *testing.T) {
+	assert := assert.New(t)
+
+	k1, ok := cacheKey("users", map[string]interface{}{"id": "1", "ts": 2})
+	assert.True(ok)
+	k2, _ := cacheKey("users", map[string]interface{}{"ts": 2, "id": "1"})
+	assert.Equal(k1, k2, "the order of the key attributes should not matter")
+
+	k3, _ := cacheKey("events", map[string]interface{}{"id": "1", "ts": 2})
+	assert.NotEqual(k1, k3, "the same key in another table is another item")
+	k4, _ := cacheKey("users", map[string]interface{}{"id": 1, "ts": 2})
+	assert.NotEqual(k1, k4)
+}
+
+func TestReadCache(t *testing.T) {
+	assert := assert.New(t)
+	counters := &cacheCounters{}
+	c := newReadCache(2, time.Minute, counters)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	a, b, d := &dynamodbResult{}, &dynamodbResult{}, &dynamodbResult{}
+	c.add("a", a, c.start())
+	c.add("b", b, c.start())
+	assert.True(a == c.get("a"))
+
+	// b is the least recently used, so it makes room for d
+	c.add("d", d, c.start())
+	assert.Equal(2, c.len())
+	assert.Nil(c.get("b"))
+	assert.True(d == c.get("d"))
+
+	c.remove("d")
+	assert.Nil(c.get("d"))
+
+	now = now.Add(time.Minute + time.Second)
+	assert.Nil(c.get("a"), "expired items should be read again")
+	assert.Equal(0, c.len())
+
+	assert.Equal(uint64(2), counters.hits)
+	assert.Equal(uint64(3), counters.misses)
+
+	c.add("users\x00a", a, c.start())
+	c.add("users\x00b", b, c.start())
+	c.add("admins\x00a", d, c.start())
+	c.removeWritten(Request{Table: "users", Action: Put, Item: map[string]interface{}{"id": "a"}})
+	assert.Equal(1, c.len(), "a write without a key should remove all the table's items")
+	c.remove("admins\x00a")
+
+	// a read started before a removal may be older than the write that removed it
+	generation := c.start()
+	c.remove("b")
+	c.add("a", a, generation)
+	assert.Nil(c.get("a"))
+
+	c.add("a", a, c.start())
+	c.clear()
+	assert.Equal(0, c.len())
+	assert.Equal(defaultCacheSize, newReadCache(0, 0, counters).size)
+}
+
+func TestMemoryCacheInvalidation(t *testing.T) {
+	assert := assert.New(t)
+	c := NewMemory(config.Store{
+		CacheSize: 10,
+		CacheTTL:  time.Hour,
+		Tables: map[string]TableSchema{
+			"users":  TableSchema{HashKey: "id"},
+			"admins": TableSchema{HashKey: "id"}}})
+
+	name := func(r Result) string {
+		s, _ := r.GetStringItem(0, "name")
+		return s
+	}
+	get := func(table string) Result {
+		r, e := c.Run(Request{Table: table, Action: Get, Key: map[string]interface{}{"id": "1"}})
+		assert.Nil(e)
+		return r
+	}
+
+	_, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "bob"}})
+	assert.Nil(e)
+	_, e = c.Run(Request{Table: "admins", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "root"}})
+	assert.Nil(e)
+	assert.Equal("bob", name(get("users")))
+	assert.Equal("root", name(get("admins")), "items with the same key in other tables are cached separately")
+	assert.Equal(CacheStats{Misses: 2, Entries: 2}, c.CacheStats())
+
+	u := Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	u.AddUpdateValue("/name", Update, "alice")
+	_, e = c.Run(u)
+	assert.Nil(e)
+	assert.Equal("alice", name(get("users")), "the update should remove the cached item")
+	assert.Equal("root", name(get("admins")))
+	assert.Equal(CacheStats{Hits: 1, Misses: 3, Entries: 2}, c.CacheStats())
+
+	_, e = c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "carol"}})
+	assert.Nil(e)
+	assert.Equal("carol", name(get("users")))
+
+	_, e = c.Run(Request{Table: "users", Action: Delete, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	assert.Equal(0, get("users").GetItemCount())
+
+	_, e = c.Run(Request{Action: BatchWrite, Batch: []Request{
+		Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "dave"}}}})
+	assert.Nil(e)
+	assert.Equal("dave", name(get("users")))
+
+	// a put with the key only in its item removes it too
+	_, e = c.Run(Request{Table: "users", Action: Put, Item: map[string]interface{}{"id": "1", "name": "frank"}})
+	assert.Nil(e)
+	assert.Equal("frank", name(get("users")))
+
+	// a write in a transaction removes the item from the datastore's cache and the transaction's
+	tx := c.StartTransaction()
+	r, e := tx.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	assert.Equal("frank", name(r))
+	_, e = tx.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "erin"}})
+	assert.Nil(e)
+	r, e = tx.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	assert.Equal("erin", name(r))
+	assert.Equal("erin", name(get("users")))
+	assert.Empty(tx.Rollback())
+	assert.Equal("frank", name(get("users")), "the rollback should remove the cached item")
+
+	// gets that skip the cache are not counted
+	before := c.CacheStats()
+	_, e = c.Run(Request{Table: "users", Action: Get, LiveData: true, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	c.CacheOff()
+	get("users")
+	c.CacheOn()
+	assert.Equal(before, c.CacheStats())
+
+	c.ClearCache()
+	assert.Equal(0, c.CacheStats().Entries)
+}
+
+// writingDB runs write the first time an item is read, after reading it, like another process
+// writing the item while the read is on its way back
+type writingDB struct {
+	*memoryDB
+	write func()
+}
+
+func (d *writingDB) GetItemWithContext(ctx aws.Context, in *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	out, err := d.memoryDB.GetItemWithContext(ctx, in, opts...)
+	if write := d.write; write != nil {
+		d.write = nil
+		write()
+	}
+	return out, err
+}
+
+func TestMemoryCacheRacingWrite(t *testing.T) {
+	assert := assert.New(t)
+	c := NewMemory(config.Store{Tables: map[string]TableSchema{"users": TableSchema{HashKey: "id"}}})
+	_, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "bob"}})
+	assert.Nil(e)
+
+	c.db = &writingDB{memoryDB: c.db.(*memoryDB), write: func() {
+		_, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "alice"}})
+		assert.Nil(e)
+	}}
+	r, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	s, _ := r.GetStringItem(0, "name")
+	assert.Equal("bob", s)
+
+	// the read finished after the write, so it is not cached over it
+	r, e = c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	s, _ = r.GetStringItem(0, "name")
+	assert.Equal("alice", s)
+}
+
+func TestMemoryCacheConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	c := NewMemory(config.Store{
+		VersionAttribute: "version",
+		Tables:           map[string]TableSchema{"users": TableSchema{HashKey: "id"}}})
+	_, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "bob"}})
+	assert.Nil(e)
+
+	// readers share cached results while a writer keeps invalidating them, run with -race
+	var wg sync.WaitGroup
+	for w := 0; w < 32; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				r, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+				if assert.Nil(e) {
+					_, ok := r.GetVersion(0)
+					assert.True(ok)
+					r.GetStringItem(0, "name")
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			_, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "bob"}, Version: i + 1})
+			assert.Nil(e)
+		}
+	}()
+	wg.Wait()
+
+	r, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	v, _ := r.GetVersion(0)
+	assert.Equal(51, v, "the last write should not be hidden by a cached read")
+}
+
+func TestAtomicCacheInvalidation(t *testing.T) {
+	assert := assert.New(t)
+	c := getAtomicStore()
+
+	_, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"n": 1}})
+	assert.Nil(e)
+	_, e = c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+
+	tx := c.StartTransaction()
+	_, e = tx.Run(Request{Table: "users", Action: Delete, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	r, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	assert.Equal(1, r.GetItemCount(), "buffered writes are not applied yet")
+	assert.Nil(tx.Finish())
+
+	r, e = c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	assert.Equal(0, r.GetItemCount(), "the commit should remove the cached item")
+}
@@ -0,0 +1,113 @@
+package store
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// cursor is the signed content of a pagination token. The fingerprint ties the token to the
+// action, table, index, segment and conditions of the query that produced it
+type cursor struct {
+	Key         map[string]*dynamodb.AttributeValue `json:"k"`
+	Fingerprint []byte                              `json:"f"`
+}
+
+// queryFingerprint hashes everything that determines which items a query reads, so a cursor can
+// only be used to continue the query it came from
+func queryFingerprint(r Request) ([]byte, error) {
+	vals := make(map[string]*dynamodb.AttributeValue)
+	names := make(map[string]*string)
+
+	keyExp, err := buildConditionExpression(r.RequestConditions, vals, names)
+	if err != nil {
+		return nil, err
+	}
+	filterExp, err := buildConditionExpression(r.ResultFitler, vals, names)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(struct {
+		Action                          Action
+		Table, Index, KeyExp, FilterExp string
+		Segment, TotalSegments          int
+		Names                           map[string]*string
+		Values                          map[string]*dynamodb.AttributeValue
+	}{r.Action, r.Table, r.Index, keyExp, filterExp, r.Segment, r.TotalSegments, names, vals})
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
+
+func signCursor(secret, payload []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// encodeCursor turns the last evaluated key of a query into an opaque, signed token
+func encodeCursor(secret []byte, r Request, lastKey map[string]*dynamodb.AttributeValue) (string, error) {
+	if len(secret) == 0 {
+		return "", errors.New("No cursor secret configured")
+	}
+
+	fp, err := queryFingerprint(r)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(cursor{Key: lastKey, Fingerprint: fp})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signCursor(secret, payload)), nil
+}
+
+// decodeCursor verifies a token produced by encodeCursor and returns the key the query should continue from.
+// The token is rejected if it has been tampered with or belongs to a different query
+func decodeCursor(secret []byte, r Request) (map[string]*dynamodb.AttributeValue, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("No cursor secret configured")
+	}
+
+	parts := strings.Split(r.Cursor, ".")
+	if len(parts) != 2 {
+		return nil, errors.New("Invalid cursor")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+	if !hmac.Equal(sig, signCursor(secret, payload)) {
+		return nil, errors.New("Invalid cursor: signature mismatch")
+	}
+
+	var c cursor
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, errors.New("Invalid cursor")
+	}
+
+	fp, err := queryFingerprint(r)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(fp, c.Fingerprint) {
+		return nil, errors.New("Invalid cursor: it does not belong to this query")
+	}
+
+	return c.Key, nil
+}
@@ -0,0 +1,123 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/sethjback/godba/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursor(t *testing.T) {
+	assert := assert.New(t)
+	secret := []byte("secret")
+
+	r := Request{Table: "events", Action: Query}
+	r.And("user", Equal, "u1")
+	key := map[string]*dynamodb.AttributeValue{
+		"user": &dynamodb.AttributeValue{S: aws.String("u1")},
+		"ts":   &dynamodb.AttributeValue{N: aws.String("4")}}
+
+	token, err := encodeCursor(secret, r, key)
+	assert.Nil(err)
+	assert.NotEmpty(token)
+
+	r.Cursor = token
+	k, err := decodeCursor(secret, r)
+	assert.Nil(err)
+	assert.Equal(key, k)
+
+	// wrong secret
+	_, err = decodeCursor([]byte("other"), r)
+	assert.NotNil(err)
+
+	// tampered payload
+	r.Cursor = "x" + token
+	_, err = decodeCursor(secret, r)
+	assert.NotNil(err)
+
+	// a different query
+	r.Cursor = token
+	r.RequestConditions = nil
+	r.And("user", Equal, "u2")
+	_, err = decodeCursor(secret, r)
+	if assert.NotNil(err) {
+		assert.Equal("Invalid cursor: it does not belong to this query", err.Error())
+	}
+
+	_, err = encodeCursor(nil, r, key)
+	assert.NotNil(err)
+
+	// another segment of the same scan, or a query with the same conditions as a scan
+	scan := Request{Table: "events", Action: Scan, Segment: 0, TotalSegments: 2}
+	scan.Cursor, err = encodeCursor(secret, scan, key)
+	assert.Nil(err)
+	_, err = decodeCursor(secret, scan)
+	assert.Nil(err)
+	other := scan
+	other.Segment = 1
+	_, err = decodeCursor(secret, other)
+	assert.NotNil(err)
+	other = scan
+	other.TotalSegments = 4
+	_, err = decodeCursor(secret, other)
+	assert.NotNil(err)
+	other = scan
+	other.Action = Query
+	_, err = decodeCursor(secret, other)
+	assert.NotNil(err)
+}
+
+func TestCursorPaging(t *testing.T) {
+	assert := assert.New(t)
+	c := NewMemory(config.Store{
+		CursorSecret: "secret",
+		Tables: map[string]TableSchema{
+			"events": TableSchema{HashKey: "user", RangeKey: "ts"}}})
+	putEvents(assert, c)
+
+	r := Request{Table: "events", Action: Query, Limit: 5}
+	r.And("user", Equal, "u1")
+
+	res, e := c.Run(r)
+	assert.Nil(e)
+	assert.Equal(5, res.GetItemCount())
+	if !assert.NotEmpty(res.GetCursor()) {
+		return
+	}
+
+	r.Cursor = res.GetCursor()
+	res, e = c.Run(r)
+	assert.Nil(e)
+	if assert.Equal(4, res.GetItemCount()) {
+		n, _ := res.GetNumberItem(0, "ts")
+		assert.Equal(6, n)
+	}
+	assert.Empty(res.GetCursor())
+
+	r.Cursor = "bogus"
+	_, e = c.Run(r)
+	assert.NotNil(e)
+
+	// the cursor key is sent exactly as it was signed, even when an int or float64 can not hold it
+	c = NewMemory(config.Store{
+		CursorSecret: "secret",
+		Tables: map[string]TableSchema{
+			"big": TableSchema{HashKey: "id", RangeKey: "n"}}})
+	for _, n := range []string{"123456789012345678901234567", "123456789012345678901234568"} {
+		_, e = c.Run(Request{Table: "big", Action: Put, Key: map[string]interface{}{"id": "a", "n": dynamodbattribute.Number(n)}, Item: map[string]interface{}{"v": n}})
+		assert.Nil(e)
+	}
+	r = Request{Table: "big", Action: Query, Limit: 1}
+	r.And("id", Equal, "a")
+	res, e = c.Run(r)
+	assert.Nil(e)
+	r.Cursor = res.GetCursor()
+	res, e = c.Run(r)
+	if assert.Nil(e) && assert.Equal(1, res.GetItemCount()) {
+		s, _ := res.GetStringItem(0, "v")
+		assert.Equal("123456789012345678901234568", s)
+	}
+}
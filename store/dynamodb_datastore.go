@@ -1,17 +1,24 @@
 package store
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/sethjback/godba/config"
+	godba "github.com/sethjback/godba/errors"
 )
 
 // DBer is a subset of the dynamoDB interface and is
@@ -23,20 +30,50 @@ type DBer interface {
 	UpdateItem(*dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error)
 	QueryPages(input *dynamodb.QueryInput, fn func(p *dynamodb.QueryOutput, lastPage bool) bool) error
 	Query(*dynamodb.QueryInput) (*dynamodb.QueryOutput, error)
+	Scan(*dynamodb.ScanInput) (*dynamodb.ScanOutput, error)
+	ScanPages(input *dynamodb.ScanInput, fn func(p *dynamodb.ScanOutput, lastPage bool) bool) error
+	BatchGetItem(*dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error)
+	BatchWriteItem(*dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error)
+	TransactWriteItems(*dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error)
+	TransactGetItems(*dynamodb.TransactGetItemsInput) (*dynamodb.TransactGetItemsOutput, error)
+
+	// the context aware versions are used for every call the datastore makes, so a cancelled or
+	// expired context stops the request, including any remaining pages or retries
+	GetItemWithContext(aws.Context, *dynamodb.GetItemInput, ...request.Option) (*dynamodb.GetItemOutput, error)
+	PutItemWithContext(aws.Context, *dynamodb.PutItemInput, ...request.Option) (*dynamodb.PutItemOutput, error)
+	DeleteItemWithContext(aws.Context, *dynamodb.DeleteItemInput, ...request.Option) (*dynamodb.DeleteItemOutput, error)
+	UpdateItemWithContext(aws.Context, *dynamodb.UpdateItemInput, ...request.Option) (*dynamodb.UpdateItemOutput, error)
+	QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(p *dynamodb.QueryOutput, lastPage bool) bool, opts ...request.Option) error
+	QueryWithContext(aws.Context, *dynamodb.QueryInput, ...request.Option) (*dynamodb.QueryOutput, error)
+	ScanWithContext(aws.Context, *dynamodb.ScanInput, ...request.Option) (*dynamodb.ScanOutput, error)
+	ScanPagesWithContext(ctx aws.Context, input *dynamodb.ScanInput, fn func(p *dynamodb.ScanOutput, lastPage bool) bool, opts ...request.Option) error
+	BatchGetItemWithContext(aws.Context, *dynamodb.BatchGetItemInput, ...request.Option) (*dynamodb.BatchGetItemOutput, error)
+	BatchWriteItemWithContext(aws.Context, *dynamodb.BatchWriteItemInput, ...request.Option) (*dynamodb.BatchWriteItemOutput, error)
+	TransactWriteItemsWithContext(aws.Context, *dynamodb.TransactWriteItemsInput, ...request.Option) (*dynamodb.TransactWriteItemsOutput, error)
+	TransactGetItemsWithContext(aws.Context, *dynamodb.TransactGetItemsInput, ...request.Option) (*dynamodb.TransactGetItemsOutput, error)
 }
 
 // make sure we implement the interface
 var _ DBer = (*dynamodb.DynamoDB)(nil)
 
 // DynamoDBDatastore implements the datastore interface
-// It holds a dynamodb DBer and manages db ops and rollbacks
+// It holds a dynamodb DBer and a read cache, and is safe for concurrent use. Transactions are run through
+// the Tx returned by StartTransaction, which keeps its own db ops for rollbacks
 type DynamoDBDatastore struct {
-	db            DBer
-	ops           []op
-	transaction   bool
-	cache         []op
-	tablePrefix   string
+	db              DBer
+	transactionMode TransactionMode
+	tablePrefix     string
+	cursorSecret    []byte
+	times           timeCodec
+	version         string
+	journal         Journal
+
+	mu            sync.Mutex // guards the cache
+	cache         *readCache
 	cacheDisabled bool
+	cacheSize     int
+	cacheTTL      time.Duration
+	counters      cacheCounters
 }
 
 // Individual operation performed in dynamodb. Used for rollbacks
@@ -51,7 +88,15 @@ type op struct {
 type dynamodbResult struct {
 	items      []map[string]*dynamodb.AttributeValue
 	attributes map[string]*dynamodb.AttributeValue
+	lastKey    map[string]*dynamodb.AttributeValue
+	cursor     string
 	pageCount  int
+	version    string
+	times      timeCodec // decodes the times in the items, see UnmarshalRow
+
+	// the ReturnValues of the request, attributes are only exposed when they were asked for. Transactions
+	// always read the old item to be able to roll back
+	returnValues ReturnValue
 }
 
 /**
@@ -109,6 +154,57 @@ func (r *dynamodbResult) GetBoolItem(itemIndex int, name string) (bool, bool) {
 	return *r.items[itemIndex][name].BOOL, true
 }
 
+// GetAttributes returns the attributes a Put, Update or Delete returned, as selected by the request's ReturnValues
+func (r *dynamodbResult) GetAttributes() map[string]interface{} {
+	if r.returnValues == None {
+		return nil
+	}
+	return unmarshalItems(r.attributes)
+}
+
+// GetAttribute returns a single returned attribute, second argument indicates if it was returned
+func (r *dynamodbResult) GetAttribute(name string) (interface{}, bool) {
+	if r.returnValues == None || r.attributes[name] == nil {
+		return nil, false
+	}
+	var out interface{}
+	if err := dynamodbattribute.Unmarshal(r.attributes[name], &out); err != nil {
+		return nil, false
+	}
+	return out, true
+}
+
+// GetNumberAttribute returns a returned attribute as an int, like the new value of a counter
+func (r *dynamodbResult) GetNumberAttribute(name string) (int, bool) {
+	if r.returnValues == None || r.attributes[name] == nil || r.attributes[name].N == nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(*r.attributes[name].N)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// UnmarshalAttributes decodes the returned attributes into a struct, using `godba` struct tags for the attribute names
+func (r *dynamodbResult) UnmarshalAttributes(out interface{}) error {
+	if r.returnValues == None {
+		return nil
+	}
+	if err := r.times.decode(structDecoder(), tagKey, &dynamodb.AttributeValue{M: r.attributes}, out); err != nil {
+		return dbError(godba.ErrorUnmarshalItem, "", "", "Could not unmarshal the returned attributes", err)
+	}
+	return nil
+}
+
+// GetVersion returns the version of an item when the datastore is configured with a VersionAttribute
+func (r *dynamodbResult) GetVersion(itemIndex int) (int, bool) {
+	if r.version == "" {
+		return 0, false
+	}
+	return r.GetNumberItem(itemIndex, r.version)
+}
+
 // GetItemCount returns the number of items retrieved from the DB
 func (r *dynamodbResult) GetItemCount() int {
 	return len(r.items)
@@ -120,13 +216,41 @@ func (r *dynamodbResult) UnmarshalItem(itemIndex int, name string, out interface
 	if !ok {
 		return nil, false
 	}
-	e := dynamodbattribute.Unmarshal(v, out)
+	e := r.times.decode(dynamodbattribute.NewDecoder(), "json", v, out)
 	if e != nil {
-		return errors.New("Could not unmarshal item" + "[" + e.Error() + "]"), false
+		return dbError(godba.ErrorUnmarshalItem, "", "", "Could not unmarshal item", e), false
 	}
 	return nil, true
 }
 
+// UnmarshalRow decodes a whole item into out, which should be a pointer to a struct or map
+func (r *dynamodbResult) UnmarshalRow(itemIndex int, out interface{}) error {
+	if itemIndex < 0 || itemIndex >= len(r.items) {
+		return dbError(godba.ErrorUnmarshalItem, "", "", "Could not unmarshal item", errors.New("index out of range"))
+	}
+	if err := r.times.decode(structDecoder(), tagKey, &dynamodb.AttributeValue{M: r.items[itemIndex]}, out); err != nil {
+		return dbError(godba.ErrorUnmarshalItem, "", "", "Could not unmarshal item", err)
+	}
+	return nil
+}
+
+// UnmarshalAll decodes every item into out, which should be a pointer to a slice. Missing items,
+// like those of a BatchGet, are nil for a slice of pointers and the zero value otherwise
+func (r *dynamodbResult) UnmarshalAll(out interface{}) error {
+	list := make([]*dynamodb.AttributeValue, len(r.items))
+	for i, item := range r.items {
+		if item == nil {
+			list[i] = &dynamodb.AttributeValue{NULL: aws.Bool(true)}
+		} else {
+			list[i] = &dynamodb.AttributeValue{M: item}
+		}
+	}
+	if err := r.times.decode(structDecoder(), tagKey, &dynamodb.AttributeValue{L: list}, out); err != nil {
+		return dbError(godba.ErrorUnmarshalItem, "", "", "Could not unmarshal items", err)
+	}
+	return nil
+}
+
 // GetItem returns a raw item
 func (r *dynamodbResult) GetItem(itemIndex int, name string) (interface{}, bool) {
 	i, ok := r.items[itemIndex][name]
@@ -136,23 +260,19 @@ func (r *dynamodbResult) GetItem(itemIndex int, name string) (interface{}, bool)
 	return nil, false
 }
 
+// GetLastEvaluatedKey returns the key a limited query stopped at, decoded into native values.
+// It can be passed straight back as Request.LastKey to fetch the next page. Nil means there is
+// nothing left to read
 func (r *dynamodbResult) GetLastEvaluatedKey() map[string]interface{} {
-	/*
-		if qO, ok := r.original.(*dynamodb.QueryOutput); ok {
-			m := make(map[string]interface{})
-			for k, v := range qO.LastEvaluatedKey {
-				if v.S != nil {
-					m[k] = *v.S
-				}
-				if v.N != nil {
-					m[k], _ = strconv.Atoi(*v.N)
-				}
-			}
+	if len(r.lastKey) == 0 {
+		return nil
+	}
+	return decodeKey(r.lastKey)
+}
 
-			return m
-		}
-	*/
-	return nil
+// GetCursor returns the signed pagination token for the last evaluated key
+func (r *dynamodbResult) GetCursor() string {
+	return r.cursor
 }
 
 func (r *dynamodbResult) PageCount() int {
@@ -169,10 +289,30 @@ const (
 	Session config.Option = iota
 	Endpoint
 	TablePrefix
+	Tables             // map[string]TableSchema of the tables for the memory store
+	CursorSecret       // string or []byte used to sign pagination cursors
+	Transactions       // the TransactionMode used by StartTransaction, Compensating by default
+	TimeFormat         // the TimeEncoding used for time.Time values in requests and results, TimeRFC3339 by default
+	VersionAttribute   // the name of the attribute used for optimistic locking, see Request.Version. Off by default
+	TransactionJournal // a Journal that durably records Compensating transactions, so they can be recovered after a crash
+	CacheSize          // int, the most items kept in the read cache. 1000 by default
+	CacheTTL           // time.Duration that items stay in the read cache. By default they stay until a write removes them
 )
 
+// cursorSecret reads the CursorSecret option
+func cursorSecret(c config.Store) []byte {
+	s, ok := c.Get(CursorSecret)
+	if !ok {
+		return nil
+	}
+	if b, ok := s.([]byte); ok {
+		return b
+	}
+	return []byte(s.(string))
+}
+
 func NewDynamodb(c config.Store) *DynamoDBDatastore {
-	dbc := &DynamoDBDatastore{transaction: false}
+	dbc := &DynamoDBDatastore{}
 
 	var sess *session.Session
 
@@ -187,11 +327,31 @@ func NewDynamodb(c config.Store) *DynamoDBDatastore {
 
 	dbc.db = dynamodb.New(sess, &aws.Config{Endpoint: aws.String(dbe)})
 
-	dbc.tablePrefix = c.GetString(TablePrefix)
+	dbc.configure(c)
 
 	return dbc
 }
 
+// configure applies the options shared by every datastore backed by a DBer
+func (c *DynamoDBDatastore) configure(cfg config.Store) {
+	c.tablePrefix = cfg.GetString(TablePrefix)
+	c.cursorSecret = cursorSecret(cfg)
+	if m, ok := cfg.Get(Transactions); ok {
+		c.transactionMode = m.(TransactionMode)
+	}
+	if t, ok := cfg.Get(TimeFormat); ok {
+		c.times = timeCodec{t.(TimeEncoding)}
+	}
+	c.version = cfg.GetString(VersionAttribute)
+	if j, ok := cfg.Get(TransactionJournal); ok {
+		c.journal = j.(Journal)
+	}
+	c.cacheSize = cfg.GetNum(CacheSize)
+	if ttl, ok := cfg.Get(CacheTTL); ok {
+		c.cacheTTL = ttl.(time.Duration)
+	}
+}
+
 /**
 
 Implements the DataStore interface
@@ -200,103 +360,382 @@ Implements the DataStore interface
 
 // clears the result cache
 func (c *DynamoDBDatastore) ClearCache() {
-	c.cache = nil
-	c.ops = nil
+	c.cacheFor(nil).clear()
+}
+
+// CacheStats returns the read cache's hit and miss counts since the datastore was created
+func (c *DynamoDBDatastore) CacheStats() CacheStats {
+	return CacheStats{
+		Hits:    atomic.LoadUint64(&c.counters.hits),
+		Misses:  atomic.LoadUint64(&c.counters.misses),
+		Entries: c.cacheFor(nil).len()}
 }
 
 func (c *DynamoDBDatastore) CacheOn() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.cacheDisabled = false
 }
 
 func (c *DynamoDBDatastore) CacheOff() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.cacheDisabled = true
 }
 
 // Run runs a single reqeust operation on the DB
 func (c *DynamoDBDatastore) Run(request Request) (Result, error) {
+	return c.RunContext(context.Background(), request)
+}
 
-	var r *dynamodbResult
-	var e error
+// RunContext runs a single request operation on the DB. The request is abandoned when ctx is
+// cancelled or its deadline passes, and the context's error is returned if that happens before it starts
+func (c *DynamoDBDatastore) RunContext(ctx context.Context, request Request) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return c.run(ctx, nil, c.prepare(request))
+}
+
+// prepare encodes the times in a request, adds the version check and prefixes its tables
+func (c *DynamoDBDatastore) prepare(request Request) Request {
+	request = c.times.request(request)
+	if c.version != "" {
+		request = versioned(request, c.version)
+	}
 
 	request.Table = c.tablePrefix + request.Table
+	switch request.Action {
+	case BatchGet, BatchWrite, TransactGet:
+		request.Batch = c.prefixBatch(request.Batch)
+	}
+
+	return request
+}
+
+// run sends a prepared request to the backend, as part of tx unless it is nil. Rollbacks use it directly,
+// the reversing requests are built from requests that have already been prepared
+func (c *DynamoDBDatastore) run(ctx context.Context, tx *dynamodbTx, request Request) (Result, error) {
+	var r *dynamodbResult
+	var e error
+	var replaced []map[string]*dynamodb.AttributeValue // for a BatchWrite in a transaction, the items it replaces
+	var applied []int                                  // for a BatchWrite, the requests that were written
+	var writes []int                                   // for a BatchWrite in a journaled transaction, the number of each write
+	var generation uint64                              // for a Get, the cache generation it started at
+
+	if tx != nil && c.transactionMode == Atomic {
+		switch request.Action {
+		case Put, Update, Delete, BatchWrite:
+			return tx.buffer(request)
+		}
+	}
 
 	switch request.Action {
-	case Put:
-		r, e = put(c.db, request)
-	case Delete:
-		if c.transaction {
-			request.ReturnValues = "ALL_OLD"
+	case Put, Update, Delete:
+		returned := request.ReturnValues
+		write := -1 // the number of the write in the journal
+		if tx != nil {
+			if returned != None && returned != AllOld {
+				return nil, dbError(godba.ErrorInvalidRequest, "", request.Table, "Could not write item", errTransactionReturnValues)
+			}
+			request.ReturnValues = AllOld
+			if c.journal != nil {
+				if request, write, e = tx.journalWrite(ctx, request); e != nil {
+					return nil, e
+				}
+			}
+		}
+		switch request.Action {
+		case Put:
+			r, e = put(ctx, c.db, request)
+		case Update:
+			r, e = update(ctx, c.db, request)
+		default:
+			r, e = dbDelete(ctx, c.db, request)
+		}
+		if e == nil {
+			r.returnValues = returned
+		}
+		// a write that failed any other way may have been applied, its entry is left for the check to tell
+		if write >= 0 && (e == nil || notApplied(e)) {
+			if err := tx.markJournal(ctx, request.Table, write, e == nil); err != nil {
+				return nil, err
+			}
 		}
-		r, e = dbDelete(c.db, request)
+		// removed even if the write failed, it may have been applied before the error
+		c.invalidate(tx, request)
 	case Get:
+		// partial items are not cached
+		cached := !request.LiveData && len(request.Projection) == 0
 		//check if we've already done this
-		if !request.LiveData && !c.cacheDisabled {
-			for _, op := range c.cache {
-				if keysEqual(op.request.Key, request.Key) {
-					return op.result, nil
-				}
+		if cached {
+			if r := c.cached(tx, request); r != nil {
+				return r, nil
 			}
 		}
-		r, e = get(c.db, request)
-		if e == nil {
-			c.cache = append(c.cache, op{request, r})
+		generation = c.cacheFor(tx).start()
+		r, e = get(ctx, c.db, request)
+	case Query, Scan:
+		if request.Cursor != "" {
+			lastKey, err := decodeCursor(c.cursorSecret, request)
+			if err != nil {
+				return nil, dbError(godba.ErrorCursor, "", request.Table, "Could not read items", err)
+			}
+			// passed through as attribute values so the key is sent exactly as it was signed
+			request.LastKey = rawItem(lastKey)
 		}
-	case Update:
-		if c.transaction {
-			request.ReturnValues = "ALL_OLD"
+		if request.Action == Query {
+			r, e = query(ctx, c.db, request)
+		} else {
+			r, e = scan(ctx, c.db, request)
+		}
+		if e == nil && len(r.lastKey) != 0 && len(c.cursorSecret) != 0 {
+			r.cursor, e = encodeCursor(c.cursorSecret, request, r.lastKey)
 		}
-		r, e = update(c.db, request)
-	case Query:
-		r, e = query(c.db, request)
 	case QueryPager:
-		r, e = queryPages(c.db, request)
+		r, e = queryPages(ctx, c.db, request)
+	case ParallelScan:
+		r, e = parallelScan(ctx, c.db, request)
+	case TransactGet:
+		r, e = transactGet(ctx, c.db, request)
+	case BatchGet, BatchWrite:
+		if request.Action == BatchGet {
+			r, e = batchGet(ctx, c.db, request)
+		} else {
+			if tx != nil {
+				for _, b := range request.Batch {
+					if b.Action == Delete {
+						return nil, dbError(godba.ErrorInvalidRequest, "BatchWriteItem", b.Table, "Could not write items", errors.New("batch deletes can not be rolled back, use Delete inside a transaction"))
+					}
+				}
+			}
+			// BatchWriteItem can not return old items, so the ones a rollback puts back are read first.
+			// Its writes can not be conditional either, a concurrent change to one of the items between
+			// the read and the write is lost if the transaction is rolled back
+			if tx != nil {
+				if replaced, e = batchOldItems(ctx, c.db, request.Batch); e != nil {
+					return nil, e
+				}
+				if c.journal != nil {
+					if request, writes, e = tx.journalBatch(ctx, request, replaced); e != nil {
+						return nil, e
+					}
+				}
+			}
+			r, applied, e = batchWrite(ctx, c.db, request)
+			c.invalidate(tx, request.Batch...)
+			// the others may still have been written if a call failed part way, their entries are left for the check to tell
+			for _, i := range applied {
+				if writes != nil && writes[i] >= 0 {
+					if err := tx.markJournal(ctx, request.Batch[i].Table, writes[i], true); err != nil && e == nil {
+						e = err
+					}
+				}
+			}
+		}
+	}
+
+	if r != nil {
+		r.version = c.version
+		r.times = c.times
 	}
 
-	if c.transaction && e == nil {
-		c.ops = append(c.ops, op{request, r})
+	// cached once complete, other goroutines share a cached result so it is not changed after this
+	if request.Action == Get && e == nil && len(request.Projection) == 0 {
+		c.addCache(tx, request, r, generation)
+	}
+
+	if tx != nil {
+		switch request.Action {
+		case BatchWrite:
+			// record each put so it is reversed individually, with the item it replaced. The ones written
+			// before a failure are recorded too, so they are rolled back
+			for _, i := range applied {
+				tx.record(op{request.Batch[i], &dynamodbResult{attributes: replaced[i]}})
+			}
+		case Put, Update, Delete:
+			if e == nil {
+				tx.record(op{request, r})
+			}
+		}
 	}
 
 	return r, e
 }
 
-func keysEqual(k1 map[string]interface{}, k2 map[string]interface{}) bool {
-	if len(k1) != len(k2) {
-		return false
+// versioned adds optimistic locking to a Put or Update: the request only succeeds if the item's version
+// attribute is still r.Version, or the item has no version when r.Version is 0, and it writes r.Version+1
+func versioned(r Request, attribute string) Request {
+	if r.Action != Put && r.Action != Update {
+		return r
 	}
 
-	for i, v := range k1 {
-		if k2[i] == nil || k2[i] != v {
-			return false
+	check := Where(attribute, Equal, r.Version)
+	if r.Version == 0 {
+		check = Where(attribute, NotExist, nil)
+	}
+	conditions := []RequestCondition{check}
+	if len(r.RequestConditions) != 0 {
+		// grouped so an Or among them can not bypass the version check
+		conditions = []RequestCondition{RequestCondition{Group: r.RequestConditions}, check}
+	}
+	r.RequestConditions = conditions
+
+	if r.Action == Put {
+		item := make(map[string]interface{}, len(r.Item)+1)
+		for k, v := range r.Item {
+			item[k] = v
+		}
+		item[attribute] = r.Version + 1
+		r.Item = item
+	} else {
+		r.Updates = append(append([]UpdateValue{}, r.Updates...), UpdateValue{Action: Put, Path: attributePath(attribute), Value: r.Version + 1})
+	}
+
+	return r
+}
+
+// errTransactionReturnValues is returned for a write in a Compensating transaction that asks for new or
+// updated values. Those requests need the whole old item to roll back
+var errTransactionReturnValues = errors.New("only None or AllOld can be returned inside a transaction")
+
+// errWriteReturnValues is returned for a Put or Delete that asks for new or updated values, dynamodb only
+// supports those for Update
+var errWriteReturnValues = errors.New("only None or AllOld can be returned by a Put or Delete")
+
+// dbError builds the error returned when a request fails. If err is already a godba error its code
+// is kept, it is more specific than the one for the request as a whole
+func dbError(code, op, table, message string, err error) error {
+	if c := godba.Code(err); c != "" {
+		code = c
+	}
+	if godba.IsConditionFailed(err) {
+		code = godba.ErrorConditionFailed
+	}
+	return &godba.Error{Code: code, Op: op, Table: table, Message: message, Err: err}
+}
+
+// prefixBatch returns a copy of the batched requests with the table prefix applied
+func (c *DynamoDBDatastore) prefixBatch(requests []Request) []Request {
+	batch := make([]Request, len(requests))
+	for i, b := range requests {
+		b.Table = c.tablePrefix + b.Table
+		batch[i] = b
+	}
+	return batch
+}
+
+// cacheFor returns the read cache for a request, the transaction's when there is one
+func (c *DynamoDBDatastore) cacheFor(tx *dynamodbTx) *readCache {
+	if tx != nil {
+		if tx.cache == nil {
+			tx.cache = newReadCache(c.cacheSize, c.cacheTTL, &c.counters)
 		}
+		return tx.cache
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil {
+		c.cache = newReadCache(c.cacheSize, c.cacheTTL, &c.counters)
+	}
+	return c.cache
+}
+
+// cached returns the result of an earlier Get of the same item, or nil
+func (c *DynamoDBDatastore) cached(tx *dynamodbTx, request Request) *dynamodbResult {
+	c.mu.Lock()
+	disabled := c.cacheDisabled
+	c.mu.Unlock()
+	if disabled {
+		return nil
+	}
+
+	key, ok := cacheKey(request.Table, request.Key)
+	if !ok {
+		return nil
 	}
+	return c.cacheFor(tx).get(key)
+}
 
-	return true
+// addCache caches the result of a Get sent at generation, unless a write invalidated the cache since
+func (c *DynamoDBDatastore) addCache(tx *dynamodbTx, request Request, r *dynamodbResult, generation uint64) {
+	if key, ok := cacheKey(request.Table, request.Key); ok {
+		c.cacheFor(tx).add(key, r, generation)
+	}
 }
 
-// StartTransaction initializes the client to record multiple operations, which can be rolled back later
-func (c *DynamoDBDatastore) StartTransaction() {
-	c.transaction = true
-	c.ops = make([]op, 0)
+// invalidate removes the items written by requests from the datastore's cache, and from the transaction's
+// cache when there is one. The caches of other transactions only see their own writes
+func (c *DynamoDBDatastore) invalidate(tx *dynamodbTx, requests ...Request) {
+	for _, r := range requests {
+		c.cacheFor(nil).removeWritten(r)
+		if tx != nil && tx.cache != nil {
+			tx.cache.removeWritten(r)
+		}
+	}
 }
 
-func (c *DynamoDBDatastore) FinishTransaction() {
-	c.transaction = false
-	c.ops = nil
+// StartTransaction starts a transaction. Its requests are recorded so they can be rolled back later, or in
+// Atomic mode its writes are buffered instead, and committed together by Finish. Transactions started
+// at the same time are independent of each other
+func (c *DynamoDBDatastore) StartTransaction() Tx {
+	return &dynamodbTx{c: c}
 }
 
-// Rollback runs through successfully completed requests and reverses them
-// If there are any errors when performing the reversing function, they are returned
-func (c *DynamoDBDatastore) Rollback() []error {
-	c.transaction = false
+// compensate runs the reversing requests of a transaction, last one first, as later writes may depend on
+// earlier ones. The transaction's journal is closed once they have all succeeded
+func (c *DynamoDBDatastore) compensate(ctx context.Context, tx string, reverse []Request) []error {
 	var errs []error
-	for _, op := range c.ops {
-		reverse := reverseOp(op)
-		_, e := c.Run(*reverse)
-		if e != nil {
+	for i := len(reverse) - 1; i >= 0; i-- {
+		// the reverse puts back the old version, it does not bump it again
+		if _, e := c.run(ctx, nil, reverse[i]); e != nil {
+			// a conditional reverse is for a write that may not have been applied. It was not, or the item
+			// has changed since and is left as it is
+			if len(reverse[i].RequestConditions) != 0 && godba.IsConditionFailed(e) {
+				continue
+			}
 			errs = append(errs, e)
 		}
 	}
 
+	if tx != "" && len(errs) == 0 {
+		if err := c.journal.End(ctx, tx); err != nil {
+			errs = append(errs, dbError(godba.ErrorJournal, "", "", "Could not close the transaction journal", err))
+		}
+	}
+
+	return errs
+}
+
+// Recover finishes the compensation of the transactions a stopped process left open in the journal, rolling
+// back their writes. It should be run when the journal is not in use, usually as a process starts
+func (c *DynamoDBDatastore) Recover() []error {
+	return c.RecoverContext(context.Background())
+}
+
+// RecoverContext is Recover with a context for the reversing requests
+func (c *DynamoDBDatastore) RecoverContext(ctx context.Context) []error {
+	if c.journal == nil {
+		return nil
+	}
+
+	txs, err := c.journal.Open(ctx)
+	if err != nil {
+		return []error{dbError(godba.ErrorJournal, "", "", "Could not read the transaction journal", err)}
+	}
+
+	var errs []error
+	for _, tx := range txs {
+		entries, err := c.journal.Entries(ctx, tx)
+		if err != nil {
+			errs = append(errs, dbError(godba.ErrorJournal, "", "", "Could not read the transaction journal", err))
+			continue
+		}
+		errs = append(errs, c.compensate(ctx, tx, journalRequests(entries))...)
+	}
+
 	return errs
 }
 
@@ -316,58 +755,226 @@ func buildConditionExpression(conditions []RequestCondition, expAttVals map[stri
 			exp += c.RelationshipString() + " "
 		}
 
-		fName := "#ename" + strconv.Itoa(valN)
-		expAttNames[fName] = aws.String(c.Field)
-		valN++
+		// start of this condition, so it can be wrapped in NOT
+		mark := len(exp)
+
+		if c.Group != nil {
+			if len(c.Group) == 0 {
+				return "", errors.New("Invalid request condition: empty group")
+			}
+			sub, err := buildConditionExpression(c.Group, expAttVals, expAttNames)
+			if err != nil {
+				return "", err
+			}
+			exp += "(" + sub + ")"
+			valI = len(expAttVals)
+			valN = len(expAttNames)
+			if c.Negate {
+				exp = exp[:mark] + "NOT " + exp[mark:]
+			}
+			continue
+		}
+
+		fName, err := conditionPath(c.Field, valN, expAttNames)
+		if err != nil {
+			return "", err
+		}
+		valN = len(expAttNames)
+
+		val := func(av *dynamodb.AttributeValue) string {
+			name := ":val" + strconv.Itoa(valI)
+			expAttVals[name] = av
+			valI++
+			return name
+		}
 
 		switch c.Type {
 		case Exist:
 			exp += "attribute_exists(" + fName + ")"
 		case NotExist:
 			exp += "attribute_not_exists(" + fName + ")"
-		case GreaterThan:
-			if i, ok := c.Value.(int); ok {
-				exp += fName + " > :val" + strconv.Itoa(valI)
-				expAttVals[":val"+strconv.Itoa(valI)] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(i))}
-				valI++
-			} else {
-				return "", errors.New("Invalid request condition: GreaterThan condition value must be an int")
+		case Equal, NotEqual, GreaterThan, LessThan, GreaterOrEqual, LessOrEqual:
+			av, err := conditionValue(c, c.Value)
+			if err != nil {
+				return "", err
 			}
-		case LessThan:
-			if i, ok := c.Value.(int); ok {
-				exp += fName + " < :val" + strconv.Itoa(valI)
-				expAttVals[":val"+strconv.Itoa(valI)] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(i))}
-				valI++
-			} else {
-				return "", errors.New("Invalid request condition: LessThan condition value must be an int")
-			}
-		case Equal:
-			exp += fName + " = :val" + strconv.Itoa(valI)
-			switch reflect.TypeOf(c.Value).Name() {
-			case "int":
-				expAttVals[":val"+strconv.Itoa(valI)] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(c.Value.(int)))}
-			case "string":
-				expAttVals[":val"+strconv.Itoa(valI)] = &dynamodb.AttributeValue{S: aws.String(c.Value.(string))}
-			default:
-				return "", errors.New("Invalid request condition: Equal condition value must be int or string")
+			if c.Type != Equal && c.Type != NotEqual && !orderedValue(av) {
+				return "", errors.New("Invalid request condition: " + c.Type.String() + " condition value must be a number, string or binary")
 			}
-			valI++
+			exp += fName + " " + comparators[c.Type] + " " + val(av)
 		case BeginsWith:
-			if st, ok := c.Value.(string); ok {
-				exp += "begins_with(" + fName + ", :val" + strconv.Itoa(valI) + ")"
-				expAttVals[":val"+strconv.Itoa(valI)] = &dynamodb.AttributeValue{S: aws.String(st)}
-				valI++
-			} else {
-				return "", errors.New("Invalid request condition: BeginsWith condition value must be a string")
+			av, err := conditionValue(c, c.Value)
+			if err != nil {
+				return "", err
+			}
+			if av.S == nil && av.B == nil {
+				return "", errors.New("Invalid request condition: BeginsWith condition value must be a string or binary")
+			}
+			exp += "begins_with(" + fName + ", " + val(av) + ")"
+		case Between:
+			vals, err := conditionValues(c)
+			if err != nil {
+				return "", err
+			}
+			if len(vals) != 2 || !orderedValue(vals[0]) || !orderedValue(vals[1]) {
+				return "", errors.New("Invalid request condition: Between condition value must be a slice of two numbers, strings or binaries")
+			}
+			exp += fName + " BETWEEN " + val(vals[0]) + " AND " + val(vals[1])
+		case In:
+			vals, err := conditionValues(c)
+			if err != nil {
+				return "", err
+			}
+			if len(vals) == 0 || len(vals) > 100 {
+				return "", errors.New("Invalid request condition: In condition value must be a slice of 1 to 100 values")
+			}
+			names := make([]string, len(vals))
+			for i, av := range vals {
+				names[i] = val(av)
+			}
+			exp += fName + " IN (" + strings.Join(names, ", ") + ")"
+		case Contains:
+			av, err := conditionValue(c, c.Value)
+			if err != nil {
+				return "", err
+			}
+			exp += "contains(" + fName + ", " + val(av) + ")"
+		case SizeGreaterThan, SizeEquals:
+			av, err := conditionValue(c, c.Value)
+			if err != nil {
+				return "", err
 			}
+			if av.N == nil {
+				return "", errors.New("Invalid request condition: " + c.Type.String() + " condition value must be a number")
+			}
+			exp += "size(" + fName + ") " + comparators[c.Type] + " " + val(av)
+		case AttributeType:
+			t, ok := c.Value.(string)
+			if !ok || !attributeTypes[t] {
+				return "", errors.New("Invalid request condition: AttributeType condition value must be one of S, SS, N, NS, B, BS, BOOL, NULL, L or M")
+			}
+			exp += "attribute_type(" + fName + ", " + val(&dynamodb.AttributeValue{S: aws.String(t)}) + ")"
 		default:
 			return "", errors.New("Unknown request condition")
 		}
+
+		if c.Negate {
+			exp = exp[:mark] + "NOT (" + exp[mark:] + ")"
+		}
 	}
 
 	return exp, nil
 }
 
+// conditionPath translates a condition field into an expression path. Fields starting with / are rfc6901
+// paths, like the ones used for updates, so conditions can reach into nested maps and lists.
+// Anything else is a single attribute name
+func conditionPath(field string, n int, expAttNames map[string]*string) (string, error) {
+	if !strings.HasPrefix(field, "/") {
+		name := "#ename" + strconv.Itoa(n)
+		expAttNames[name] = aws.String(field)
+		return name, nil
+	}
+
+	path := ""
+	for _, seg := range strings.Split(field, "/")[1:] {
+		if _, err := strconv.Atoi(seg); err == nil {
+			if path == "" {
+				return "", errors.New("Invalid path " + field + ": it can not start with a list index")
+			}
+			path += "[" + seg + "]"
+			continue
+		}
+		if seg == "" || seg == "-" {
+			return "", errors.New("Invalid path " + field)
+		}
+
+		name := "#ename" + strconv.Itoa(n)
+		expAttNames[name] = aws.String(unescapePathSegment(seg))
+		n++
+		if path != "" {
+			path += "."
+		}
+		path += name
+	}
+
+	return path, nil
+}
+
+// buildProjectionExpression translates the attributes to read into a projection expression. Like condition
+// fields, they can be attribute names or rfc6901 paths
+func buildProjectionExpression(paths []string, expAttNames map[string]*string) (string, error) {
+	exp := make([]string, 0, len(paths))
+	for _, p := range paths {
+		path, err := conditionPath(p, len(expAttNames), expAttNames)
+		if err != nil {
+			return "", err
+		}
+		exp = append(exp, path)
+	}
+	return strings.Join(exp, ", "), nil
+}
+
+// attributePath returns the rfc6901 path of a top level attribute, escaping the / and ~ in its name
+func attributePath(name string) string {
+	return "/" + strings.Replace(strings.Replace(name, "~", "~0", -1), "/", "~1", -1)
+}
+
+// unescapePathSegment decodes the ~1 and ~0 escapes rfc6901 uses for / and ~ in a segment
+func unescapePathSegment(seg string) string {
+	return strings.Replace(strings.Replace(seg, "~1", "/", -1), "~0", "~", -1)
+}
+
+// the types accepted by an AttributeType condition
+var attributeTypes = map[string]bool{"S": true, "SS": true, "N": true, "NS": true, "B": true, "BS": true, "BOOL": true, "NULL": true, "L": true, "M": true}
+
+// the operators of the comparison conditions
+var comparators = map[Condition]string{
+	Equal:           "=",
+	NotEqual:        "<>",
+	GreaterThan:     ">",
+	LessThan:        "<",
+	GreaterOrEqual:  ">=",
+	LessOrEqual:     "<=",
+	SizeGreaterThan: ">",
+	SizeEquals:      "=",
+}
+
+// conditionValue encodes a condition value with the same encoder used for items. Values that can not
+// be stored in dynamodb are rejected with an ErrorEncodeValue error
+func conditionValue(c RequestCondition, v interface{}) (*dynamodb.AttributeValue, error) {
+	av, err := encodeValue(v)
+	if err == nil && reflect.DeepEqual(av, &dynamodb.AttributeValue{}) {
+		err = errors.New("unsupported type " + reflect.TypeOf(v).String())
+	}
+	if err != nil {
+		return nil, &godba.Error{Code: godba.ErrorEncodeValue, Message: "Invalid request condition: could not encode " + c.Type.String() + " condition value", Err: err}
+	}
+	return av, nil
+}
+
+// conditionValues encodes the elements of a slice or array condition value
+func conditionValues(c RequestCondition) ([]*dynamodb.AttributeValue, error) {
+	rv := reflect.ValueOf(c.Value)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, errors.New("Invalid request condition: " + c.Type.String() + " condition value must be a slice")
+	}
+	vals := make([]*dynamodb.AttributeValue, rv.Len())
+	for i := range vals {
+		av, err := conditionValue(c, rv.Index(i).Interface())
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = av
+	}
+	return vals, nil
+}
+
+// orderedValue reports whether a value can be used in a range comparison
+func orderedValue(av *dynamodb.AttributeValue) bool {
+	return av.N != nil || av.S != nil || av.B != nil
+}
+
 // translates the path from an rfc6901 path into a dynamodb update expression path
 // the only major difference is that list items are not referenece by a delimiter, but rather
 // by the array type notation (i.e. list[1] vs. list.1)
@@ -391,7 +998,7 @@ func parseUpdateKey(key string, index int) (string, map[string]string) {
 				ename = "-"
 			} else {
 				ename = "#" + iString + "ename" + strconv.Itoa(i)
-				names[ename] = val
+				names[ename] = unescapePathSegment(val)
 			}
 
 			if final == "" {
@@ -409,7 +1016,13 @@ func parseUpdateKey(key string, index int) (string, map[string]string) {
 // into a dynamodb update expression
 // It uses :val placeholders for the actual values and indexes them in the expAttMap
 func buildUpdateExpression(items []UpdateValue, expAttMap map[string]*dynamodb.AttributeValue, expAttName map[string]*string) (string, error) {
-	expMap := map[string]string{"SET": "", "REMOVE": ""}
+	expMap := map[string]string{"SET": "", "REMOVE": "", "ADD": "", "DELETE": ""}
+	clause := func(name, exp string) {
+		if expMap[name] != "" {
+			expMap[name] += ", "
+		}
+		expMap[name] += exp
+	}
 
 	i := len(expAttMap)
 	n := len(expAttName)
@@ -429,45 +1042,170 @@ func buildUpdateExpression(items []UpdateValue, expAttMap map[string]*dynamodb.A
 			}
 			expMap["REMOVE"] += k
 		case Put, Update:
+			if v.From != "" {
+				if strings.HasSuffix(k, ".-") {
+					return "", errors.New("Invalid update: the value from " + v.From + " can not be appended to a list")
+				}
+				fk, fVals := parseUpdateKey(v.From, n)
+				for nName, nVal := range fVals {
+					expAttName[nName] = aws.String(nVal)
+				}
+				n++
+				clause("SET", k+" = "+fk)
+				continue
+			}
+
 			val, err := marshalItems(map[string]interface{}{k: v.Value})
 			if err != nil {
 				return "", errors.New("Unable to marshal item: " + err.Error())
 			}
-			// for all else use set
-			if expMap["SET"] != "" {
-				expMap["SET"] += ", "
-			}
 
-			last := k[len(k)-1:]
-			// if that last part of the path is - this is an array update
-			switch last {
-			case "-":
-				//TODO: this will fail if list >= 999*
-				nK := k[:len(k)-2] + "[999" + strconv.Itoa(n) + "]"
-				expMap["SET"] += nK + " = " + valStr
-			default:
-				expMap["SET"] += k + " = " + valStr
+			// if that last part of the path is - the value is appended to the list
+			if strings.HasSuffix(k, ".-") {
+				emptyStr := ":val" + strconv.Itoa(i+1)
+				lk := k[:len(k)-2]
+				clause("SET", lk+" = list_append(if_not_exists("+lk+", "+emptyStr+"), "+valStr+")")
+				expAttMap[valStr] = &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{val[k]}}
+				expAttMap[emptyStr] = &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{}}
+				i += 2
+				continue
 			}
+			clause("SET", k+" = "+valStr)
 			expAttMap[valStr] = val[k]
-		}
-
-		i++
-	}
-
-	finalExp := ""
-	if expMap["SET"] != "" {
-		finalExp += "SET " + expMap["SET"]
-	}
-	if expMap["REMOVE"] != "" {
-		if finalExp != "" {
-			finalExp += " "
-		}
-		finalExp += "REMOVE " + expMap["REMOVE"]
-	}
+			i++
+		case Append, Prepend:
+			av, err := listValue(v.Value)
+			if err != nil {
+				return "", errors.New("Unable to marshal item: " + err.Error())
+			}
+			// a missing list starts empty
+			emptyStr := ":val" + strconv.Itoa(i+1)
+			if v.Action == Append {
+				clause("SET", k+" = list_append(if_not_exists("+k+", "+emptyStr+"), "+valStr+")")
+			} else {
+				clause("SET", k+" = list_append("+valStr+", if_not_exists("+k+", "+emptyStr+"))")
+			}
+			expAttMap[valStr] = av
+			expAttMap[emptyStr] = &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{}}
+			i += 2
+		case Insert:
+			return "", errors.New("Invalid update: inserting at " + v.Path + " needs the current list, it can only be used in a single Update request")
+		case Increment, Decrement:
+			av, err := encodeValue(v.Value)
+			if err != nil {
+				return "", errors.New("Unable to marshal item: " + err.Error())
+			}
+			if av.N == nil {
+				return "", errors.New("Invalid update: " + v.Path + " can only be incremented or decremented by a number")
+			}
+			op := " + "
+			if v.Action == Decrement {
+				op = " - "
+			}
+			// a missing counter starts at zero
+			zeroStr := ":val" + strconv.Itoa(i+1)
+			clause("SET", k+" = if_not_exists("+k+", "+zeroStr+")"+op+valStr)
+			expAttMap[valStr] = av
+			expAttMap[zeroStr] = &dynamodb.AttributeValue{N: aws.String("0")}
+			i += 2
+		case AddToSet, RemoveFromSet:
+			if len(nVals) != 1 || strings.ContainsAny(k, "[.") {
+				return "", errors.New("Invalid update: " + v.Path + " is not a top level attribute, sets can only be updated at the top level")
+			}
+			av, err := setValue(v.Value)
+			if err != nil {
+				return "", errors.New("Invalid update: " + v.Path + " " + err.Error())
+			}
+			if v.Action == AddToSet {
+				clause("ADD", k+" "+valStr)
+			} else {
+				clause("DELETE", k+" "+valStr)
+			}
+			expAttMap[valStr] = av
+			i++
+		case SetIfNotExists:
+			val, err := encodeValue(v.Value)
+			if err != nil {
+				return "", errors.New("Unable to marshal item: " + err.Error())
+			}
+			clause("SET", k+" = if_not_exists("+k+", "+valStr+")")
+			expAttMap[valStr] = val
+			i++
+		default:
+			return "", errors.New("Invalid update: unsupported update action for " + v.Path)
+		}
+	}
+
+	finalExp := ""
+	if expMap["SET"] != "" {
+		finalExp += "SET " + expMap["SET"]
+	}
+	if expMap["REMOVE"] != "" {
+		if finalExp != "" {
+			finalExp += " "
+		}
+		finalExp += "REMOVE " + expMap["REMOVE"]
+	}
+	for _, name := range []string{"ADD", "DELETE"} {
+		if expMap[name] != "" {
+			if finalExp != "" {
+				finalExp += " "
+			}
+			finalExp += name + " " + expMap[name]
+		}
+	}
 
 	return finalExp, nil
 }
 
+// listValue encodes the elements added by an Append or Prepend. The elements of a slice are added
+// individually, any other value is added as a single element
+func listValue(v interface{}) (*dynamodb.AttributeValue, error) {
+	av, err := encodeValue(v)
+	if err != nil {
+		return nil, err
+	}
+	if av.L != nil {
+		return av, nil
+	}
+	return &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{av}}, nil
+}
+
+// setValue encodes a set update value. Slices of strings, numbers or binaries become the matching set type,
+// and a single value is a set of one
+func setValue(v interface{}) (*dynamodb.AttributeValue, error) {
+	av, err := encodeValue(v)
+	if err != nil {
+		return nil, err
+	}
+	if av.SS != nil || av.NS != nil || av.BS != nil {
+		return av, nil
+	}
+
+	elems := av.L
+	if elems == nil {
+		elems = []*dynamodb.AttributeValue{av}
+	}
+	if len(elems) == 0 {
+		return nil, errors.New("set values can not be empty")
+	}
+
+	set := &dynamodb.AttributeValue{}
+	for _, e := range elems {
+		switch {
+		case e.S != nil && set.NS == nil && set.BS == nil:
+			set.SS = append(set.SS, e.S)
+		case e.N != nil && set.SS == nil && set.BS == nil:
+			set.NS = append(set.NS, e.N)
+		case e.B != nil && set.SS == nil && set.NS == nil:
+			set.BS = append(set.BS, e.B)
+		default:
+			return nil, errors.New("set values must all be strings, numbers or binaries")
+		}
+	}
+	return set, nil
+}
+
 // marshalItems takes a map of attribute names and values, and converts the value into
 // an appropriate dynamodb AttributeValue
 // In the case of an empty Map or List, want to create empty {} or [] in DynamoDB
@@ -475,7 +1213,6 @@ func buildUpdateExpression(items []UpdateValue, expAttMap map[string]*dynamodb.A
 // We also don't want to encode empty strings, so ignore those
 func marshalItems(in map[string]interface{}) (map[string]*dynamodb.AttributeValue, error) {
 	i := map[string]*dynamodb.AttributeValue{}
-	enc := dynamodbattribute.NewEncoder()
 	for k, v := range in {
 		switch v.(type) {
 		case string:
@@ -484,7 +1221,7 @@ func marshalItems(in map[string]interface{}) (map[string]*dynamodb.AttributeValu
 			}
 		}
 
-		v, err := enc.Encode(v)
+		v, err := encodeValue(v)
 		if err != nil {
 			return nil, errors.New("Could not marshal item: " + err.Error())
 		}
@@ -495,6 +1232,36 @@ func marshalItems(in map[string]interface{}) (map[string]*dynamodb.AttributeValu
 	return i, nil
 }
 
+// decodeKey converts key AttributeValues into native types. Unlike unmarshalItems numbers that are
+// integers decode as int, so the key marshals back to exactly the same value. Numbers that an int or
+// float64 can not hold exactly stay a dynamodbattribute.Number
+func decodeKey(in map[string]*dynamodb.AttributeValue) map[string]interface{} {
+	key := make(map[string]interface{})
+
+	for k, v := range in {
+		switch {
+		case v.S != nil:
+			key[k] = *v.S
+		case v.N != nil:
+			key[k] = dynamodbattribute.Number(*v.N)
+			if i, err := strconv.Atoi(*v.N); err == nil && sameNumber(i, *v.N) {
+				key[k] = i
+			} else if f, err := strconv.ParseFloat(*v.N, 64); err == nil && sameNumber(f, *v.N) {
+				key[k] = f
+			}
+		case v.B != nil:
+			key[k] = v.B
+		}
+	}
+	return key
+}
+
+// sameNumber reports if v marshals to exactly the number n
+func sameNumber(v interface{}, n string) bool {
+	av, err := encodeValue(v)
+	return err == nil && av.N != nil && *av.N == n
+}
+
 // unmarshalItems takes a map of AttributeValues, converts them to native types, and returns the value
 // without the AttributeValue struct
 func unmarshalItems(in map[string]*dynamodb.AttributeValue) map[string]interface{} {
@@ -512,7 +1279,10 @@ func unmarshalItems(in map[string]*dynamodb.AttributeValue) map[string]interface
 	return vals
 }
 
-func put(db DBer, r Request) (*dynamodbResult, error) {
+func put(ctx context.Context, db DBer, r Request) (*dynamodbResult, error) {
+	if r.ReturnValues != None && r.ReturnValues != AllOld {
+		return nil, dbError(godba.ErrorInvalidRequest, "PutItem", r.Table, "Could not put item in the db", errWriteReturnValues)
+	}
 	condexp := ""
 	expValMap := make(map[string]*dynamodb.AttributeValue)
 	expNameMap := make(map[string]*string)
@@ -524,13 +1294,13 @@ func put(db DBer, r Request) (*dynamodbResult, error) {
 
 	item, err := marshalItems(r.Item)
 	if err != nil {
-		return nil, errors.New("Could not put item in the db [" + err.Error() + "]")
+		return nil, dbError(godba.ErrorMarshalItem, "PutItem", r.Table, "Could not put item in the db", err)
 	}
 
 	if r.RequestConditions != nil {
 		condexp, err = buildConditionExpression(r.RequestConditions, expValMap, expNameMap)
 		if err != nil {
-			return nil, errors.New("Could not put item in the db [" + err.Error() + "]")
+			return nil, dbError(godba.ErrorRequestCondition, "PutItem", r.Table, "Could not put item in the db", err)
 		}
 	}
 
@@ -538,6 +1308,10 @@ func put(db DBer, r Request) (*dynamodbResult, error) {
 		TableName: aws.String(r.Table),
 		Item:      item}
 
+	if r.ReturnValues != None {
+		putInput.ReturnValues = aws.String(r.ReturnValues.String())
+	}
+
 	if len(condexp) != 0 {
 		putInput.ConditionExpression = aws.String(condexp)
 	}
@@ -550,41 +1324,39 @@ func put(db DBer, r Request) (*dynamodbResult, error) {
 		putInput.ExpressionAttributeNames = expNameMap
 	}
 
-	_, e := db.PutItem(putInput)
+	dbResult, e := db.PutItemWithContext(ctx, putInput)
 
 	if e != nil {
-		var re error
-		if awsErr, ok := e.(awserr.Error); ok {
-			re = errors.New("Unable to put item in the database [" + awsErr.Error() + "]")
-		} else {
-			re = errors.New("Unable to put item in the database")
-		}
-		return nil, re
+		return nil, dbError(godba.ErrorPutItem, "PutItem", r.Table, "Unable to put item in the database", e)
 	}
 
-	return &dynamodbResult{}, nil
+	return &dynamodbResult{attributes: dbResult.Attributes, returnValues: r.ReturnValues}, nil
 }
 
-func get(db DBer, r Request) (*dynamodbResult, error) {
+func get(ctx context.Context, db DBer, r Request) (*dynamodbResult, error) {
 	key, err := marshalItems(r.Key)
 	if err != nil {
-		return nil, errors.New("Could not get item [" + err.Error() + "]")
+		return nil, dbError(godba.ErrorMarshalItem, "GetItem", r.Table, "Could not get item", err)
 	}
 
-	dbResult, e := db.GetItem(&dynamodb.GetItemInput{
+	in := &dynamodb.GetItemInput{
 		TableName:      aws.String(r.Table),
 		Key:            key,
-		ConsistentRead: aws.Bool(r.ConsistentRead)})
-
-	if e != nil {
-		var re error
-		if awsErr, ok := e.(awserr.Error); ok {
-			re = errors.New("Unable to retrieve item from the database [" + awsErr.Error() + "]")
-		} else {
-			re = errors.New("Unable to retrieve item from the database ")
+		ConsistentRead: aws.Bool(r.ConsistentRead)}
+	if len(r.Projection) != 0 {
+		names := make(map[string]*string)
+		proj, err := buildProjectionExpression(r.Projection, names)
+		if err != nil {
+			return nil, dbError(godba.ErrorProjection, "GetItem", r.Table, "Could not get item", err)
 		}
+		in.ProjectionExpression = aws.String(proj)
+		in.ExpressionAttributeNames = names
+	}
+
+	dbResult, e := db.GetItemWithContext(ctx, in)
 
-		return nil, re
+	if e != nil {
+		return nil, dbError(godba.ErrorGetItem, "GetItem", r.Table, "Unable to retrieve item from the database", e)
 	}
 
 	result := &dynamodbResult{}
@@ -596,34 +1368,48 @@ func get(db DBer, r Request) (*dynamodbResult, error) {
 	return result, nil
 }
 
-func dbDelete(db DBer, r Request) (*dynamodbResult, error) {
+func dbDelete(ctx context.Context, db DBer, r Request) (*dynamodbResult, error) {
+	if r.ReturnValues != None && r.ReturnValues != AllOld {
+		return nil, dbError(godba.ErrorInvalidRequest, "DeleteItem", r.Table, "Could not delete item", errWriteReturnValues)
+	}
 	key, err := marshalItems(r.Key)
 	if err != nil {
-		return nil, errors.New("Could not delete item [" + err.Error() + "]")
+		return nil, dbError(godba.ErrorMarshalItem, "DeleteItem", r.Table, "Could not delete item", err)
+	}
+
+	expValMap := make(map[string]*dynamodb.AttributeValue)
+	expNameMap := make(map[string]*string)
+	condexp, err := buildConditionExpression(r.RequestConditions, expValMap, expNameMap)
+	if err != nil {
+		return nil, dbError(godba.ErrorRequestCondition, "DeleteItem", r.Table, "Could not delete item", err)
 	}
 
 	var returnvals *string
-	if r.ReturnValues != "" {
-		returnvals = aws.String(r.ReturnValues)
+	if r.ReturnValues != None {
+		returnvals = aws.String(r.ReturnValues.String())
 	}
 
-	dbResult, e := db.DeleteItem(&dynamodb.DeleteItemInput{
+	in := &dynamodb.DeleteItemInput{
 		TableName:    aws.String(r.Table),
 		Key:          key,
-		ReturnValues: returnvals})
+		ReturnValues: returnvals}
+	if condexp != "" {
+		in.ConditionExpression = aws.String(condexp)
+	}
+	if len(expValMap) != 0 {
+		in.ExpressionAttributeValues = expValMap
+	}
+	if len(expNameMap) != 0 {
+		in.ExpressionAttributeNames = expNameMap
+	}
 
-	if e != nil {
-		var re error
-		if awsErr, ok := e.(awserr.Error); ok {
-			re = errors.New("Unable to delete item in the database [" + awsErr.Error() + "]")
-		} else {
-			re = errors.New("Unable to delete item in the database")
-		}
+	dbResult, e := db.DeleteItemWithContext(ctx, in)
 
-		return nil, re
+	if e != nil {
+		return nil, dbError(godba.ErrorDeleteItem, "DeleteItem", r.Table, "Unable to delete item in the database", e)
 	}
 
-	result := &dynamodbResult{}
+	result := &dynamodbResult{returnValues: r.ReturnValues}
 	if dbResult.Attributes != nil {
 		result.attributes = dbResult.Attributes
 	}
@@ -634,18 +1420,40 @@ func dbDelete(db DBer, r Request) (*dynamodbResult, error) {
 // update implements the update logic for dynamodb
 // it translates the Updates in the request into an update expression and expression value map
 // then sends that to dynamodb
-func update(db DBer, r Request) (*dynamodbResult, error) {
+func update(ctx context.Context, db DBer, r Request) (*dynamodbResult, error) {
 	key, err := marshalItems(r.Key)
 	if err != nil {
-		return nil, errors.New("Could not update item [" + err.Error() + "]")
+		return nil, dbError(godba.ErrorMarshalItem, "UpdateItem", r.Table, "Could not update item", err)
+	}
+
+	if r.patch {
+		if r, err = resolvePatch(ctx, db, r, key); err != nil {
+			return nil, err
+		}
+	}
+
+	updates, guards, err := resolveInserts(ctx, db, r, key)
+	if err != nil {
+		return nil, err
 	}
 
 	updateMap := make(map[string]*dynamodb.AttributeValue)
 	updateNames := make(map[string]*string)
 
-	updateExp, err := buildUpdateExpression(r.Updates, updateMap, updateNames)
+	updateExp, err := buildUpdateExpression(updates, updateMap, updateNames)
 	if err != nil {
-		return nil, errors.New("Could not update item [" + err.Error() + "]")
+		return nil, dbError(godba.ErrorUpdateExpression, "UpdateItem", r.Table, "Could not update item", err)
+	}
+	// the request conditions are grouped so an Or among them can not bypass the insert guards
+	conditions := r.RequestConditions
+	if len(guards) != 0 && len(r.RequestConditions) != 0 {
+		conditions = append([]RequestCondition{RequestCondition{Group: r.RequestConditions}}, guards...)
+	} else if len(guards) != 0 {
+		conditions = guards
+	}
+	condExp, err := buildConditionExpression(conditions, updateMap, updateNames)
+	if err != nil {
+		return nil, dbError(godba.ErrorRequestCondition, "UpdateItem", r.Table, "Could not update item", err)
 	}
 
 	if len(updateMap) == 0 {
@@ -656,30 +1464,28 @@ func update(db DBer, r Request) (*dynamodbResult, error) {
 	}
 
 	var returnvals *string
-	if r.ReturnValues != "" {
-		returnvals = aws.String(r.ReturnValues)
+	if r.ReturnValues != None {
+		returnvals = aws.String(r.ReturnValues.String())
 	}
 
-	dbResult, e := db.UpdateItem(&dynamodb.UpdateItemInput{
+	in := &dynamodb.UpdateItemInput{
 		TableName:                 aws.String(r.Table),
 		Key:                       key,
 		UpdateExpression:          aws.String(updateExp),
 		ExpressionAttributeValues: updateMap,
 		ExpressionAttributeNames:  updateNames,
-		ReturnValues:              returnvals})
+		ReturnValues:              returnvals}
+	if condExp != "" {
+		in.ConditionExpression = aws.String(condExp)
+	}
 
-	if e != nil {
-		var re error
-		if awsErr, ok := e.(awserr.Error); ok {
-			re = errors.New("Unable to update item in the database [" + awsErr.Error() + "]")
-		} else {
-			re = errors.New("Unable to update item in the database")
-		}
+	dbResult, e := db.UpdateItemWithContext(ctx, in)
 
-		return nil, re
+	if e != nil {
+		return nil, dbError(godba.ErrorUpdateItem, "UpdateItem", r.Table, "Unable to update item in the database", e)
 	}
 
-	result := &dynamodbResult{}
+	result := &dynamodbResult{returnValues: r.ReturnValues}
 	if dbResult.Attributes != nil {
 		result.attributes = dbResult.Attributes
 	}
@@ -687,16 +1493,111 @@ func update(db DBer, r Request) (*dynamodbResult, error) {
 	return result, nil
 }
 
-func queryPages(db DBer, r Request) (*dynamodbResult, error) {
+// resolveInserts replaces the Insert updates in r with an update of the whole list. dynamodb can not insert
+// into the middle of a list, so the current lists are read and the update is guarded by conditions that
+// they have not changed since
+func resolveInserts(ctx context.Context, db DBer, r Request, key map[string]*dynamodb.AttributeValue) ([]UpdateValue, []RequestCondition, error) {
+	var item map[string]*dynamodb.AttributeValue
+	var guards []RequestCondition
+	updates := make([]UpdateValue, 0, len(r.Updates))
+	lists := make(map[string]int)
+
+	for _, v := range r.Updates {
+		if v.Action != Insert {
+			updates = append(updates, v)
+			continue
+		}
+
+		slash := strings.LastIndex(v.Path, "/")
+		index, err := strconv.Atoi(v.Path[slash+1:])
+		if slash <= 0 || err != nil || index < 0 {
+			return nil, nil, dbError(godba.ErrorUpdateExpression, "UpdateItem", r.Table, "Could not update item", errors.New("Invalid update: "+v.Path+" is not a list index"))
+		}
+		path := v.Path[:slash]
+
+		if item == nil {
+			out, e := db.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String(r.Table), Key: key, ConsistentRead: aws.Bool(true)})
+			if e != nil {
+				return nil, nil, dbError(godba.ErrorGetItem, "GetItem", r.Table, "Could not read the list to insert into", e)
+			}
+			item = out.Item
+			if item == nil {
+				item = make(map[string]*dynamodb.AttributeValue)
+			}
+		}
+
+		var list []*dynamodb.AttributeValue
+		if u, ok := lists[path]; ok {
+			// a second insert into the same list
+			list = updates[u].Value.(*dynamodb.AttributeValue).L
+		} else {
+			old, ok := attributeAtPath(item, path)
+			if ok {
+				if old.L == nil {
+					return nil, nil, dbError(godba.ErrorUpdateExpression, "UpdateItem", r.Table, "Could not update item", errors.New("Invalid update: "+path+" is not a list"))
+				}
+				list = old.L
+				guards = append(guards, RequestCondition{Field: path, Type: Equal, Value: old, Relationship: And})
+			} else {
+				guards = append(guards, RequestCondition{Field: path, Type: NotExist, Relationship: And})
+			}
+			lists[path] = len(updates)
+			updates = append(updates, UpdateValue{Action: Update, Path: path})
+		}
+
+		if index > len(list) {
+			return nil, nil, dbError(godba.ErrorUpdateExpression, "UpdateItem", r.Table, "Could not update item", errors.New("Invalid update: "+v.Path+" is past the end of the list"))
+		}
+		av, err := encodeValue(v.Value)
+		if err != nil {
+			return nil, nil, dbError(godba.ErrorMarshalItem, "UpdateItem", r.Table, "Could not update item", err)
+		}
+		spliced := make([]*dynamodb.AttributeValue, 0, len(list)+1)
+		spliced = append(append(append(spliced, list[:index]...), av), list[index:]...)
+		updates[lists[path]].Value = &dynamodb.AttributeValue{L: spliced}
+	}
+
+	return updates, guards, nil
+}
+
+// attributeAtPath returns the value at an rfc6901 path in an item
+func attributeAtPath(item map[string]*dynamodb.AttributeValue, path string) (*dynamodb.AttributeValue, bool) {
+	cur := &dynamodb.AttributeValue{M: item}
+	for _, seg := range strings.Split(path, "/")[1:] {
+		switch {
+		case cur.M != nil:
+			v, ok := cur.M[unescapePathSegment(seg)]
+			if !ok {
+				return nil, false
+			}
+			cur = v
+		case cur.L != nil:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(cur.L) {
+				return nil, false
+			}
+			cur = cur.L[i]
+		default:
+			return nil, false
+		}
+	}
+	return cur, true
+}
+
+func queryPages(ctx context.Context, db DBer, r Request) (*dynamodbResult, error) {
 	expValMap := make(map[string]*dynamodb.AttributeValue)
 	expValName := make(map[string]*string)
 	keyExp, err := buildConditionExpression(r.RequestConditions, expValMap, expValName)
 	if err != nil {
-		return nil, errors.New("Could not query items [" + err.Error() + "]")
+		return nil, dbError(godba.ErrorRequestCondition, "Query", r.Table, "Could not query items", err)
 	}
 	filterExp, err := buildConditionExpression(r.ResultFitler, expValMap, expValName)
 	if err != nil {
-		return nil, errors.New("Could not query items [" + err.Error() + "]")
+		return nil, dbError(godba.ErrorFilterCondition, "Query", r.Table, "Could not query items", err)
+	}
+	projExp, err := buildProjectionExpression(r.Projection, expValName)
+	if err != nil {
+		return nil, dbError(godba.ErrorProjection, "Query", r.Table, "Could not query items", err)
 	}
 
 	result := &dynamodbResult{}
@@ -708,13 +1609,16 @@ func queryPages(db DBer, r Request) (*dynamodbResult, error) {
 	if filterExp != "" {
 		qI.FilterExpression = aws.String(filterExp)
 	}
+	if projExp != "" {
+		qI.ProjectionExpression = aws.String(projExp)
+	}
 	if r.Index != "" {
 		qI.IndexName = aws.String(r.Index)
 	}
 	start := r.PageSize * (r.Page - 1)
 	count := r.PageSize
 	resultsSeen := 0
-	e := db.QueryPages(qI,
+	e := db.QueryPagesWithContext(ctx, qI,
 		func(page *dynamodb.QueryOutput, lastpage bool) bool {
 			if int(*page.Count)+resultsSeen <= start {
 				resultsSeen += int(*page.Count)
@@ -740,24 +1644,22 @@ func queryPages(db DBer, r Request) (*dynamodbResult, error) {
 		result.pageCount++
 	}
 	if e != nil {
-		var re error
-		if awsErr, ok := e.(awserr.Error); ok {
-			re = errors.New("Unable to query the database [" + awsErr.Error() + "]")
-		} else {
-			re = errors.New("Unable to query the database")
-		}
-		return nil, re
+		return nil, dbError(godba.ErrorQueryItem, "Query", r.Table, "Unable to query the database", e)
 	}
 	return result, nil
 }
 
-func query(db DBer, r Request) (*dynamodbResult, error) {
+func query(ctx context.Context, db DBer, r Request) (*dynamodbResult, error) {
 	expValMap := make(map[string]*dynamodb.AttributeValue)
 	expValName := make(map[string]*string)
 
 	keyExp, err := buildConditionExpression(r.RequestConditions, expValMap, expValName)
 	if err != nil {
-		return nil, errors.New("Could not query items [" + err.Error() + "]")
+		return nil, dbError(godba.ErrorRequestCondition, "Query", r.Table, "Could not query items", err)
+	}
+	projExp, err := buildProjectionExpression(r.Projection, expValName)
+	if err != nil {
+		return nil, dbError(godba.ErrorProjection, "Query", r.Table, "Could not query items", err)
 	}
 
 	result := &dynamodbResult{}
@@ -767,6 +1669,12 @@ func query(db DBer, r Request) (*dynamodbResult, error) {
 		KeyConditionExpression:    aws.String(keyExp),
 		ExpressionAttributeValues: expValMap,
 		ExpressionAttributeNames:  expValName}
+	if projExp != "" {
+		qI.ProjectionExpression = aws.String(projExp)
+	}
+	if r.Index != "" {
+		qI.IndexName = aws.String(r.Index)
+	}
 
 	if r.Limit > 0 {
 		qI.Limit = aws.Int64(int64(r.Limit))
@@ -775,62 +1683,546 @@ func query(db DBer, r Request) (*dynamodbResult, error) {
 	if len(r.LastKey) != 0 {
 		lKey, err := marshalItems(r.LastKey)
 		if err != nil {
-			return nil, err
+			return nil, dbError(godba.ErrorMarshalItem, "Query", r.Table, "Could not query items", err)
 		}
 		qI.ExclusiveStartKey = lKey
 	}
 
-	e := db.QueryPages(qI,
+	e := db.QueryPagesWithContext(ctx, qI,
 		func(p *dynamodb.QueryOutput, lastPage bool) bool {
 			for i := 0; i < int(*p.Count); i++ {
 				result.items = append(result.items, p.Items[i])
 			}
-			return true
+			result.lastKey = p.LastEvaluatedKey
+			// a limited query only reads a single page, the caller continues from the last key
+			return r.Limit <= 0
 		})
 
 	if e != nil {
-		var re error
-		if awsErr, ok := e.(awserr.Error); ok {
-			re = errors.New("Unable to query the database [" + awsErr.Error() + "]")
-		} else {
-			re = errors.New("Unable to query the database")
+		return nil, dbError(godba.ErrorQueryItem, "Query", r.Table, "Unable to query the database", e)
+	}
+
+	return result, nil
+}
+
+// buildScanInput translates a scan request into the dynamodb input. The ResultFitler becomes the filter expression.
+// Errors are godba errors coded for the part of the request that was invalid
+func buildScanInput(r Request) (*dynamodb.ScanInput, error) {
+	expValMap := make(map[string]*dynamodb.AttributeValue)
+	expValName := make(map[string]*string)
+
+	filterExp, err := buildConditionExpression(r.ResultFitler, expValMap, expValName)
+	if err != nil {
+		return nil, &godba.Error{Code: godba.ErrorFilterCondition, Message: "Invalid filter", Err: err}
+	}
+	projExp, err := buildProjectionExpression(r.Projection, expValName)
+	if err != nil {
+		return nil, &godba.Error{Code: godba.ErrorProjection, Message: "Invalid projection", Err: err}
+	}
+
+	sI := &dynamodb.ScanInput{
+		TableName:      aws.String(r.Table),
+		ConsistentRead: aws.Bool(r.ConsistentRead)}
+
+	if filterExp != "" {
+		sI.FilterExpression = aws.String(filterExp)
+		if len(expValMap) != 0 {
+			sI.ExpressionAttributeValues = expValMap
+		}
+	}
+	if projExp != "" {
+		sI.ProjectionExpression = aws.String(projExp)
+	}
+	if len(expValName) != 0 {
+		sI.ExpressionAttributeNames = expValName
+	}
+
+	if r.Index != "" {
+		sI.IndexName = aws.String(r.Index)
+	}
+
+	if r.TotalSegments > 0 {
+		sI.Segment = aws.Int64(int64(r.Segment))
+		sI.TotalSegments = aws.Int64(int64(r.TotalSegments))
+	}
+
+	if r.Limit > 0 {
+		sI.Limit = aws.Int64(int64(r.Limit))
+	}
+
+	if len(r.LastKey) != 0 {
+		lKey, err := marshalItems(r.LastKey)
+		if err != nil {
+			return nil, &godba.Error{Code: godba.ErrorMarshalItem, Message: "Invalid last key", Err: err}
 		}
+		sI.ExclusiveStartKey = lKey
+	}
+
+	return sI, nil
+}
+
+// scan reads every item in the table, or in a single segment if TotalSegments is set.
+// Like query, a limited scan stops after the first page and returns the last evaluated key
+func scan(ctx context.Context, db DBer, r Request) (*dynamodbResult, error) {
+	sI, err := buildScanInput(r)
+	if err != nil {
+		return nil, dbError(godba.ErrorScanItem, "Scan", r.Table, "Could not scan items", err)
+	}
+
+	result := &dynamodbResult{}
+
+	e := db.ScanPagesWithContext(ctx, sI,
+		func(p *dynamodb.ScanOutput, lastPage bool) bool {
+			result.items = append(result.items, p.Items...)
+			result.lastKey = p.LastEvaluatedKey
+			return r.Limit <= 0
+		})
+
+	if e != nil {
+		return nil, dbError(godba.ErrorScanItem, "Scan", r.Table, "Unable to scan the database", e)
+	}
+
+	return result, nil
+}
+
+// parallelScan splits the table into TotalSegments segments and reads them with Workers concurrent scans.
+// Items are returned in segment order
+func parallelScan(ctx context.Context, db DBer, r Request) (*dynamodbResult, error) {
+	if r.TotalSegments <= 0 {
+		return nil, dbError(godba.ErrorInvalidRequest, "Scan", r.Table, "Could not scan items", errors.New("ParallelScan requires TotalSegments"))
+	}
+
+	workers := r.Workers
+	if workers <= 0 || workers > r.TotalSegments {
+		workers = r.TotalSegments
+	}
+
+	segments := make([]*dynamodbResult, r.TotalSegments)
+	errs := make([]error, r.TotalSegments)
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range jobs {
+				sr := r
+				sr.Segment = s
+				sr.Limit = 0
+				sr.LastKey = nil
+				segments[s], errs[s] = scan(ctx, db, sr)
+			}
+		}()
+	}
+
+	for s := 0; s < r.TotalSegments; s++ {
+		jobs <- s
+	}
+	close(jobs)
+	wg.Wait()
+
+	result := &dynamodbResult{}
+	for s, sr := range segments {
+		if errs[s] != nil {
+			return nil, errs[s]
+		}
+		result.items = append(result.items, sr.items...)
+	}
+
+	return result, nil
+}
+
+// batch limits and retry behaviour for unprocessed items
+const (
+	batchGetSize   = 100
+	batchWriteSize = 25
+	batchRetries   = 8
+	batchBackoff   = 50 * time.Millisecond
+)
+
+// sleepContext waits for d, returning early with the context's error if ctx is done first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// batchItemKey identifies an item by its table and key attributes. names are the key attributes
+// of the table, which lets a returned item be matched to the request for it
+func batchItemKey(table string, names []string, item map[string]*dynamodb.AttributeValue) string {
+	k := make(map[string]*dynamodb.AttributeValue, len(names))
+	for _, n := range names {
+		k[n] = item[n]
+	}
+	b, _ := json.Marshal(k)
+	return table + "/" + string(b)
+}
+
+// batchOldItems reads the items a batch of Puts is about to replace, in batch order, nil if missing
+func batchOldItems(ctx context.Context, db DBer, batch []Request) ([]map[string]*dynamodb.AttributeValue, error) {
+	gets := make([]Request, len(batch))
+	for i, b := range batch {
+		gets[i] = Request{Table: b.Table, Action: Get, Key: b.Key}
+	}
+	r, err := batchGet(ctx, db, Request{Action: BatchGet, Batch: gets, ConsistentRead: true})
+	if err != nil {
+		return nil, err
+	}
+	return r.items, nil
+}
+
+// batchGet reads the items for the Get requests in r.Batch using BatchGetItem, 100 keys at a time.
+// Keys dynamodb could not process are retried with exponential backoff.
+// Result items are in the same order as the requests, missing items are empty. Each table is read with
+// one projection, so the items of a table have the paths projected by any of its requests
+func batchGet(ctx context.Context, db DBer, r Request) (*dynamodbResult, error) {
+	keyNames := make(map[string][]string)
+	projections := make(map[string]*dynamodb.KeysAndAttributes)
+	paths := make(map[string]map[string]bool)
+	positions := make(map[string][]int)
+	var keys []string
+	var tables []string
+	var marshaled []map[string]*dynamodb.AttributeValue
+
+	for i, b := range r.Batch {
+		if b.Action != Get {
+			return nil, dbError(godba.ErrorInvalidRequest, "BatchGetItem", b.Table, "Could not get items", errors.New("BatchGet only supports Get requests"))
+		}
+		key, err := marshalItems(b.Key)
+		if err != nil {
+			return nil, dbError(godba.ErrorMarshalItem, "BatchGetItem", b.Table, "Could not get items", err)
+		}
+		if _, ok := keyNames[b.Table]; !ok {
+			for n := range key {
+				keyNames[b.Table] = append(keyNames[b.Table], n)
+			}
+			if len(b.Projection) != 0 {
+				paths[b.Table] = map[string]bool{}
+			}
+		}
+		// dynamodb takes one projection per table, so it covers the paths of every request for the table,
+		// or the whole item if any request wants it
+		if p, ok := paths[b.Table]; ok {
+			if len(b.Projection) == 0 {
+				delete(paths, b.Table)
+			}
+			for _, path := range b.Projection {
+				p[path] = true
+			}
+		}
+		k := batchItemKey(b.Table, keyNames[b.Table], key)
+		// dynamodb rejects duplicate keys, so each item is only requested once
+		if _, ok := positions[k]; !ok {
+			keys = append(keys, k)
+			tables = append(tables, b.Table)
+			marshaled = append(marshaled, key)
+		}
+		positions[k] = append(positions[k], i)
+	}
+
+	for table, p := range paths {
+		// the key is always read so items can be matched to their requests
+		for _, n := range keyNames[table] {
+			p[n] = true
+		}
+		ka := &dynamodb.KeysAndAttributes{ExpressionAttributeNames: make(map[string]*string)}
+		proj, err := buildProjectionExpression(mergeProjections(p), ka.ExpressionAttributeNames)
+		if err != nil {
+			return nil, dbError(godba.ErrorProjection, "BatchGetItem", table, "Could not get items", err)
+		}
+		ka.ProjectionExpression = aws.String(proj)
+		projections[table] = ka
+	}
+
+	result := &dynamodbResult{items: make([]map[string]*dynamodb.AttributeValue, len(r.Batch))}
+
+	for start := 0; start < len(keys); start += batchGetSize {
+		end := start + batchGetSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		pending := make(map[string]*dynamodb.KeysAndAttributes)
+		for i := start; i < end; i++ {
+			if pending[tables[i]] == nil {
+				pending[tables[i]] = &dynamodb.KeysAndAttributes{ConsistentRead: aws.Bool(r.ConsistentRead)}
+				if p := projections[tables[i]]; p != nil {
+					pending[tables[i]].ProjectionExpression = p.ProjectionExpression
+					pending[tables[i]].ExpressionAttributeNames = p.ExpressionAttributeNames
+				}
+			}
+			pending[tables[i]].Keys = append(pending[tables[i]].Keys, marshaled[i])
+		}
+
+		for attempt := 0; len(pending) != 0; attempt++ {
+			if attempt > batchRetries {
+				return nil, dbError(godba.ErrorBatchGet, "BatchGetItem", "", "Unable to retrieve items from the database", errors.New("unprocessed keys remain after retrying"))
+			}
+			if attempt > 0 {
+				if err := sleepContext(ctx, batchBackoff<<uint(attempt-1)); err != nil {
+					return nil, err
+				}
+			}
+
+			out, e := db.BatchGetItemWithContext(ctx, &dynamodb.BatchGetItemInput{RequestItems: pending})
+			if e != nil {
+				return nil, dbError(godba.ErrorBatchGet, "BatchGetItem", "", "Unable to retrieve items from the database", e)
+			}
 
-		return nil, re
+			for table, items := range out.Responses {
+				for _, item := range items {
+					for _, i := range positions[batchItemKey(table, keyNames[table], item)] {
+						result.items[i] = item
+					}
+				}
+			}
+			pending = out.UnprocessedKeys
+		}
 	}
 
 	return result, nil
 }
 
-// reverseOp takes a successful operation and generates a request to undo it
+// mergeProjections returns the paths to project so every one of paths is read. dynamodb rejects
+// overlapping paths, so a path inside another one, or the same path spelled differently, is left out
+func mergeProjections(paths map[string]bool) []string {
+	segments := make(map[string][]string, len(paths))
+	for p := range paths {
+		if strings.HasPrefix(p, "/") {
+			for _, seg := range strings.Split(p, "/")[1:] {
+				segments[p] = append(segments[p], unescapePathSegment(seg))
+			}
+		} else {
+			segments[p] = []string{p}
+		}
+	}
+
+	covers := func(outer, inner []string) bool {
+		if len(outer) > len(inner) {
+			return false
+		}
+		for i := range outer {
+			if outer[i] != inner[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	var merged []string
+	for p, segs := range segments {
+		covered := false
+		for o, outer := range segments {
+			// of two spellings of the same path the first in sort order is kept
+			if o != p && covers(outer, segs) && (len(outer) < len(segs) || o < p) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			merged = append(merged, p)
+		}
+	}
+	sort.Strings(merged)
+	return merged
+}
+
+// batchWrite runs the Put and Delete requests in r.Batch using BatchWriteItem, 25 at a time.
+// Requests dynamodb could not process are retried with exponential backoff.
+// applied has the indexes in r.Batch of the requests that were written, or may have been when the call
+// sending them failed. When an error stops the batch part way through they are still returned
+func batchWrite(ctx context.Context, db DBer, r Request) (_ *dynamodbResult, applied []int, err error) {
+	var writes []*dynamodb.WriteRequest
+	var tables []string
+
+	for _, b := range r.Batch {
+		w := &dynamodb.WriteRequest{}
+		switch b.Action {
+		case Put:
+			item := make(map[string]interface{})
+			for k, v := range b.Item {
+				item[k] = v
+			}
+			for k, v := range b.Key {
+				item[k] = v
+			}
+			av, err := marshalItems(item)
+			if err != nil {
+				return nil, nil, dbError(godba.ErrorMarshalItem, "BatchWriteItem", b.Table, "Could not write items", err)
+			}
+			w.PutRequest = &dynamodb.PutRequest{Item: av}
+		case Delete:
+			key, err := marshalItems(b.Key)
+			if err != nil {
+				return nil, nil, dbError(godba.ErrorMarshalItem, "BatchWriteItem", b.Table, "Could not write items", err)
+			}
+			w.DeleteRequest = &dynamodb.DeleteRequest{Key: key}
+		default:
+			return nil, nil, dbError(godba.ErrorInvalidRequest, "BatchWriteItem", b.Table, "Could not write items", errors.New("BatchWrite only supports Put and Delete requests"))
+		}
+		writes = append(writes, w)
+		tables = append(tables, b.Table)
+	}
+
+	// sent returns the indexes of the requests before end, leaving out the ones still unprocessed in pending.
+	// Unprocessed items come back as copies, so they are matched by their encoding
+	sent := func(end int, pending map[string][]*dynamodb.WriteRequest) []int {
+		left := make(map[string]bool)
+		for _, ws := range pending {
+			for _, w := range ws {
+				b, _ := json.Marshal(w)
+				left[string(b)] = true
+			}
+		}
+		var idx []int
+		for i := 0; i < end; i++ {
+			if b, _ := json.Marshal(writes[i]); !left[string(b)] {
+				idx = append(idx, i)
+			}
+		}
+		return idx
+	}
+
+	for start := 0; start < len(writes); start += batchWriteSize {
+		end := start + batchWriteSize
+		if end > len(writes) {
+			end = len(writes)
+		}
+
+		pending := make(map[string][]*dynamodb.WriteRequest)
+		for i := start; i < end; i++ {
+			pending[tables[i]] = append(pending[tables[i]], writes[i])
+		}
+
+		for attempt := 0; len(pending) != 0; attempt++ {
+			if attempt > batchRetries {
+				return nil, sent(end, pending), dbError(godba.ErrorBatchWrite, "BatchWriteItem", "", "Unable to write items to the database", errors.New("unprocessed items remain after retrying"))
+			}
+			if attempt > 0 {
+				if err := sleepContext(ctx, batchBackoff<<uint(attempt-1)); err != nil {
+					return nil, sent(end, pending), err
+				}
+			}
+
+			out, e := db.BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{RequestItems: pending})
+			if e != nil {
+				return nil, sent(end, nil), dbError(godba.ErrorBatchWrite, "BatchWriteItem", "", "Unable to write items to the database", e)
+			}
+			pending = out.UnprocessedItems
+		}
+	}
+
+	return &dynamodbResult{}, sent(len(writes), nil), nil
+}
+
+// reverseUpdates restores every path an update changed to its value in old, the item before the update,
+// and removes the paths the update created
+func reverseUpdates(updates []UpdateValue, old map[string]*dynamodb.AttributeValue) []UpdateValue {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, v := range updates {
+		path := v.Path
+		segs := strings.Split(path, "/")
+		for i := 2; i < len(segs); i++ {
+			if segs[i] == "-" || isIndex(segs[i]) {
+				// changes to list elements can shift the rest of the list, so the whole list is restored.
+				// A patch's numeric segment can be a map member too, restoring its map works either way
+				path = strings.Join(segs[:i], "/")
+				break
+			}
+		}
+		if !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+
+	reversed := make([]UpdateValue, 0, len(paths))
+	for _, path := range paths {
+		// restoring a parent restores its children too, and dynamodb rejects overlapping paths
+		covered := false
+		for _, p := range paths {
+			if strings.HasPrefix(path, p+"/") {
+				covered = true
+				break
+			}
+		}
+		if covered {
+			continue
+		}
+
+		if v, ok := attributeAtPath(old, path); ok {
+			reversed = append(reversed, UpdateValue{Action: Put, Path: path, Value: v})
+		} else {
+			reversed = append(reversed, UpdateValue{Action: Delete, Path: path})
+		}
+	}
+
+	return reversed
+}
+
+// isIndex reports whether a path segment is a list index
+func isIndex(seg string) bool {
+	_, err := strconv.Atoi(seg)
+	return err == nil
+}
+
+// reverseOp takes a successful operation and generates a request to undo it, or nil if there is nothing to undo
 func reverseOp(o op) *Request {
+	var old map[string]*dynamodb.AttributeValue
+	if o.result != nil {
+		old = o.result.attributes
+	}
+
 	r := &Request{}
 	switch o.request.Action {
 	case Put:
-		r.Action = Delete
 		r.Key = o.request.Key
 		r.Table = o.request.Table
+		if len(old) == 0 {
+			r.Action = Delete
+			break
+		}
+		// the put replaced an item, which is put back
+		r.Action = Put
+		r.Item = rawItem(old)
 	case Delete:
+		if len(old) == 0 {
+			// there was nothing to delete
+			return nil
+		}
 		r.Action = Put
 		r.Key = o.request.Key
 		r.Table = o.request.Table
-		r.Item = unmarshalItems(o.result.attributes)
+		r.Item = rawItem(old)
 	case Update:
-		r.Action = Update
 		r.Key = o.request.Key
 		r.Table = o.request.Table
-		r.Updates = make([]UpdateValue, 0)
-		attrs := unmarshalItems(o.result.attributes)
-		for _, v := range o.request.Updates {
-			if v.Action == Put && attrs[v.Path] == nil {
-				r.Updates = append(r.Updates, UpdateValue{Action: Delete})
-			} else {
-				if attrs[v.Path] != nil {
-					r.Updates = append(r.Updates, UpdateValue{Action: Put, Path: v.Path, Value: attrs[v.Path]})
-				}
-			}
+		if len(old) == 0 {
+			// the update created the item
+			r.Action = Delete
+			break
 		}
+		r.Action = Update
+		r.Updates = reverseUpdates(o.request.Updates, old)
+	default:
+		return nil
 	}
 
 	return r
 }
+
+// rawItem wraps the attributes of an item so marshalItems passes them through unchanged, which keeps set types intact
+func rawItem(in map[string]*dynamodb.AttributeValue) map[string]interface{} {
+	item := make(map[string]interface{}, len(in))
+	for k, v := range in {
+		item[k] = v
+	}
+	return item
+}
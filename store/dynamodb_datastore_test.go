@@ -1,8 +1,12 @@
 package store
 
 import (
+	"context"
+	"errors"
 	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"gitlab.com/paasapi/api/common/util"
 
@@ -11,6 +15,8 @@ import (
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	godba "github.com/sethjback/godba/errors"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -91,10 +97,19 @@ func TestResult(t *testing.T) {
 }
 
 func TestStartTransaction(t *testing.T) {
-	c := &DynamoDBDatastore{transaction: false}
-	c.StartTransaction()
-	assert.True(t, c.transaction, "Transaction flag not set to true")
-	assert.NotNil(t, c.ops, "Did not create operation array")
+	assert := assert.New(t)
+	c := &DynamoDBDatastore{}
+	tx, ok := c.StartTransaction().(*dynamodbTx)
+	if assert.True(ok) {
+		assert.Equal(c, tx.c)
+		assert.False(tx.done)
+	}
+	assert.False(c.StartTransaction() == Tx(tx), "each transaction should have its own state")
+
+	assert.Nil(tx.Finish())
+	_, e := tx.Run(Request{Table: "test", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Equal(godba.ErrorInvalidRequest, godba.Code(e), "a finished transaction can not run requests")
+	assert.Nil(tx.Rollback())
 }
 
 func TestRun(t *testing.T) {
@@ -108,7 +123,7 @@ func TestRun(t *testing.T) {
 		opList = append(opList, r.Operation.Name)
 	})
 
-	c := &DynamoDBDatastore{transaction: false, db: dbc}
+	c := &DynamoDBDatastore{db: dbc}
 
 	r, e := c.Run(Request{
 		Table:  "test",
@@ -183,12 +198,12 @@ func TestBuildConditionExpression(t *testing.T) {
 
 	c = nil
 
-	c = append(c, RequestCondition{Field: "test4", Type: GreaterThan, Value: "string"})
+	c = append(c, RequestCondition{Field: "test4", Type: GreaterThan, Value: true})
 	attValNames = make(map[string]*string)
 	exp, err = buildConditionExpression(c, attValMap, attValNames)
 	assert.Empty(exp)
 	if assert.NotNil(err) {
-		assert.Equal("Invalid request condition: GreaterThan condition value must be an int", err.Error())
+		assert.Equal("Invalid request condition: GreaterThan condition value must be a number, string or binary", err.Error())
 	}
 
 	c = nil
@@ -245,6 +260,72 @@ func TestBuildUpdateExpression(t *testing.T) {
 	assert.Nil(err)
 }
 
+func TestBuildUpdateActions(t *testing.T) {
+	assert := assert.New(t)
+	expAMap := make(map[string]*dynamodb.AttributeValue)
+	expNames := make(map[string]*string)
+
+	i := []UpdateValue{
+		UpdateValue{Action: Increment, Path: "/views", Value: 1},
+		UpdateValue{Action: Decrement, Path: "/stock/count", Value: 2},
+		UpdateValue{Action: AddToSet, Path: "/tags", Value: []string{"a", "b"}},
+		UpdateValue{Action: RemoveFromSet, Path: "/ids", Value: 3},
+		UpdateValue{Action: SetIfNotExists, Path: "/created", Value: "today"},
+		UpdateValue{Action: Delete, Path: "/old"}}
+
+	exp, err := buildUpdateExpression(i, expAMap, expNames)
+	assert.Nil(err)
+	assert.Equal("SET #0ename0 = if_not_exists(#0ename0, :val1) + :val0, #1ename0.#1ename1 = if_not_exists(#1ename0.#1ename1, :val3) - :val2, "+
+		"#4ename0 = if_not_exists(#4ename0, :val6) REMOVE #5ename0 ADD #2ename0 :val4 DELETE #3ename0 :val5", exp)
+	assert.Equal(map[string]*dynamodb.AttributeValue{
+		":val0": &dynamodb.AttributeValue{N: aws.String("1")},
+		":val1": &dynamodb.AttributeValue{N: aws.String("0")},
+		":val2": &dynamodb.AttributeValue{N: aws.String("2")},
+		":val3": &dynamodb.AttributeValue{N: aws.String("0")},
+		":val4": &dynamodb.AttributeValue{SS: aws.StringSlice([]string{"a", "b"})},
+		":val5": &dynamodb.AttributeValue{NS: aws.StringSlice([]string{"3"})},
+		":val6": &dynamodb.AttributeValue{S: aws.String("today")}}, expAMap)
+
+	invalid := []UpdateValue{
+		UpdateValue{Action: Increment, Path: "/views", Value: "one"},
+		UpdateValue{Action: AddToSet, Path: "/nested/tags", Value: "a"},
+		UpdateValue{Action: AddToSet, Path: "/tags", Value: []string{}},
+		UpdateValue{Action: AddToSet, Path: "/tags", Value: []interface{}{"a", 1}},
+		UpdateValue{Action: Query, Path: "/tags", Value: "a"}}
+	for _, u := range invalid {
+		_, err = buildUpdateExpression([]UpdateValue{u}, make(map[string]*dynamodb.AttributeValue), make(map[string]*string))
+		assert.NotNil(err, "%v should not build", u)
+	}
+}
+
+func TestBuildListUpdates(t *testing.T) {
+	assert := assert.New(t)
+	expAMap := make(map[string]*dynamodb.AttributeValue)
+	expNames := make(map[string]*string)
+
+	i := []UpdateValue{
+		UpdateValue{Action: Put, Path: "/list/-", Value: "a"},
+		UpdateValue{Action: Append, Path: "/more", Value: []int{1, 2}},
+		UpdateValue{Action: Prepend, Path: "/nested/list", Value: "b"}}
+
+	exp, err := buildUpdateExpression(i, expAMap, expNames)
+	assert.Nil(err)
+	assert.Equal("SET #0ename0 = list_append(if_not_exists(#0ename0, :val1), :val0), #1ename0 = list_append(if_not_exists(#1ename0, :val3), :val2), "+
+		"#2ename0.#2ename1 = list_append(:val4, if_not_exists(#2ename0.#2ename1, :val5))", exp)
+	empty := &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{}}
+	assert.Equal(map[string]*dynamodb.AttributeValue{
+		":val0": &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{&dynamodb.AttributeValue{S: aws.String("a")}}},
+		":val1": empty,
+		":val2": &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{&dynamodb.AttributeValue{N: aws.String("1")}, &dynamodb.AttributeValue{N: aws.String("2")}}},
+		":val3": empty,
+		":val4": &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{&dynamodb.AttributeValue{S: aws.String("b")}}},
+		":val5": empty}, expAMap)
+
+	// inserts are resolved against the current list before the expression is built
+	_, err = buildUpdateExpression([]UpdateValue{UpdateValue{Action: Insert, Path: "/list/1", Value: "a"}}, expAMap, expNames)
+	assert.NotNil(err)
+}
+
 func TestParseUpdateKey(t *testing.T) {
 	assert := assert.New(t)
 
@@ -314,7 +395,7 @@ func TestPut(t *testing.T) {
 		}
 	})
 
-	dbr, e := put(dbc, r)
+	dbr, e := put(context.Background(), dbc, r)
 
 	assert.NotNil(dbr, "Response Nil")
 	assert.Nil(e, "Error Nil")
@@ -325,11 +406,11 @@ func TestPut(t *testing.T) {
 		r.Retryable = util.ConvertBool(false)
 	})
 
-	dbr, e = put(dbc, r)
+	dbr, e = put(context.Background(), dbc, r)
 
 	assert.Nil(dbr, "Response Nil")
 	if assert.NotNil(e, "Error Nil") {
-		assert.Equal(ErrorPutItem, e)
+		assert.Equal(godba.ErrorPutItem, godba.Code(e))
 	}
 
 }
@@ -356,7 +437,7 @@ func TestUpdate(t *testing.T) {
 		}
 	})
 
-	dbr, e := update(dbc, r)
+	dbr, e := update(context.Background(), dbc, r)
 	assert.Nil(e)
 	assert.NotNil(dbr)
 
@@ -366,10 +447,10 @@ func TestUpdate(t *testing.T) {
 		r.Retryable = util.ConvertBool(false)
 	})
 
-	dbr, e = update(dbc, r)
+	dbr, e = update(context.Background(), dbc, r)
 	assert.Nil(dbr, "Response Nil")
 	if assert.NotNil(e, "Error Nil") {
-		assert.Equal(ErrorUpdateItem, e)
+		assert.Equal(godba.ErrorUpdateItem, godba.Code(e))
 	}
 }
 
@@ -401,7 +482,7 @@ func TestQuery(t *testing.T) {
 		data.Count = util.ConverInt64(2)
 	})
 
-	dbr, e := query(dbc, r)
+	dbr, e := query(context.Background(), dbc, r)
 	assert.Nil(e)
 	if assert.NotNil(dbr) {
 		if assert.Equal(2, dbr.GetItemCount()) {
@@ -422,10 +503,10 @@ func TestQuery(t *testing.T) {
 		r.Retryable = util.ConvertBool(false)
 	})
 
-	dbr, e = query(dbc, r)
+	dbr, e = query(context.Background(), dbc, r)
 	assert.Nil(dbr, "Response Nil")
 	if assert.NotNil(e, "Error Nil") {
-		assert.Equal(ErrorQueryItem, e)
+		assert.Equal(godba.ErrorQueryItem, godba.Code(e))
 	}
 }
 
@@ -490,7 +571,7 @@ func TestQueryPages(t *testing.T) {
 		}
 	})
 
-	dbr, e := queryPages(dbc, r)
+	dbr, e := queryPages(context.Background(), dbc, r)
 	assert.Nil(e)
 	if assert.NotNil(dbr.items) && assert.Len(dbr.items, 10) {
 		for i := 0; i < 10; i++ {
@@ -507,7 +588,7 @@ func TestQueryPages(t *testing.T) {
 
 	//get the second page
 	r.Page = 2
-	dbr, e = queryPages(dbc, r)
+	dbr, e = queryPages(context.Background(), dbc, r)
 	assert.Nil(e)
 	if assert.NotNil(dbr.items) && assert.Len(dbr.items, 10) {
 		for i := 0; i < 10; i++ {
@@ -525,7 +606,7 @@ func TestQueryPages(t *testing.T) {
 	//get a different page
 	r.Page = 3
 	r.PageSize = 3
-	dbr, e = queryPages(dbc, r)
+	dbr, e = queryPages(context.Background(), dbc, r)
 	assert.Nil(e)
 	if assert.NotNil(dbr.items) && assert.Len(dbr.items, 3) {
 		assert.NotNil(dbr.items[0]["page0t7"], "looking for: page1t7")
@@ -535,6 +616,122 @@ func TestQueryPages(t *testing.T) {
 	}
 }
 
+func TestConditionalWrites(t *testing.T) {
+	assert := assert.New(t)
+
+	u := Request{Table: "test", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	u.AddUpdateValue("/name", Put, "bob").And("version", Equal, 2).Or("/name", NotExist, nil)
+	d := Request{Table: "test", Action: Delete, Key: map[string]interface{}{"id": "1"}}
+	d.And("version", Equal, 2)
+
+	dbc := getDbClient()
+	dbc.Handlers.Send.PushBack(func(r *request.Request) {
+		switch p := r.Params.(type) {
+		case *dynamodb.UpdateItemInput:
+			assert.Equal("SET #0ename0 = :val0", *p.UpdateExpression)
+			assert.Equal("#ename1 = :val1 OR attribute_not_exists(#ename2)", *p.ConditionExpression)
+			assert.Equal(map[string]*dynamodb.AttributeValue{
+				":val0": &dynamodb.AttributeValue{S: aws.String("bob")},
+				":val1": &dynamodb.AttributeValue{N: aws.String("2")}}, p.ExpressionAttributeValues)
+			assert.Equal(map[string]*string{
+				"#0ename0": aws.String("name"),
+				"#ename1":  aws.String("version"),
+				"#ename2":  aws.String("name")}, p.ExpressionAttributeNames)
+		case *dynamodb.DeleteItemInput:
+			assert.Equal("#ename0 = :val0", *p.ConditionExpression)
+			assert.Equal(map[string]*dynamodb.AttributeValue{":val0": &dynamodb.AttributeValue{N: aws.String("2")}}, p.ExpressionAttributeValues)
+			assert.Equal(map[string]*string{"#ename0": aws.String("version")}, p.ExpressionAttributeNames)
+		default:
+			assert.Fail("unexpected request")
+		}
+	})
+
+	_, e := update(context.Background(), dbc, u)
+	assert.Nil(e)
+	_, e = dbDelete(context.Background(), dbc, d)
+	assert.Nil(e)
+
+	dbc.Handlers.Send.Clear()
+	dbc.Handlers.Send.PushBack(func(r *request.Request) {
+		r.Error = awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+		r.Retryable = aws.Bool(false)
+	})
+
+	_, e = update(context.Background(), dbc, u)
+	assert.Equal(godba.ErrorConditionFailed, godba.Code(e))
+	assert.True(godba.IsConditionFailed(e))
+	_, e = dbDelete(context.Background(), dbc, d)
+	assert.Equal(godba.ErrorConditionFailed, godba.Code(e))
+
+	d.And("version", GreaterThan, true)
+	_, e = dbDelete(context.Background(), dbc, d)
+	assert.Equal(godba.ErrorRequestCondition, godba.Code(e))
+}
+
+func TestVersioned(t *testing.T) {
+	assert := assert.New(t)
+
+	p := Request{Table: "test", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "bob"}}
+	v := versioned(p, "ver")
+	assert.Equal([]RequestCondition{RequestCondition{Field: "ver", Type: NotExist}}, v.RequestConditions)
+	assert.Equal(map[string]interface{}{"name": "bob", "ver": 1}, v.Item)
+	assert.Nil(p.Item["ver"], "the request item should not be modified")
+
+	u := Request{Table: "test", Action: Update, Key: map[string]interface{}{"id": "1"}, Version: 4}
+	u.AddUpdateValue("/name", Put, "alice").And("name", Equal, "bob").Or("name", NotExist, nil)
+	v = versioned(u, "v/1")
+	assert.Equal([]RequestCondition{
+		RequestCondition{Group: u.RequestConditions},
+		RequestCondition{Field: "v/1", Type: Equal, Value: 4}}, v.RequestConditions)
+	assert.Equal([]UpdateValue{
+		UpdateValue{Action: Put, Path: "/name", Value: "alice"},
+		UpdateValue{Action: Put, Path: "/v~11", Value: 5}}, v.Updates)
+	assert.Len(u.Updates, 1)
+
+	exp, err := buildUpdateExpression(v.Updates, make(map[string]*dynamodb.AttributeValue), make(map[string]*string))
+	assert.Nil(err)
+	assert.Equal("SET #0ename0 = :val0, #1ename0 = :val1", exp)
+
+	d := Request{Table: "test", Action: Delete, Key: map[string]interface{}{"id": "1"}}
+	assert.Equal(d, versioned(d, "ver"))
+}
+
+func TestReturnValues(t *testing.T) {
+	assert := assert.New(t)
+
+	dbc := getDbClient()
+	dbc.Handlers.Send.PushBack(func(r *request.Request) {
+		switch p := r.Params.(type) {
+		case *dynamodb.UpdateItemInput:
+			assert.Equal("UPDATED_NEW", *p.ReturnValues)
+			r.Data.(*dynamodb.UpdateItemOutput).Attributes = map[string]*dynamodb.AttributeValue{"views": &dynamodb.AttributeValue{N: aws.String("7")}}
+		case *dynamodb.PutItemInput:
+			assert.Nil(p.ReturnValues)
+		default:
+			assert.Fail("unexpected request")
+		}
+	})
+
+	u := Request{Table: "test", Action: Update, Key: map[string]interface{}{"id": "1"}, ReturnValues: UpdatedNew}
+	u.AddUpdateValue("/views", Increment, 1)
+	res, e := update(context.Background(), dbc, u)
+	if assert.Nil(e) {
+		n, ok := res.GetNumberAttribute("views")
+		assert.True(ok)
+		assert.Equal(7, n)
+		v, ok := res.GetAttribute("views")
+		assert.True(ok)
+		assert.Equal(float64(7), v)
+		_, ok = res.GetNumberAttribute("missing")
+		assert.False(ok)
+	}
+
+	res, e = put(context.Background(), dbc, Request{Table: "test", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{}})
+	if assert.Nil(e) {
+		assert.Nil(res.GetAttributes())
+	}
+}
+
 func TestDelete(t *testing.T) {
 	assert := assert.New(t)
 
@@ -552,7 +749,7 @@ func TestDelete(t *testing.T) {
 		}
 	})
 
-	dbr, e := dbDelete(dbc, r)
+	dbr, e := dbDelete(context.Background(), dbc, r)
 
 	assert.NotNil(dbr, "Response Nil")
 	assert.Nil(e, "Error Nil")
@@ -563,10 +760,10 @@ func TestDelete(t *testing.T) {
 		r.Retryable = util.ConvertBool(false)
 	})
 
-	dbr, e = dbDelete(dbc, r)
+	dbr, e = dbDelete(context.Background(), dbc, r)
 	assert.Nil(dbr, "Response Nil")
 	if assert.NotNil(e, "Error Nil") {
-		assert.Equal(ErrorDeleteItem, e)
+		assert.Equal(godba.ErrorDeleteItem, godba.Code(e))
 	}
 }
 
@@ -591,7 +788,7 @@ func TestGet(t *testing.T) {
 			"two": &dynamodb.AttributeValue{S: util.ConvertString("twovalue")}}
 	})
 
-	dbr, e := get(dbc, r)
+	dbr, e := get(context.Background(), dbc, r)
 
 	assert.NotNil(dbr, "Response nil")
 	assert.Nil(e, "Error nil")
@@ -609,13 +806,58 @@ func TestGet(t *testing.T) {
 		r.Retryable = util.ConvertBool(false)
 	})
 
-	dbr, e = get(dbc, r)
+	dbr, e = get(context.Background(), dbc, r)
 	assert.Nil(dbr, "Response Nil")
 	if assert.NotNil(e, "Error Nil") {
-		assert.Equal(ErrorGetItem, e)
+		assert.Equal(godba.ErrorGetItem, godba.Code(e))
 	}
 }
 
+func TestProjection(t *testing.T) {
+	assert := assert.New(t)
+
+	dbc := getDbClient()
+	dbc.Handlers.Send.PushBack(func(r *request.Request) {
+		switch p := r.Params.(type) {
+		case *dynamodb.GetItemInput:
+			assert.Equal("#ename0, #ename1.#ename2[1]", *p.ProjectionExpression)
+			assert.Equal(map[string]*string{"#ename0": aws.String("name"), "#ename1": aws.String("address"), "#ename2": aws.String("lines")}, p.ExpressionAttributeNames)
+		case *dynamodb.QueryInput:
+			assert.Equal("#ename0 = :val0", *p.KeyConditionExpression)
+			assert.Equal("#ename1, #ename2.#ename3[1]", *p.ProjectionExpression)
+		case *dynamodb.ScanInput:
+			assert.Nil(p.FilterExpression)
+			assert.Equal("#ename0", *p.ProjectionExpression)
+			assert.Equal(map[string]*string{"#ename0": aws.String("name")}, p.ExpressionAttributeNames)
+		default:
+			assert.Fail("unexpected request")
+		}
+		switch d := r.Data.(type) {
+		case *dynamodb.QueryOutput:
+			d.Count = aws.Int64(0)
+		case *dynamodb.ScanOutput:
+			d.Count = aws.Int64(0)
+		}
+	})
+
+	r := Request{Table: "test", Action: Get, Key: map[string]interface{}{"id": "1"}, Projection: []string{"name", "/address/lines/1"}}
+	_, e := get(context.Background(), dbc, r)
+	assert.Nil(e)
+
+	r = Request{Table: "test", Action: Query, Projection: r.Projection}
+	r.And("id", Equal, "1")
+	_, e = query(context.Background(), dbc, r)
+	assert.Nil(e)
+
+	_, e = scan(context.Background(), dbc, Request{Table: "test", Action: Scan, Projection: []string{"name"}})
+	assert.Nil(e)
+
+	_, e = get(context.Background(), dbc, Request{Table: "test", Action: Get, Key: map[string]interface{}{"id": "1"}, Projection: []string{"/0/name"}})
+	assert.Equal(godba.ErrorProjection, godba.Code(e))
+	_, e = scan(context.Background(), dbc, Request{Table: "test", Action: Scan, Projection: []string{"/a//b"}})
+	assert.Equal(godba.ErrorProjection, godba.Code(e))
+}
+
 func TestReverseOp(t *testing.T) {
 	assert := assert.New(t)
 	var o op
@@ -639,25 +881,71 @@ func TestReverseOp(t *testing.T) {
 	r = reverseOp(o)
 	if assert.Equal(r.Action, Put) {
 		assert.Equal(map[string]interface{}{
-			"field1": "value1 string",
-			"field2": float64(2),
-			"field3": []string{"value3.1", "value3.2"}}, r.Item)
+			"field1": o.result.attributes["field1"],
+			"field2": o.result.attributes["field2"],
+			"field3": o.result.attributes["field3"]}, r.Item)
+	}
+
+	// a put that replaced an item puts the old one back
+	o.request.Action = Put
+	r = reverseOp(o)
+	if assert.Equal(r.Action, Put) {
+		assert.Equal(rawItem(o.result.attributes), r.Item)
 	}
 
+	// a delete that found nothing needs no reversing, and neither do reads
+	o.request.Action = Delete
+	assert.Nil(reverseOp(op{request: o.request, result: &dynamodbResult{}}))
+	assert.Nil(reverseOp(op{request: Request{Table: "test", Action: Get, Key: o.request.Key}, result: o.result}))
+
 	o.request.Action = Update
 	o.request.Updates = []UpdateValue{
-		UpdateValue{Delete, "field1", nil},
-		UpdateValue{Put, "field2", 3},
-		UpdateValue{Put, "field4", "irrelevant, should delete"}}
+		UpdateValue{Action: Delete, Path: "/field1", Value: nil},
+		UpdateValue{Action: Put, Path: "/field2", Value: 3},
+		UpdateValue{Action: Put, Path: "/field4", Value: "irrelevant, should delete"},
+		UpdateValue{Action: AddToSet, Path: "/field3", Value: "value3.3"}}
+
+	r = reverseOp(o)
+	if assert.Equal(r.Action, Update) {
+		assert.Equal([]UpdateValue{
+			UpdateValue{Action: Put, Path: "/field1", Value: &dynamodb.AttributeValue{S: util.ConvertString("value1 string")}},
+			UpdateValue{Action: Put, Path: "/field2", Value: &dynamodb.AttributeValue{N: util.ConvertString("2")}},
+			UpdateValue{Action: Delete, Path: "/field4"},
+			UpdateValue{Action: Put, Path: "/field3", Value: o.result.attributes["field3"]}}, r.Updates)
+	}
+
+	// nested paths restore the old nested value, list changes restore the whole list and a parent covers its children
+	o.result = &dynamodbResult{attributes: map[string]*dynamodb.AttributeValue{
+		"profile": &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{
+			"address": &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{"zip": &dynamodb.AttributeValue{S: util.ConvertString("12345")}}},
+			"tags":    &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{&dynamodb.AttributeValue{S: util.ConvertString("a")}}}}},
+		"a/b": &dynamodb.AttributeValue{N: util.ConvertString("1")}}}
+	o.request.Updates = []UpdateValue{
+		UpdateValue{Action: Update, Path: "/profile/address/zip", Value: "54321"},
+		UpdateValue{Action: Put, Path: "/profile/address/city", Value: "nowhere"},
+		UpdateValue{Action: Delete, Path: "/profile/tags/0"},
+		UpdateValue{Action: Put, Path: "/profile/tags/-", Value: "b"},
+		UpdateValue{Action: Increment, Path: "/a~1b", Value: 1},
+		UpdateValue{Action: Put, Path: "/new/-", Value: "c"},
+		UpdateValue{Action: Put, Path: "/other", From: "/profile/address"},
+		UpdateValue{Action: Put, Path: "/other/city", Value: "x"}}
 
 	r = reverseOp(o)
 	if assert.Equal(r.Action, Update) {
 		assert.Equal([]UpdateValue{
-			UpdateValue{Put, "field1", "value1 string"},
-			UpdateValue{Put, "field2", float64(2)},
-			UpdateValue{Delete, "", nil}}, r.Updates)
+			UpdateValue{Action: Put, Path: "/profile/address/zip", Value: &dynamodb.AttributeValue{S: util.ConvertString("12345")}},
+			UpdateValue{Action: Delete, Path: "/profile/address/city"},
+			UpdateValue{Action: Put, Path: "/profile/tags", Value: o.result.attributes["profile"].M["tags"]},
+			UpdateValue{Action: Put, Path: "/a~1b", Value: &dynamodb.AttributeValue{N: util.ConvertString("1")}},
+			UpdateValue{Action: Delete, Path: "/new"},
+			UpdateValue{Action: Delete, Path: "/other"}}, r.Updates)
 	}
 
+	// an update that created the item is reversed by deleting it
+	o.result = &dynamodbResult{}
+	r = reverseOp(o)
+	assert.Equal(Delete, r.Action)
+	assert.Equal(o.request.Key, r.Key)
 }
 
 func TestRollback(t *testing.T) {
@@ -667,8 +955,8 @@ func TestRollback(t *testing.T) {
 	dbc.Handlers.Send.PushBack(func(r *request.Request) {
 		opList = append(opList, r.Operation.Name)
 	})
-	c := &DynamoDBDatastore{
-		db: dbc,
+	tx := &dynamodbTx{
+		c: &DynamoDBDatastore{db: dbc},
 		ops: []op{
 			op{
 				Request{
@@ -678,9 +966,10 @@ func TestRollback(t *testing.T) {
 				&dynamodbResult{}},
 			op{
 				Request{
-					Action: Update,
-					Key:    map[string]interface{}{"id": "1234"},
-					Table:  "test"},
+					Action:  Update,
+					Key:     map[string]interface{}{"id": "1234"},
+					Table:   "test",
+					Updates: []UpdateValue{UpdateValue{Action: Put, Path: "/field1", Value: "new"}}},
 				&dynamodbResult{attributes: map[string]*dynamodb.AttributeValue{
 					"field1": &dynamodb.AttributeValue{S: util.ConvertString("value1 string")},
 					"field2": &dynamodb.AttributeValue{N: util.ConvertString("2")},
@@ -694,9 +983,10 @@ func TestRollback(t *testing.T) {
 					"field1": &dynamodb.AttributeValue{S: util.ConvertString("value1 string")},
 					"field2": &dynamodb.AttributeValue{N: util.ConvertString("2")},
 					"field3": &dynamodb.AttributeValue{SS: []*string{util.ConvertString("value3.1"), util.ConvertString("value3.2")}}}}}}}
-	err := c.Rollback()
+	err := tx.Rollback()
 	assert.Nil(err)
-	assert.Equal([]string{"DeleteItem", "UpdateItem", "PutItem"}, opList)
+	// the writes are reversed last to first
+	assert.Equal([]string{"PutItem", "UpdateItem", "DeleteItem"}, opList)
 }
 
 func TestQueryIndex(t *testing.T) {
@@ -791,3 +1081,457 @@ func TestCacheHit(t *testing.T) {
 	assert.NotEqual(res, res3)
 	assert.Len(opList, 2)
 }
+
+func TestQueryLastKey(t *testing.T) {
+	assert := assert.New(t)
+
+	r := Request{
+		Table:   "test",
+		Action:  Query,
+		Limit:   1,
+		LastKey: map[string]interface{}{"id": "equal", "n": 1, "b": []byte{1, 2}},
+		RequestConditions: []RequestCondition{
+			RequestCondition{Field: "id", Type: Equal, Value: "equal"}}}
+
+	pages := 0
+	dbc := getDbClient()
+	dbc.Handlers.Send.PushBack(func(r *request.Request) {
+		pages++
+		p := r.Params.(*dynamodb.QueryInput)
+		assert.Equal(int64(1), *p.Limit)
+		assert.Equal(map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{S: util.ConvertString("equal")},
+			"n":  &dynamodb.AttributeValue{N: util.ConvertString("1")},
+			"b":  &dynamodb.AttributeValue{B: []byte{1, 2}}}, p.ExclusiveStartKey)
+
+		data := r.Data.(*dynamodb.QueryOutput)
+		data.Items = []map[string]*dynamodb.AttributeValue{
+			map[string]*dynamodb.AttributeValue{"id": &dynamodb.AttributeValue{S: util.ConvertString("equal")}}}
+		data.Count = util.ConverInt64(1)
+		data.LastEvaluatedKey = map[string]*dynamodb.AttributeValue{
+			"id": &dynamodb.AttributeValue{S: util.ConvertString("equal")},
+			"n":  &dynamodb.AttributeValue{N: util.ConvertString("2")},
+			"f":  &dynamodb.AttributeValue{N: util.ConvertString("2.5")},
+			"b":  &dynamodb.AttributeValue{B: []byte{3, 4}}}
+	})
+
+	dbr, e := query(context.Background(), dbc, r)
+	assert.Nil(e)
+	assert.Equal(1, pages, "a limited query should stop after the first page")
+	if assert.NotNil(dbr) {
+		assert.Equal(1, dbr.GetItemCount())
+		assert.Equal(map[string]interface{}{"id": "equal", "n": 2, "f": 2.5, "b": []byte{3, 4}}, dbr.GetLastEvaluatedKey())
+	}
+
+	dbr = &dynamodbResult{}
+	assert.Nil(dbr.GetLastEvaluatedKey())
+
+	// numbers an int or float64 can not hold exactly keep their digits
+	for _, n := range []string{"123456789012345678901234567", "0.1000000000000000000001", "1e3", "007"} {
+		key := decodeKey(map[string]*dynamodb.AttributeValue{"n": &dynamodb.AttributeValue{N: util.ConvertString(n)}})
+		assert.Equal(dynamodbattribute.Number(n), key["n"])
+		av, err := marshalItems(key)
+		if assert.Nil(err) {
+			assert.Equal(n, *av["n"].N)
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	assert := assert.New(t)
+
+	r := Request{
+		Table:         "test",
+		Action:        Scan,
+		Segment:       1,
+		TotalSegments: 4,
+		ResultFitler: []RequestCondition{
+			RequestCondition{Field: "test", Type: Equal, Value: "equal"}}}
+
+	dbc := getDbClient()
+	dbc.Handlers.Send.PushBack(func(r *request.Request) {
+		p, ok := r.Params.(*dynamodb.ScanInput)
+		if assert.True(ok) {
+			assert.Equal("#ename0 = :val0", *p.FilterExpression)
+			assert.Equal(map[string]*string{"#ename0": util.ConvertString("test")}, p.ExpressionAttributeNames)
+			assert.Equal(map[string]*dynamodb.AttributeValue{":val0": &dynamodb.AttributeValue{S: util.ConvertString("equal")}}, p.ExpressionAttributeValues)
+			assert.Equal(int64(1), *p.Segment)
+			assert.Equal(int64(4), *p.TotalSegments)
+		}
+		data := r.Data.(*dynamodb.ScanOutput)
+		data.Items = []map[string]*dynamodb.AttributeValue{
+			map[string]*dynamodb.AttributeValue{"t1": &dynamodb.AttributeValue{S: util.ConvertString("t1v")}},
+			map[string]*dynamodb.AttributeValue{"t2": &dynamodb.AttributeValue{S: util.ConvertString("t2v")}}}
+		data.Count = util.ConverInt64(2)
+	})
+
+	dbr, e := scan(context.Background(), dbc, r)
+	assert.Nil(e)
+	if assert.NotNil(dbr) && assert.Equal(2, dbr.GetItemCount()) {
+		st, _ := dbr.GetStringItem(1, "t2")
+		assert.Equal("t2v", st)
+	}
+
+	var segments []int64
+	var mu sync.Mutex
+	dbc.Handlers.Send.Clear()
+	dbc.Handlers.Send.PushBack(func(r *request.Request) {
+		p := r.Params.(*dynamodb.ScanInput)
+		mu.Lock()
+		segments = append(segments, *p.Segment)
+		mu.Unlock()
+		data := r.Data.(*dynamodb.ScanOutput)
+		data.Items = []map[string]*dynamodb.AttributeValue{
+			map[string]*dynamodb.AttributeValue{"segment": &dynamodb.AttributeValue{N: util.ConvertString(strconv.Itoa(int(*p.Segment)))}}}
+	})
+
+	r.Action = ParallelScan
+	r.Workers = 2
+	dbr, e = parallelScan(context.Background(), dbc, r)
+	assert.Nil(e)
+	assert.ElementsMatch([]int64{0, 1, 2, 3}, segments)
+	if assert.NotNil(dbr) && assert.Equal(4, dbr.GetItemCount()) {
+		for i := 0; i < 4; i++ {
+			n, _ := dbr.GetNumberItem(i, "segment")
+			assert.Equal(i, n)
+		}
+	}
+
+	r.TotalSegments = 0
+	_, e = parallelScan(context.Background(), dbc, r)
+	assert.NotNil(e)
+
+	// each failure is coded for what went wrong
+	_, e = scan(context.Background(), dbc, Request{Table: "test", Action: Scan, ResultFitler: []RequestCondition{
+		RequestCondition{Field: "test", Type: Condition(99), Value: "equal"}}})
+	assert.Equal(godba.ErrorFilterCondition, godba.Code(e))
+	_, e = scan(context.Background(), dbc, Request{Table: "test", Action: Scan, LastKey: map[string]interface{}{"id": complex(1, 2)}})
+	assert.Equal(godba.ErrorMarshalItem, godba.Code(e))
+	dbc.Handlers.Send.Clear()
+	dbc.Handlers.Send.PushBack(func(r *request.Request) {
+		r.Error = awserr.New("TestError", "testing", nil)
+	})
+	_, e = scan(context.Background(), dbc, Request{Table: "test", Action: Scan})
+	assert.Equal(godba.ErrorScanItem, godba.Code(e))
+	assert.Equal("Scan", e.(*godba.Error).Op)
+}
+
+func TestMergeProjections(t *testing.T) {
+	assert := assert.New(t)
+
+	merged := mergeProjections(map[string]bool{
+		"name": true, "/name": true, "/address/lines/1": true, "/address": true, "/tags/0": true, "/tags/1": true, "id": true})
+	assert.Equal([]string{"/address", "/name", "/tags/0", "/tags/1", "id"}, merged)
+	assert.Equal([]string{"/a~1b"}, mergeProjections(map[string]bool{"/a~1b": true, "/a~1b/c": true}))
+}
+
+func TestBatchGet(t *testing.T) {
+	assert := assert.New(t)
+
+	r := Request{Action: BatchGet}
+	for i := 0; i < 150; i++ {
+		r.AddBatch(Request{Table: "test", Action: Get, Key: map[string]interface{}{"id": strconv.Itoa(i)}})
+	}
+
+	calls := 0
+	retried := false
+	dbc := getDbClient()
+	dbc.Handlers.Send.PushBack(func(r *request.Request) {
+		calls++
+		p := r.Params.(*dynamodb.BatchGetItemInput)
+		keys := p.RequestItems["test"].Keys
+		assert.True(len(keys) <= 100)
+
+		data := r.Data.(*dynamodb.BatchGetItemOutput)
+		data.Responses = map[string][]map[string]*dynamodb.AttributeValue{}
+		for i, k := range keys {
+			// leave the first key unprocessed once, and never return item 7
+			if i == 0 && !retried {
+				retried = true
+				data.UnprocessedKeys = map[string]*dynamodb.KeysAndAttributes{"test": &dynamodb.KeysAndAttributes{Keys: keys[:1]}}
+				continue
+			}
+			if *k["id"].S == "7" {
+				continue
+			}
+			data.Responses["test"] = append(data.Responses["test"], map[string]*dynamodb.AttributeValue{
+				"id":    k["id"],
+				"value": &dynamodb.AttributeValue{S: util.ConvertString("v" + *k["id"].S)}})
+		}
+	})
+
+	dbr, e := batchGet(context.Background(), dbc, r)
+	assert.Nil(e)
+	assert.Equal(3, calls)
+	if assert.NotNil(dbr) && assert.Equal(150, dbr.GetItemCount()) {
+		for i := 0; i < 150; i++ {
+			v, ok := dbr.GetStringItem(i, "value")
+			if i == 7 {
+				assert.False(ok)
+			} else {
+				assert.Equal("v"+strconv.Itoa(i), v)
+			}
+		}
+	}
+
+	r.Batch[0].Action = Put
+	_, e = batchGet(context.Background(), dbc, r)
+	assert.NotNil(e)
+}
+
+func TestBatchWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	r := Request{Action: BatchWrite}
+	for i := 0; i < 30; i++ {
+		r.AddBatch(Request{Table: "test", Action: Put, Key: map[string]interface{}{"id": strconv.Itoa(i)}, Item: map[string]interface{}{"field": i}})
+	}
+	r.AddBatch(Request{Table: "other", Action: Delete, Key: map[string]interface{}{"id": "x"}})
+
+	var sizes []int
+	dbc := getDbClient()
+	dbc.Handlers.Send.PushBack(func(r *request.Request) {
+		p := r.Params.(*dynamodb.BatchWriteItemInput)
+		n := 0
+		for _, w := range p.RequestItems {
+			n += len(w)
+		}
+		sizes = append(sizes, n)
+		if len(sizes) == 1 {
+			data := r.Data.(*dynamodb.BatchWriteItemOutput)
+			data.UnprocessedItems = map[string][]*dynamodb.WriteRequest{"test": p.RequestItems["test"][:2]}
+		}
+	})
+
+	dbr, applied, e := batchWrite(context.Background(), dbc, r)
+	assert.Nil(e)
+	assert.NotNil(dbr)
+	assert.Equal([]int{25, 2, 6}, sizes)
+	assert.Len(applied, 31)
+
+	// a failing chunk stops the batch, the requests written before it are returned
+	sizes = nil
+	dbc.Handlers.Send.PushBack(func(r *request.Request) {
+		if len(sizes) == 3 {
+			r.Error = awserr.New("TestError", "testing", nil)
+		}
+	})
+	_, applied, e = batchWrite(context.Background(), dbc, r)
+	assert.Equal(godba.ErrorBatchWrite, godba.Code(e))
+	if assert.Len(applied, 31) {
+		assert.Equal(30, applied[30], "the failing chunk may have been written")
+	}
+
+	// requests still unprocessed when the batch stops were not written
+	sizes = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	dbc.Handlers.Send.Clear()
+	dbc.Handlers.Send.PushBack(func(r *request.Request) {
+		sizes = append(sizes, 0)
+		if len(sizes) == 2 {
+			p := r.Params.(*dynamodb.BatchWriteItemInput)
+			data := r.Data.(*dynamodb.BatchWriteItemOutput)
+			data.UnprocessedItems = map[string][]*dynamodb.WriteRequest{"test": p.RequestItems["test"][:1]}
+			cancel()
+		}
+	})
+	_, applied, e = batchWrite(ctx, dbc, r)
+	assert.NotNil(e)
+	if assert.Len(applied, 30) {
+		assert.Equal(24, applied[24])
+		assert.Equal(26, applied[25], "item 25 was never written")
+	}
+
+	r.Batch[0].Action = Update
+	_, applied, e = batchWrite(context.Background(), dbc, r)
+	assert.NotNil(e)
+	assert.Empty(applied)
+}
+
+func TestRunContext(t *testing.T) {
+	assert := assert.New(t)
+
+	pages := 0
+	ctx, cancel := context.WithCancel(context.Background())
+	dbc := getDbClient()
+	dbc.Handlers.Send.PushBack(func(r *request.Request) {
+		data := r.Data.(*dynamodb.QueryOutput)
+		data.Items = []map[string]*dynamodb.AttributeValue{
+			map[string]*dynamodb.AttributeValue{"id": &dynamodb.AttributeValue{S: aws.String(strconv.Itoa(pages))}}}
+		data.Count = aws.Int64(1)
+		data.LastEvaluatedKey = map[string]*dynamodb.AttributeValue{"id": &dynamodb.AttributeValue{S: aws.String(strconv.Itoa(pages))}}
+		pages++
+		// the client goes away while the first page is being read
+		cancel()
+	})
+
+	c := &DynamoDBDatastore{db: dbc}
+	r := Request{Table: "test", Action: QueryPager, Page: 1, PageSize: 10}
+	r.And("id", Equal, "1")
+
+	_, e := c.RunContext(ctx, r)
+	assert.NotNil(e)
+	assert.Equal(1, pages, "no more pages should be read once the context is cancelled")
+
+	_, e = c.RunContext(ctx, r)
+	assert.Equal(context.Canceled, e)
+	assert.Equal(1, pages)
+}
+
+func TestErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	dbc := getDbClient()
+	dbc.Handlers.Send.PushBack(func(r *request.Request) {
+		r.Error = awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "slow down", nil)
+		r.Retryable = aws.Bool(false)
+	})
+
+	_, e := get(context.Background(), dbc, Request{Table: "test", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	if assert.NotNil(e) {
+		var ge *godba.Error
+		if assert.True(errors.As(e, &ge)) {
+			assert.Equal(godba.ErrorGetItem, ge.Code)
+			assert.Equal("GetItem", ge.Op)
+			assert.Equal("test", ge.Table)
+		}
+		assert.True(errors.Is(e, &godba.Error{Code: godba.ErrorGetItem}))
+		assert.False(errors.Is(e, &godba.Error{Code: godba.ErrorPutItem}))
+		assert.True(godba.IsThrottled(e))
+		assert.False(godba.IsConditionFailed(e))
+		assert.False(godba.IsNotFound(e))
+		assert.Equal("Unable to retrieve item from the database [ProvisionedThroughputExceededException: slow down]", e.Error())
+	}
+
+	r := Request{Table: "test", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{}}
+	r.And("id", GreaterThan, true)
+	_, e = put(context.Background(), dbc, r)
+	assert.Equal(godba.ErrorRequestCondition, godba.Code(e))
+}
+
+func TestBuildConditionOperators(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		c    RequestCondition
+		exp  string
+		vals []*dynamodb.AttributeValue
+	}{
+		{RequestCondition{Field: "f", Type: NotEqual, Value: "a"}, "#ename0 <> :val0", []*dynamodb.AttributeValue{&dynamodb.AttributeValue{S: aws.String("a")}}},
+		{RequestCondition{Field: "f", Type: GreaterOrEqual, Value: 1}, "#ename0 >= :val0", []*dynamodb.AttributeValue{&dynamodb.AttributeValue{N: aws.String("1")}}},
+		{RequestCondition{Field: "f", Type: LessOrEqual, Value: 1}, "#ename0 <= :val0", []*dynamodb.AttributeValue{&dynamodb.AttributeValue{N: aws.String("1")}}},
+		{RequestCondition{Field: "f", Type: Between, Value: []int{1, 5}}, "#ename0 BETWEEN :val0 AND :val1", []*dynamodb.AttributeValue{&dynamodb.AttributeValue{N: aws.String("1")}, &dynamodb.AttributeValue{N: aws.String("5")}}},
+		{RequestCondition{Field: "f", Type: In, Value: []string{"a", "b"}}, "#ename0 IN (:val0, :val1)", []*dynamodb.AttributeValue{&dynamodb.AttributeValue{S: aws.String("a")}, &dynamodb.AttributeValue{S: aws.String("b")}}},
+		{RequestCondition{Field: "f", Type: Contains, Value: "a"}, "contains(#ename0, :val0)", []*dynamodb.AttributeValue{&dynamodb.AttributeValue{S: aws.String("a")}}},
+		{RequestCondition{Field: "f", Type: SizeGreaterThan, Value: 2}, "size(#ename0) > :val0", []*dynamodb.AttributeValue{&dynamodb.AttributeValue{N: aws.String("2")}}},
+		{RequestCondition{Field: "f", Type: SizeEquals, Value: 2}, "size(#ename0) = :val0", []*dynamodb.AttributeValue{&dynamodb.AttributeValue{N: aws.String("2")}}},
+		{RequestCondition{Field: "f", Type: AttributeType, Value: "SS"}, "attribute_type(#ename0, :val0)", []*dynamodb.AttributeValue{&dynamodb.AttributeValue{S: aws.String("SS")}}},
+	}
+
+	for _, test := range tests {
+		vals := make(map[string]*dynamodb.AttributeValue)
+		names := make(map[string]*string)
+		exp, err := buildConditionExpression([]RequestCondition{test.c}, vals, names)
+		if assert.Nil(err, test.c.Type.String()) {
+			assert.Equal(test.exp, exp)
+			assert.Equal("f", *names["#ename0"])
+			for i, v := range test.vals {
+				assert.Equal(v, vals[":val"+strconv.Itoa(i)], test.c.Type.String())
+			}
+			assert.Len(vals, len(test.vals))
+		}
+	}
+
+	invalid := []RequestCondition{
+		RequestCondition{Field: "f", Type: NotEqual, Value: make(chan int)},
+		RequestCondition{Field: "f", Type: GreaterOrEqual, Value: true},
+		RequestCondition{Field: "f", Type: Between, Value: []int{1}},
+		RequestCondition{Field: "f", Type: Between, Value: 1},
+		RequestCondition{Field: "f", Type: In, Value: []string{}},
+		RequestCondition{Field: "f", Type: In, Value: []interface{}{"a", func() {}}},
+		RequestCondition{Field: "f", Type: SizeEquals, Value: "a"},
+		RequestCondition{Field: "f", Type: AttributeType, Value: "X"},
+	}
+	for _, c := range invalid {
+		_, err := buildConditionExpression([]RequestCondition{c}, make(map[string]*dynamodb.AttributeValue), make(map[string]*string))
+		assert.NotNil(err, c.Type.String())
+	}
+}
+
+func TestConditionPath(t *testing.T) {
+	assert := assert.New(t)
+
+	vals := make(map[string]*dynamodb.AttributeValue)
+	names := make(map[string]*string)
+	exp, err := buildConditionExpression([]RequestCondition{
+		RequestCondition{Field: "/profile/address/zip", Type: Equal, Value: "12345"},
+		RequestCondition{Field: "/tags/0", Type: Exist, Relationship: And},
+		RequestCondition{Field: "plain.name", Type: Exist, Relationship: And},
+		RequestCondition{Field: "/a~1b/c~0d", Type: Exist, Relationship: And}}, vals, names)
+	assert.Nil(err)
+	assert.Equal("#ename0.#ename1.#ename2 = :val0 AND attribute_exists(#ename3[0]) AND attribute_exists(#ename4) AND attribute_exists(#ename5.#ename6)", exp)
+	assert.Equal(map[string]*string{
+		"#ename0": aws.String("profile"),
+		"#ename1": aws.String("address"),
+		"#ename2": aws.String("zip"),
+		"#ename3": aws.String("tags"),
+		"#ename4": aws.String("plain.name"),
+		"#ename5": aws.String("a/b"),
+		"#ename6": aws.String("c~d")}, names)
+
+	for _, f := range []string{"/0/a", "/a//b", "/a/-"} {
+		_, err = buildConditionExpression([]RequestCondition{RequestCondition{Field: f, Type: Exist}}, vals, make(map[string]*string))
+		assert.NotNil(err, f)
+	}
+}
+
+func TestConditionValues(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	vals := make(map[string]*dynamodb.AttributeValue)
+	names := make(map[string]*string)
+	exp, err := buildConditionExpression([]RequestCondition{
+		RequestCondition{Field: "a", Type: GreaterThan, Value: int64(5)},
+		RequestCondition{Field: "b", Type: LessOrEqual, Value: 2.5, Relationship: And},
+		RequestCondition{Field: "c", Type: Equal, Value: true, Relationship: And},
+		RequestCondition{Field: "d", Type: Equal, Value: []byte("x"), Relationship: And},
+		RequestCondition{Field: "e", Type: LessThan, Value: now, Relationship: And},
+		RequestCondition{Field: "f", Type: Between, Value: []float64{1.5, 2.5}, Relationship: And},
+		RequestCondition{Field: "g", Type: GreaterThan, Value: dynamodbattribute.UnixTime(now), Relationship: And}}, vals, names)
+	assert.Nil(err)
+	assert.Equal("#ename0 > :val0 AND #ename1 <= :val1 AND #ename2 = :val2 AND #ename3 = :val3 AND #ename4 < :val4 AND #ename5 BETWEEN :val5 AND :val6 AND #ename6 > :val7", exp)
+	assert.Equal("5", *vals[":val0"].N)
+	assert.Equal("2.5", *vals[":val1"].N)
+	assert.True(*vals[":val2"].BOOL)
+	assert.Equal([]byte("x"), vals[":val3"].B)
+	assert.Equal("2020-01-02T03:04:05Z", *vals[":val4"].S)
+	assert.Equal("1.5", *vals[":val5"].N)
+	assert.Equal(strconv.FormatInt(now.Unix(), 10), *vals[":val7"].N)
+
+	r := Request{Table: "test", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{}}
+	r.And("a", Equal, make(chan int))
+	_, err = put(context.Background(), getDbClient(), r)
+	if assert.NotNil(err) {
+		assert.Equal(godba.ErrorEncodeValue, godba.Code(err))
+		assert.True(errors.Is(err, &godba.Error{Code: godba.ErrorEncodeValue}))
+	}
+
+	u := timeCodec{TimeUnix}.request(Request{
+		Key:               map[string]interface{}{"ts": now},
+		Item:              map[string]interface{}{"meta": map[string]interface{}{"at": now, "n": 1}},
+		RequestConditions: []RequestCondition{RequestCondition{Field: "ts", Type: Between, Value: []time.Time{now, now}}}})
+	vals = make(map[string]*dynamodb.AttributeValue)
+	_, err = buildConditionExpression(u.RequestConditions, vals, make(map[string]*string))
+	assert.Nil(err)
+	assert.Equal(strconv.FormatInt(now.Unix(), 10), *vals[":val0"].N)
+	key, err := marshalItems(u.Key)
+	if assert.Nil(err) {
+		assert.Equal(strconv.FormatInt(now.Unix(), 10), *key["ts"].N)
+	}
+	item, err := marshalItems(u.Item)
+	if assert.Nil(err) {
+		assert.Equal(strconv.FormatInt(now.Unix(), 10), *item["meta"].M["at"].N)
+		assert.Equal("1", *item["meta"].M["n"].N)
+	}
+}
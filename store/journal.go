@@ -0,0 +1,271 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Journal durably records the writes of Compensating transactions. Each entry is the request that reverses
+// a write, appended before the write is sent, so if the process stops part way through a transaction
+// another one can roll it back with Recover. Once a write is known to be applied, or known not to be, a marker
+// entry records it. A write that has no marker is only reversed if the item is still as the write left it.
+// Puts, Updates and Deletes read the item first and only write if it is unchanged, which makes them fail
+// with ErrorConditionFailed when another process changes the item at the same time. The item's VersionAttribute
+// tells if it changed, or JournalHashAttribute when the datastore has no version
+type Journal interface {
+	// Begin starts a new transaction and returns its id
+	Begin(ctx context.Context) (string, error)
+
+	// Append records the reversing request for a write, before the write is sent
+	Append(ctx context.Context, tx string, entry JournalEntry) error
+
+	// Entries returns a transaction's entries in the order they were appended
+	Entries(ctx context.Context, tx string) ([]JournalEntry, error)
+
+	// End removes a transaction that was finished or rolled back
+	End(ctx context.Context, tx string) error
+
+	// Open returns the ids of the transactions that have not ended
+	Open(ctx context.Context) ([]string, error)
+}
+
+// JournalEntry is a request that reverses a write, with its values stored as dynamodb attribute values so
+// it round trips through json unchanged
+type JournalEntry struct {
+	Table   string
+	Action  Action
+	Key     map[string]*dynamodb.AttributeValue
+	Item    map[string]*dynamodb.AttributeValue `json:",omitempty"`
+	Updates []JournalUpdate                     `json:",omitempty"`
+	Write   int                                 // the number of the write in the transaction, or the one a marker is for
+	Check   string                              `json:",omitempty"` // the attribute that tells if a write with no marker was applied
+	Written *dynamodb.AttributeValue            `json:",omitempty"` // the value the write left in Check, nil if it removed the item
+	Applied bool                                `json:",omitempty"` // a marker: the write was applied
+	Cancel  bool                                `json:",omitempty"` // a marker: the write was not applied, it is not reversed
+}
+
+// JournalHashAttribute is added to the items written by Compensating transactions with a TransactionJournal
+// when the datastore has no VersionAttribute, and to the items of their BatchWrites. It holds a hash of the
+// last journaled write of the item
+const JournalHashAttribute = "godbaJournalHash"
+
+// JournalUpdate is an UpdateValue of a JournalEntry
+type JournalUpdate struct {
+	Action Action
+	Path   string
+	Value  *dynamodb.AttributeValue `json:",omitempty"`
+}
+
+func newJournalEntry(r Request) (JournalEntry, error) {
+	e := JournalEntry{Table: r.Table, Action: r.Action}
+
+	var err error
+	if e.Key, err = marshalItems(r.Key); err != nil {
+		return e, err
+	}
+	if r.Item != nil {
+		if e.Item, err = marshalItems(r.Item); err != nil {
+			return e, err
+		}
+	}
+	for _, u := range r.Updates {
+		ju := JournalUpdate{Action: u.Action, Path: u.Path}
+		if u.Action != Delete {
+			if ju.Value, err = encodeValue(u.Value); err != nil {
+				return e, err
+			}
+		}
+		e.Updates = append(e.Updates, ju)
+	}
+
+	return e, nil
+}
+
+// journalRequests returns the reversing requests of a transaction's entries, leaving out the writes that were
+// not applied. A write with no marker may or may not have been, its reverse is conditional on the item
+// still being as the write left it
+func journalRequests(entries []JournalEntry) []Request {
+	applied := make(map[int]bool)
+	for _, e := range entries {
+		if e.Applied || e.Cancel {
+			applied[e.Write] = e.Applied
+		}
+	}
+
+	reverse := make([]Request, 0, len(entries))
+	for _, e := range entries {
+		if e.Applied || e.Cancel {
+			continue
+		}
+		a, marked := applied[e.Write]
+		if marked && !a {
+			continue
+		}
+		r := e.request()
+		if !marked && e.Check != "" {
+			check := Where(attributePath(e.Check), Equal, e.Written)
+			if e.Written == nil {
+				check = Where(attributePath(e.Check), NotExist, nil)
+			}
+			r.RequestConditions = []RequestCondition{check}
+		}
+		reverse = append(reverse, r)
+	}
+	return reverse
+}
+
+// request rebuilds the reversing request. The table is already prefixed
+func (e JournalEntry) request() Request {
+	r := Request{Table: e.Table, Action: e.Action, Key: rawItem(e.Key)}
+	if e.Item != nil {
+		r.Item = rawItem(e.Item)
+	}
+	for _, u := range e.Updates {
+		uv := UpdateValue{Action: u.Action, Path: u.Path}
+		if u.Value != nil {
+			uv.Value = u.Value
+		}
+		r.Updates = append(r.Updates, uv)
+	}
+	return r
+}
+
+// newTransactionID returns a random id for a journal transaction
+func newTransactionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// FileJournal is a Journal that keeps each transaction in a file of json lines in a directory. Every
+// append is synced to disk before it returns. Processes that run at the same time need their own directory
+type FileJournal struct {
+	dir string
+	mu  sync.Mutex
+}
+
+const journalExt = ".journal"
+
+// NewFileJournal returns a journal in dir, creating the directory if needed
+func NewFileJournal(dir string) (*FileJournal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileJournal{dir: dir}, nil
+}
+
+func (j *FileJournal) path(tx string) string {
+	return filepath.Join(j.dir, tx+journalExt)
+}
+
+// Begin creates the transaction's file
+func (j *FileJournal) Begin(ctx context.Context) (string, error) {
+	tx, err := newTransactionID()
+	if err != nil {
+		return "", err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f, err := os.OpenFile(j.path(tx), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return "", err
+	}
+	return tx, f.Close()
+}
+
+// Append writes the entry as a line at the end of the transaction's file
+func (j *FileJournal) Append(ctx context.Context, tx string, entry JournalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	f, err := os.OpenFile(j.path(tx), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Entries reads the transaction's file. A partly written last line, left by a crash during Append, is skipped
+func (j *FileJournal) Entries(ctx context.Context, tx string) ([]JournalEntry, error) {
+	j.mu.Lock()
+	data, err := ioutil.ReadFile(j.path(tx))
+	j.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []JournalEntry
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(make([]byte, 64*1024), len(data)+1)
+	for s.Scan() {
+		var e JournalEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			if !bytes.HasSuffix(data, []byte("\n")) && bytes.HasSuffix(data, s.Bytes()) {
+				break
+			}
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, s.Err()
+}
+
+// End removes the transaction's file
+func (j *FileJournal) End(ctx context.Context, tx string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err := os.Remove(j.path(tx))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Open lists the transaction files in the directory
+func (j *FileJournal) Open(ctx context.Context) ([]string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	files, err := filepath.Glob(filepath.Join(j.dir, "*"+journalExt))
+	if err != nil {
+		return nil, err
+	}
+
+	txs := make([]string, 0, len(files))
+	for _, f := range files {
+		txs = append(txs, strings.TrimSuffix(filepath.Base(f), journalExt))
+	}
+	sort.Strings(txs)
+	return txs, nil
+}
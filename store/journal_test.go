@@ -0,0 +1,433 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/sethjback/godba/config"
+	godba "github.com/sethjback/godba/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournalEntry(t *testing.T) {
+	assert := assert.New(t)
+
+	r := Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	r.AddUpdateValue("/name", Put, &dynamodb.AttributeValue{S: aws.String("bob")}).
+		AddUpdateValue("/tags", Put, &dynamodb.AttributeValue{SS: []*string{aws.String("a")}}).
+		AddUpdateValue("/old", Delete, nil)
+
+	e, err := newJournalEntry(r)
+	if assert.Nil(err) {
+		assert.Equal(map[string]*dynamodb.AttributeValue{"id": &dynamodb.AttributeValue{S: aws.String("1")}}, e.Key)
+		assert.Nil(e.Updates[2].Value)
+
+		back := e.request()
+		assert.Equal(r.Table, back.Table)
+		assert.Equal(Update, back.Action)
+		assert.Equal(r.Updates[1], back.Updates[1])
+		assert.Equal(UpdateValue{Action: Delete, Path: "/old"}, back.Updates[2])
+	}
+}
+
+func testJournal(t *testing.T, j Journal) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	open, err := j.Open(ctx)
+	assert.Nil(err)
+	assert.Empty(open)
+
+	first, err := j.Begin(ctx)
+	assert.Nil(err)
+	second, err := j.Begin(ctx)
+	assert.Nil(err)
+	assert.NotEqual(first, second)
+
+	entries := []JournalEntry{
+		JournalEntry{Table: "users", Action: Delete, Key: map[string]*dynamodb.AttributeValue{"id": &dynamodb.AttributeValue{S: aws.String("1")}}},
+		JournalEntry{Table: "users", Action: Put, Key: map[string]*dynamodb.AttributeValue{"id": &dynamodb.AttributeValue{S: aws.String("2")}},
+			Item: map[string]*dynamodb.AttributeValue{"n": &dynamodb.AttributeValue{N: aws.String("1")}}}}
+	for _, e := range entries {
+		assert.Nil(j.Append(ctx, first, e))
+	}
+	assert.Nil(j.Append(ctx, second, entries[0]))
+
+	got, err := j.Entries(ctx, first)
+	assert.Nil(err)
+	assert.Equal(entries, got)
+
+	open, err = j.Open(ctx)
+	assert.Nil(err)
+	assert.ElementsMatch([]string{first, second}, open)
+
+	assert.Nil(j.End(ctx, first))
+	open, err = j.Open(ctx)
+	assert.Nil(err)
+	assert.Equal([]string{second}, open)
+}
+
+func TestFileJournal(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "journal")
+	if !assert.Nil(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := NewFileJournal(filepath.Join(dir, "tx"))
+	if !assert.Nil(err) {
+		return
+	}
+	testJournal(t, j)
+
+	// a crash part way through an append leaves a partial last line, which is ignored
+	ctx := context.Background()
+	tx, _ := j.Begin(ctx)
+	assert.Nil(j.Append(ctx, tx, JournalEntry{Table: "users", Action: Delete}))
+	f, err := os.OpenFile(j.path(tx), os.O_APPEND|os.O_WRONLY, 0600)
+	if assert.Nil(err) {
+		f.WriteString(`{"Table":"us`)
+		f.Close()
+	}
+	entries, err := j.Entries(ctx, tx)
+	assert.Nil(err)
+	assert.Len(entries, 1)
+}
+
+func TestTableJournal(t *testing.T) {
+	db := newMemoryDB()
+	db.createTable("journal", TableSchema{HashKey: "journal", RangeKey: "entry"})
+	testJournal(t, NewTableJournal(db, "journal", "test"))
+
+	// journals with other names in the same table are separate
+	j := NewTableJournal(db, "journal", "other")
+	open, err := j.Open(context.Background())
+	assert.Nil(t, err)
+	assert.Empty(t, open)
+}
+
+func TestMemoryRollbackOrder(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+	c.CacheOff()
+
+	_, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "bob"}})
+	assert.Nil(e)
+
+	// each write depends on the one before it, so they only undo cleanly last to first
+	tx := c.StartTransaction()
+	_, e = tx.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "alice"}})
+	assert.Nil(e)
+	u := Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	u.AddUpdateValue("/name", Update, "carol").And("name", Equal, "alice")
+	_, e = tx.Run(u)
+	assert.Nil(e)
+	_, e = tx.Run(Request{Table: "users", Action: Delete, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	_, e = tx.Run(Request{Table: "users", Action: Delete, Key: map[string]interface{}{"id": "missing"}})
+	assert.Nil(e)
+	_, e = tx.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+
+	assert.Empty(tx.Rollback())
+	r, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	s, _ := r.GetStringItem(0, "name")
+	assert.Equal("bob", s, "the overwritten item should be put back")
+
+	r, e = c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "missing"}})
+	assert.Nil(e)
+	assert.Equal(0, r.GetItemCount())
+}
+
+// crashingDB applies updates and then fails, like a process that stops right after the write is sent
+type crashingDB struct {
+	*memoryDB
+}
+
+func (d crashingDB) UpdateItemWithContext(ctx aws.Context, in *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	d.memoryDB.UpdateItemWithContext(ctx, in, opts...)
+	return nil, errors.New("crashed")
+}
+
+// lostDB fails updates without applying them, like a request that times out before it reaches dynamodb
+type lostDB struct {
+	*memoryDB
+}
+
+func (d lostDB) UpdateItemWithContext(ctx aws.Context, in *dynamodb.UpdateItemInput, opts ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	return nil, errors.New("timed out")
+}
+
+// racingDB changes an item's name right after the first time it is read with a consistent read,
+// like another journaled transaction writing it between a transaction's read and write
+type racingDB struct {
+	*memoryDB
+	name string
+	done bool
+}
+
+func (d *racingDB) GetItemWithContext(ctx aws.Context, in *dynamodb.GetItemInput, opts ...request.Option) (*dynamodb.GetItemOutput, error) {
+	out, err := d.memoryDB.GetItemWithContext(ctx, in, opts...)
+	if err != nil || out.Item == nil || d.done {
+		return out, err
+	}
+	d.done = true
+	item := map[string]*dynamodb.AttributeValue{}
+	for k, v := range out.Item {
+		item[k] = v
+	}
+	item["name"] = &dynamodb.AttributeValue{S: aws.String(d.name)}
+	item[JournalHashAttribute] = &dynamodb.AttributeValue{S: aws.String("racing")}
+	_, err = d.memoryDB.PutItemWithContext(ctx, &dynamodb.PutItemInput{TableName: in.TableName, Item: item})
+	return out, err
+}
+
+func TestMemoryRecoverAfterWrite(t *testing.T) {
+	assert := assert.New(t)
+	j := NewTableJournal(newMemoryDB(), "journal", "test")
+	j.db.(*memoryDB).createTable("journal", TableSchema{HashKey: "journal", RangeKey: "entry"})
+	cfg := config.Store{
+		TransactionJournal: j,
+		Tables:             map[string]TableSchema{"users": TableSchema{HashKey: "id"}}}
+	c := NewMemory(cfg)
+	c.CacheOff()
+
+	_, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "bob"}})
+	assert.Nil(e)
+
+	// the write is applied but the process stops before it hears back: the entry was journaled first
+	crashed := NewMemory(cfg)
+	crashed.db = crashingDB{c.db.(*memoryDB)}
+	tx := crashed.StartTransaction()
+	u := Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	u.AddUpdateValue("/name", Update, "alice")
+	_, e = tx.Run(u)
+	assert.NotNil(e)
+	res, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	s, _ := res.GetStringItem(0, "name")
+	assert.Equal("alice", s)
+
+	assert.Empty(c.Recover())
+	res, e = c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	s, _ = res.GetStringItem(0, "name")
+	assert.Equal("bob", s)
+
+	// an item changed between the read and the write is not written, and its entry is cancelled so
+	// recovering does not undo the other change
+	racing := NewMemory(cfg)
+	racing.db = &racingDB{memoryDB: c.db.(*memoryDB), name: "dave"}
+	tx = racing.StartTransaction()
+	_, e = tx.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "2"}, Item: map[string]interface{}{"name": "carol"}})
+	assert.Nil(e)
+	u = Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	u.AddUpdateValue("/name", Update, "erin")
+	_, e = tx.Run(u)
+	assert.True(godba.IsConditionFailed(e))
+
+	assert.Empty(c.Recover())
+	res, e = c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	s, _ = res.GetStringItem(0, "name")
+	assert.Equal("dave", s)
+	res, e = c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "2"}})
+	assert.Nil(e)
+	assert.Equal(0, res.GetItemCount())
+
+	// a write that may not have been applied is only reversed if the item still has its hash. This one
+	// was not, and the item has been written since, which recovering leaves alone
+	lost := NewMemory(cfg)
+	lost.db = lostDB{c.db.(*memoryDB)}
+	tx = lost.StartTransaction()
+	u = Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	u.AddUpdateValue("/name", Update, "frank")
+	_, e = tx.Run(u)
+	assert.NotNil(e)
+	_, e = c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "gina"}})
+	assert.Nil(e)
+
+	assert.Empty(c.Recover())
+	res, e = c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	s, _ = res.GetStringItem(0, "name")
+	assert.Equal("gina", s)
+	open, _ := j.Open(context.Background())
+	assert.Empty(open)
+}
+
+func TestMemoryJournalVersion(t *testing.T) {
+	assert := assert.New(t)
+	j := NewTableJournal(newMemoryDB(), "journal", "test")
+	j.db.(*memoryDB).createTable("journal", TableSchema{HashKey: "journal", RangeKey: "entry"})
+	cfg := config.Store{
+		TransactionJournal: j,
+		VersionAttribute:   "version",
+		Tables:             map[string]TableSchema{"users": TableSchema{HashKey: "id"}}}
+	c := NewMemory(cfg)
+	c.CacheOff()
+
+	// a wide item is checked by its version alone, the journal adds no hash
+	item := make(map[string]interface{})
+	for i := 0; i < 200; i++ {
+		item["field"+strconv.Itoa(i)] = strings.Repeat("x", 100)
+	}
+	tx := c.StartTransaction()
+	_, e := tx.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: item})
+	assert.Nil(e)
+	assert.Nil(tx.Finish())
+
+	// the write is applied but fails, the version it set tells recovering to reverse it
+	crashed := NewMemory(cfg)
+	crashed.db = crashingDB{c.db.(*memoryDB)}
+	tx = crashed.StartTransaction()
+	u := Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}, Version: 1}
+	u.AddUpdateValue("/field0", Update, "y")
+	_, e = tx.Run(u)
+	assert.NotNil(e)
+
+	assert.Empty(c.Recover())
+	res, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	s, _ := res.GetStringItem(0, "field0")
+	assert.Equal(strings.Repeat("x", 100), s)
+	v, _ := res.GetVersion(0)
+	assert.Equal(1, v)
+	_, ok := res.GetItem(0, JournalHashAttribute)
+	assert.False(ok)
+}
+
+func TestMemoryRollbackFromJournal(t *testing.T) {
+	assert := assert.New(t)
+	j := NewTableJournal(newMemoryDB(), "journal", "test")
+	j.db.(*memoryDB).createTable("journal", TableSchema{HashKey: "journal", RangeKey: "entry"})
+	c := NewMemory(config.Store{
+		TransactionJournal: j,
+		Tables:             map[string]TableSchema{"users": TableSchema{HashKey: "id"}}})
+	c.CacheOff()
+
+	_, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "bob"}})
+	assert.Nil(e)
+
+	// the update is applied but fails, so the transaction does not record it. Its journal entry undoes it
+	crashed := NewMemory(config.Store{
+		TransactionJournal: j,
+		Tables:             map[string]TableSchema{"users": TableSchema{HashKey: "id"}}})
+	crashed.db = crashingDB{c.db.(*memoryDB)}
+	tx := crashed.StartTransaction()
+	_, e = tx.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "2"}, Item: map[string]interface{}{"name": "carol"}})
+	assert.Nil(e)
+	u := Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	u.AddUpdateValue("/name", Update, "alice")
+	_, e = tx.Run(u)
+	assert.NotNil(e)
+
+	crashed.db = c.db
+	assert.Empty(tx.Rollback())
+	res, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	s, _ := res.GetStringItem(0, "name")
+	assert.Equal("bob", s)
+	res, e = c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "2"}})
+	assert.Nil(e)
+	assert.Equal(0, res.GetItemCount())
+	open, _ := j.Open(context.Background())
+	assert.Empty(open)
+
+	// the puts of a batch carry the hash of their write, and are reversed from their entries too
+	tx = c.StartTransaction()
+	b := Request{Action: BatchWrite}
+	b.AddBatch(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "dave"}}).
+		AddBatch(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "3"}, Item: map[string]interface{}{"name": "erin"}})
+	_, e = tx.Run(b)
+	assert.Nil(e)
+	res, e = c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "3"}})
+	assert.Nil(e)
+	_, ok := res.GetStringItem(0, JournalHashAttribute)
+	assert.True(ok)
+
+	assert.Empty(tx.Rollback())
+	res, e = c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	s, _ = res.GetStringItem(0, "name")
+	assert.Equal("bob", s)
+	res, e = c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "3"}})
+	assert.Nil(e)
+	assert.Equal(0, res.GetItemCount())
+}
+
+func TestMemoryRecover(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "journal")
+	if !assert.Nil(err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	j, _ := NewFileJournal(dir)
+
+	cfg := config.Store{
+		TablePrefix:        "test_",
+		TransactionJournal: j,
+		Tables:             map[string]TableSchema{"users": TableSchema{HashKey: "id"}}}
+	c := NewMemory(cfg)
+	c.CacheOff()
+
+	_, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "bob"}})
+	assert.Nil(e)
+
+	// a finished transaction leaves nothing to recover
+	tx := c.StartTransaction()
+	_, e = tx.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "3"}, Item: map[string]interface{}{"name": "dave"}})
+	assert.Nil(e)
+	assert.Nil(tx.Finish())
+	open, _ := j.Open(context.Background())
+	assert.Empty(open)
+
+	// the process stops part way through a transaction
+	tx = c.StartTransaction()
+	u := Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	u.AddUpdateValue("/name", Update, "alice").AddUpdateValue("/labels", AddToSet, []string{"b"})
+	_, e = tx.Run(u)
+	assert.Nil(e)
+	_, e = tx.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "2"}, Item: map[string]interface{}{"name": "carol"}})
+	assert.Nil(e)
+	open, _ = j.Open(context.Background())
+	assert.Len(open, 1)
+
+	// a new process on the same table and journal rolls it back
+	restarted := NewMemory(cfg)
+	restarted.db = c.db
+	assert.Empty(restarted.Recover())
+
+	r, e := restarted.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	s, _ := r.GetStringItem(0, "name")
+	assert.Equal("bob", s)
+	assert.Nil(r.(*dynamodbResult).items[0]["labels"])
+	r, e = restarted.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "2"}})
+	assert.Nil(e)
+	assert.Equal(0, r.GetItemCount())
+
+	open, _ = j.Open(context.Background())
+	assert.Empty(open)
+	assert.Empty(restarted.Recover())
+
+	// a journal that can not be written fails the write that could not be recorded
+	tx = c.StartTransaction()
+	os.RemoveAll(dir)
+	ioutil.WriteFile(dir, nil, 0600)
+	_, e = tx.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "4"}, Item: map[string]interface{}{"name": "dave"}})
+	assert.Equal(godba.ErrorJournal, godba.Code(e))
+	tx.Rollback()
+}
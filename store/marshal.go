@@ -0,0 +1,409 @@
+package store
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// TimeEncoding controls how time.Time values in requests are stored and compared
+type TimeEncoding int32
+
+const (
+	// TimeRFC3339 stores times as RFC3339 strings with nanoseconds, the dynamodbattribute default
+	TimeRFC3339 TimeEncoding = iota
+
+	// TimeUnix stores times as the number of seconds since the epoch
+	TimeUnix
+)
+
+// tagKey is the struct tag used to name attributes when whole items are (un)marshalled to and from structs.
+// It takes the form `godba:"name,omitempty,key"`. Fields tagged with key are part of the item's key.
+// The other options are the ones supported by dynamodbattribute, and a dynamodbav tag takes precedence
+const tagKey = "godba"
+
+func structEncoder() *dynamodbattribute.Encoder {
+	return dynamodbattribute.NewEncoder(func(e *dynamodbattribute.Encoder) {
+		e.TagKey = tagKey
+	})
+}
+
+func structDecoder() *dynamodbattribute.Decoder {
+	return dynamodbattribute.NewDecoder(func(d *dynamodbattribute.Decoder) {
+		d.TagKey = tagKey
+	})
+}
+
+// keyFields returns the values of the struct fields tagged as part of the key, by attribute name.
+// Anonymous embedded structs are searched as well
+func keyFields(v reflect.Value) map[string]interface{} {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	keys := make(map[string]interface{})
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.Anonymous {
+			for k, kv := range keyFields(v.Field(i)) {
+				keys[k] = kv
+			}
+			continue
+		}
+		if sf.PkgPath != "" {
+			continue
+		}
+
+		parts := strings.Split(sf.Tag.Get(tagKey), ",")
+		if parts[0] == "-" {
+			continue
+		}
+		for _, opt := range parts[1:] {
+			if opt == "key" {
+				name := parts[0]
+				if name == "" {
+					name = sf.Name
+				}
+				keys[name] = v.Field(i).Interface()
+			}
+		}
+	}
+
+	return keys
+}
+
+// encodeValue marshals a single value. Items, keys, updates and conditions all go through it so a value
+// is stored and compared the same way everywhere. Values that are already an AttributeValue, like the ones
+// set by SetItemFrom, are passed through as is
+func encodeValue(v interface{}) (*dynamodb.AttributeValue, error) {
+	if av, ok := v.(*dynamodb.AttributeValue); ok {
+		return av, nil
+	}
+	return dynamodbattribute.NewEncoder().Encode(v)
+}
+
+// timeCodec encodes and decodes the times in requests and results with a datastore's TimeEncoding, so a
+// time is stored, compared and read back the same way wherever it appears. dynamodbattribute only stores
+// times as numbers for fields tagged unixtime, so the codec converts the times around it
+type timeCodec struct {
+	encoding TimeEncoding
+}
+
+// value converts a time.Time value to the codec's encoding. Times nested in maps, slices and structs are
+// converted too, in which case the value is returned encoded. Other values are returned unchanged
+func (c timeCodec) value(v interface{}) interface{} {
+	if c.encoding != TimeUnix {
+		return v
+	}
+	switch t := v.(type) {
+	case nil, *dynamodb.AttributeValue:
+		return v
+	case time.Time:
+		return dynamodbattribute.UnixTime(t)
+	case *time.Time:
+		if t != nil {
+			return dynamodbattribute.UnixTime(*t)
+		}
+		return v
+	case []time.Time:
+		l := make([]interface{}, len(t))
+		for i, e := range t {
+			l[i] = dynamodbattribute.UnixTime(e)
+		}
+		return l
+	}
+
+	rv := reflect.ValueOf(v)
+	av, err := encodeValue(v)
+	if err != nil {
+		// the error is returned when the request is sent
+		return v
+	}
+	if converted := convertTimes(rv.Type(), rv, av, "json", unixTime); converted != av {
+		return converted
+	}
+	return v
+}
+
+func (c timeCodec) values(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[k] = c.value(v)
+	}
+	return out
+}
+
+func (c timeCodec) conditions(conditions []RequestCondition) []RequestCondition {
+	if conditions == nil {
+		return nil
+	}
+	out := make([]RequestCondition, len(conditions))
+	for i, cond := range conditions {
+		cond.Value = c.value(cond.Value)
+		cond.Group = c.conditions(cond.Group)
+		out[i] = cond
+	}
+	return out
+}
+
+// item converts the times in the attributes SetItemFrom marshalled from r.source. Attributes that were
+// replaced since are values like any other
+func (c timeCodec) item(r Request) map[string]interface{} {
+	item := c.values(r.Item)
+	if c.encoding != TimeUnix || r.source == nil {
+		return item
+	}
+
+	marshalled := make(map[string]*dynamodb.AttributeValue)
+	for name, v := range r.Item {
+		if av, ok := v.(*dynamodb.AttributeValue); ok {
+			marshalled[name] = av
+		}
+	}
+	v := reflect.ValueOf(r.source)
+	converted := convertTimes(v.Type(), v, &dynamodb.AttributeValue{M: marshalled}, tagKey, unixTime)
+	for name, av := range converted.M {
+		item[name] = av
+	}
+	return item
+}
+
+// request returns a copy of r with the times in its key, item, updates and conditions converted to the
+// codec's encoding
+func (c timeCodec) request(r Request) Request {
+	if c.encoding == TimeRFC3339 {
+		return r
+	}
+
+	r.Key = c.values(r.Key)
+	r.Item = c.item(r)
+	r.LastKey = c.values(r.LastKey)
+	r.RequestConditions = c.conditions(r.RequestConditions)
+	r.ResultFitler = c.conditions(r.ResultFitler)
+
+	if r.Updates != nil {
+		updates := make([]UpdateValue, len(r.Updates))
+		for i, u := range r.Updates {
+			u.Value = c.value(u.Value)
+			updates[i] = u
+		}
+		r.Updates = updates
+	}
+
+	if r.Batch != nil {
+		batch := make([]Request, len(r.Batch))
+		for i, b := range r.Batch {
+			batch[i] = c.request(b)
+		}
+		r.Batch = batch
+	}
+
+	return r
+}
+
+// decode unmarshals av into out with the decoder, which names struct fields with tag. Stored times are
+// converted back to the strings the decoder reads times from
+func (c timeCodec) decode(d *dynamodbattribute.Decoder, tag string, av *dynamodb.AttributeValue, out interface{}) error {
+	if c.encoding == TimeUnix {
+		if t := reflect.TypeOf(out); t != nil {
+			av = convertTimes(t, reflect.Value{}, av, tag, rfc3339Time)
+		}
+	}
+	return d.Decode(av, out)
+}
+
+var (
+	timeType        = reflect.TypeOf(time.Time{})
+	marshalerType   = reflect.TypeOf((*dynamodbattribute.Marshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*dynamodbattribute.Unmarshaler)(nil)).Elem()
+)
+
+// unixTime converts a time stored as an RFC3339 string to a number of seconds
+func unixTime(av *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if av.S == nil {
+		return av
+	}
+	t, err := time.Parse(time.RFC3339Nano, *av.S)
+	if err != nil {
+		return av
+	}
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(t.Unix(), 10))}
+}
+
+// rfc3339Time converts a time stored as a number of seconds to an RFC3339 string
+func rfc3339Time(av *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if av.N == nil {
+		return av
+	}
+	n, err := strconv.ParseInt(*av.N, 10, 64)
+	if err != nil {
+		return av
+	}
+	return &dynamodb.AttributeValue{S: aws.String(time.Unix(n, 0).UTC().Format(time.RFC3339Nano))}
+}
+
+// convertTimes returns av with conv applied to the attributes that hold a time, going by the Go type t the
+// attribute is encoded from or decoded to. v is the value being encoded, when there is one, and says what
+// an interface holds. Struct fields are named by their tag the way dynamodbattribute names them. av is not
+// modified, the attributes that change are copied, and av itself is returned when nothing changes
+func convertTimes(t reflect.Type, v reflect.Value, av *dynamodb.AttributeValue, tag string, conv func(*dynamodb.AttributeValue) *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if av == nil {
+		return nil
+	}
+
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Interface {
+		if v.IsValid() && v.Kind() == t.Kind() {
+			if v.IsNil() {
+				return av
+			}
+			v = v.Elem()
+		} else {
+			v = reflect.Value{}
+		}
+		if t.Kind() == reflect.Interface {
+			if !v.IsValid() {
+				return av
+			}
+			t = v.Type()
+		} else {
+			t = t.Elem()
+		}
+	}
+	if t.Implements(marshalerType) || reflect.PtrTo(t).Implements(unmarshalerType) {
+		return av
+	}
+	if t.ConvertibleTo(timeType) {
+		return conv(av)
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if av.M == nil {
+			return av
+		}
+		var m map[string]*dynamodb.AttributeValue
+		convertFields(t, v, av.M, tag, conv, &m)
+		if m != nil {
+			return &dynamodb.AttributeValue{M: m}
+		}
+	case reflect.Map:
+		if av.M == nil || t.Key().Kind() != reflect.String {
+			return av
+		}
+		var m map[string]*dynamodb.AttributeValue
+		for name, e := range av.M {
+			var ev reflect.Value
+			if v.IsValid() {
+				ev = v.MapIndex(reflect.ValueOf(name).Convert(t.Key()))
+			}
+			if c := convertTimes(t.Elem(), ev, e, tag, conv); c != e {
+				m = copyAttributes(av.M, m)
+				m[name] = c
+			}
+		}
+		if m != nil {
+			return &dynamodb.AttributeValue{M: m}
+		}
+	case reflect.Slice, reflect.Array:
+		var l []*dynamodb.AttributeValue
+		for i, e := range av.L {
+			var ev reflect.Value
+			if v.IsValid() && i < v.Len() {
+				ev = v.Index(i)
+			}
+			if c := convertTimes(t.Elem(), ev, e, tag, conv); c != e {
+				if l == nil {
+					l = append([]*dynamodb.AttributeValue(nil), av.L...)
+				}
+				l[i] = c
+			}
+		}
+		if l != nil {
+			return &dynamodb.AttributeValue{L: l}
+		}
+	}
+
+	return av
+}
+
+// convertFields converts the times in the attributes of struct type t. The attributes are copied to *m
+// the first time one changes. Anonymous embedded structs are flattened, as dynamodbattribute does
+func convertFields(t reflect.Type, v reflect.Value, attrs map[string]*dynamodb.AttributeValue, tag string, conv func(*dynamodb.AttributeValue) *dynamodb.AttributeValue, m *map[string]*dynamodb.AttributeValue) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" && !sf.Anonymous {
+			continue
+		}
+
+		var fv reflect.Value
+		if v.IsValid() {
+			fv = v.Field(i)
+		}
+		name := sf.Tag.Get("dynamodbav")
+		if name == "" {
+			name = sf.Tag.Get(tag)
+		}
+		name = strings.Split(name, ",")[0]
+		if name == "-" {
+			continue
+		}
+
+		ft := sf.Type
+		if sf.Anonymous && name == "" {
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+				if fv.IsValid() {
+					if fv.IsNil() {
+						continue
+					}
+					fv = fv.Elem()
+				}
+			}
+			if ft.Kind() == reflect.Struct {
+				convertFields(ft, fv, attrs, tag, conv, m)
+				continue
+			}
+		}
+		if sf.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = sf.Name
+		}
+		e, ok := attrs[name]
+		if !ok {
+			continue
+		}
+		if c := convertTimes(sf.Type, fv, e, tag, conv); c != e {
+			*m = copyAttributes(attrs, *m)
+			(*m)[name] = c
+		}
+	}
+}
+
+func copyAttributes(attrs, m map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	if m != nil {
+		return m
+	}
+	m = make(map[string]*dynamodb.AttributeValue, len(attrs))
+	for k, av := range attrs {
+		m[k] = av
+	}
+	return m
+}
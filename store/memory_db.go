@@ -0,0 +1,1087 @@
+package store
+
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/sethjback/godba/config"
+)
+
+// TableSchema describes the key attributes of an in-memory table
+type TableSchema struct {
+	HashKey  string
+	RangeKey string
+	Indexes  map[string]TableSchema // secondary indexes, by name
+}
+
+// memoryDB is an in-process implementation of DBer. Items are held in memory and every
+// expression is evaluated the way DynamoDB would evaluate it, so a DynamoDBDatastore
+// backed by it has the same semantics as one talking to a real table
+type memoryDB struct {
+	mu     sync.Mutex
+	tables map[string]*memoryTable
+}
+
+type memoryTable struct {
+	schema TableSchema
+	items  map[string]memItem // items indexed by their encoded primary key
+}
+
+// make sure we implement the interface
+var _ DBer = (*memoryDB)(nil)
+
+// NewMemory creates a datastore that keeps everything in process. Tables must be declared with the
+// Tables option, just as they would have to exist in DynamoDB
+func NewMemory(c config.Store) *DynamoDBDatastore {
+	dbc := &DynamoDBDatastore{}
+	dbc.configure(c)
+
+	db := newMemoryDB()
+	if t, ok := c.Get(Tables); ok {
+		for name, schema := range t.(map[string]TableSchema) {
+			db.createTable(dbc.tablePrefix+name, schema)
+		}
+	}
+	dbc.db = db
+
+	return dbc
+}
+
+func newMemoryDB() *memoryDB {
+	return &memoryDB{tables: make(map[string]*memoryTable)}
+}
+
+func (m *memoryDB) createTable(name string, schema TableSchema) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tables[name] = &memoryTable{schema: schema, items: make(map[string]memItem)}
+}
+
+func (m *memoryDB) table(name *string) (*memoryTable, error) {
+	t, ok := m.tables[*name]
+	if !ok {
+		return nil, awserr.New(dynamodb.ErrCodeResourceNotFoundException, "Requested resource not found: Table: "+*name+" not found", nil)
+	}
+	return t, nil
+}
+
+// keyNames returns the names of the key attributes of the schema
+func (s TableSchema) keyNames() []string {
+	if s.RangeKey == "" {
+		return []string{s.HashKey}
+	}
+	return []string{s.HashKey, s.RangeKey}
+}
+
+// encodeKey builds a string that uniquely identifies the primary key of the item
+func (t *memoryTable) encodeKey(item map[string]*dynamodb.AttributeValue) (string, error) {
+	var parts []string
+	for _, name := range t.schema.keyNames() {
+		v, ok := item[name]
+		if !ok || v == nil {
+			return "", validationError("One or more parameter values were invalid: Missing the key " + name + " in the item")
+		}
+		switch {
+		case v.S != nil:
+			parts = append(parts, "S:"+*v.S)
+		case v.N != nil:
+			n, ok := parseNumber(*v.N)
+			if !ok {
+				return "", validationError("A value provided cannot be converted into a number")
+			}
+			parts = append(parts, "N:"+n.RatString())
+		case v.B != nil:
+			parts = append(parts, "B:"+string(v.B))
+		default:
+			return "", validationError("One or more parameter values were invalid: Type mismatch for key " + name)
+		}
+	}
+	return strings.Join(parts, "\x00"), nil
+}
+
+// keyOf validates that key contains exactly the key attributes and returns its encoding
+func (t *memoryTable) keyOf(key map[string]*dynamodb.AttributeValue) (string, error) {
+	if len(key) != len(t.schema.keyNames()) {
+		return "", validationError("The provided key element does not match the schema")
+	}
+	return t.encodeKey(key)
+}
+
+// keyAttributes extracts the table (and optional index) key attributes from an item
+func (t *memoryTable) keyAttributes(item memItem, index *TableSchema) map[string]*dynamodb.AttributeValue {
+	k := make(map[string]*dynamodb.AttributeValue)
+	names := t.schema.keyNames()
+	if index != nil {
+		names = append(names, index.keyNames()...)
+	}
+	for _, n := range names {
+		if v, ok := item[n]; ok {
+			k[n] = copyAttr(v)
+		}
+	}
+	return k
+}
+
+// sorted returns the items of the table in key order. If an index is given only items containing the
+// index keys are returned, ordered by the index keys and then the table keys
+func (t *memoryTable) sorted(index *TableSchema) []memItem {
+	var items []memItem
+	for _, item := range t.items {
+		if index != nil {
+			if _, ok := item[index.HashKey]; !ok {
+				continue
+			}
+			if _, ok := item[index.RangeKey]; index.RangeKey != "" && !ok {
+				continue
+			}
+		}
+		items = append(items, item)
+	}
+
+	var names []string
+	if index != nil {
+		names = index.keyNames()
+	}
+	names = append(names, t.schema.keyNames()...)
+
+	sort.Slice(items, func(i, j int) bool {
+		return compareKeys(items[i], items[j], names) < 0
+	})
+	return items
+}
+
+func compareKeys(a, b map[string]*dynamodb.AttributeValue, names []string) int {
+	for _, n := range names {
+		if c, _ := attrCompare(a[n], b[n]); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func (m *memoryDB) GetItem(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	if err := in.Validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, err := m.table(in.TableName)
+	if err != nil {
+		return nil, err
+	}
+	k, err := t.keyOf(in.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	p := newExprParser(in.ExpressionAttributeNames, nil)
+	var proj []docPath
+	if in.ProjectionExpression != nil {
+		if proj, err = p.parseProjection(*in.ProjectionExpression); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	out := &dynamodb.GetItemOutput{}
+	if item, ok := t.items[k]; ok {
+		if proj != nil {
+			item = project(item, proj)
+		}
+		out.Item = copyItem(item)
+	}
+	return out, nil
+}
+
+// memoryWrite is a validated change to a single item that has not been applied yet
+type memoryWrite struct {
+	t       *memoryTable
+	key     string
+	old     memItem
+	item    memItem         // the new item, nil deletes it
+	updated map[string]bool // top level attributes changed by an update
+	check   bool            // a condition check only, nothing is written
+}
+
+func (w memoryWrite) apply() {
+	switch {
+	case w.check:
+	case w.item == nil:
+		delete(w.t.items, w.key)
+	default:
+		w.t.items[w.key] = w.item
+	}
+}
+
+func (m *memoryDB) preparePut(table *string, item map[string]*dynamodb.AttributeValue, cond *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (memoryWrite, error) {
+	t, err := m.table(table)
+	if err != nil {
+		return memoryWrite{}, err
+	}
+	k, err := t.encodeKey(item)
+	if err != nil {
+		return memoryWrite{}, err
+	}
+
+	w := memoryWrite{t: t, key: k, old: t.items[k], item: copyItem(item)}
+	return w, checkCondition(w.old, cond, names, values)
+}
+
+func (m *memoryDB) prepareDelete(table *string, key map[string]*dynamodb.AttributeValue, cond *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (memoryWrite, error) {
+	t, err := m.table(table)
+	if err != nil {
+		return memoryWrite{}, err
+	}
+	k, err := t.keyOf(key)
+	if err != nil {
+		return memoryWrite{}, err
+	}
+
+	w := memoryWrite{t: t, key: k, old: t.items[k]}
+	return w, checkCondition(w.old, cond, names, values)
+}
+
+func (m *memoryDB) prepareCheck(table *string, key map[string]*dynamodb.AttributeValue, cond *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (memoryWrite, error) {
+	w, err := m.prepareDelete(table, key, cond, names, values)
+	w.check = true
+	return w, err
+}
+
+func (m *memoryDB) prepareUpdate(table *string, key map[string]*dynamodb.AttributeValue, exp *string, cond *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) (memoryWrite, error) {
+	t, err := m.table(table)
+	if err != nil {
+		return memoryWrite{}, err
+	}
+	k, err := t.keyOf(key)
+	if err != nil {
+		return memoryWrite{}, err
+	}
+
+	p := newExprParser(names, values)
+	var actions []updateAction
+	if exp != nil {
+		if actions, err = p.parseUpdate(*exp); err != nil {
+			return memoryWrite{}, err
+		}
+	}
+	var c exprCondition
+	if cond != nil {
+		if c, err = p.parseCondition(*cond); err != nil {
+			return memoryWrite{}, err
+		}
+	}
+	if err := p.checkUnused(); err != nil {
+		return memoryWrite{}, err
+	}
+
+	w := memoryWrite{t: t, key: k, old: t.items[k], updated: make(map[string]bool)}
+	if c != nil {
+		ok, err := c.eval(w.old)
+		if err != nil {
+			return memoryWrite{}, err
+		}
+		if !ok {
+			return memoryWrite{}, conditionFailed()
+		}
+	}
+
+	w.item = memItem(copyItem(w.old))
+	if w.item == nil {
+		w.item = memItem(copyItem(key))
+	}
+	if err := applyUpdate(w.item, actions); err != nil {
+		return memoryWrite{}, err
+	}
+	for _, name := range t.schema.keyNames() {
+		if !attrEqual(w.item[name], key[name]) {
+			return memoryWrite{}, validationError("One or more parameter values were invalid: Cannot update attribute " + name + ". This attribute is part of the key")
+		}
+	}
+	for _, a := range actions {
+		w.updated[a.path[0].name] = true
+	}
+
+	return w, nil
+}
+
+func (m *memoryDB) PutItem(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	if err := in.Validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w, err := m.preparePut(in.TableName, in.Item, in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	w.apply()
+
+	out := &dynamodb.PutItemOutput{}
+	if in.ReturnValues != nil && *in.ReturnValues == dynamodb.ReturnValueAllOld {
+		out.Attributes = copyItem(w.old)
+	}
+	return out, nil
+}
+
+func (m *memoryDB) DeleteItem(in *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	if err := in.Validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w, err := m.prepareDelete(in.TableName, in.Key, in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	w.apply()
+
+	out := &dynamodb.DeleteItemOutput{}
+	if in.ReturnValues != nil && *in.ReturnValues == dynamodb.ReturnValueAllOld {
+		out.Attributes = copyItem(w.old)
+	}
+	return out, nil
+}
+
+func (m *memoryDB) UpdateItem(in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	if err := in.Validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w, err := m.prepareUpdate(in.TableName, in.Key, in.UpdateExpression, in.ConditionExpression, in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	w.apply()
+
+	out := &dynamodb.UpdateItemOutput{}
+	if in.ReturnValues != nil {
+		out.Attributes = returnAttributes(*in.ReturnValues, w.old, w.item, w.updated)
+	}
+	return out, nil
+}
+
+// returnAttributes selects the attributes an update returns for the given ReturnValues setting
+func returnAttributes(rv string, old, new memItem, updated map[string]bool) map[string]*dynamodb.AttributeValue {
+	var src memItem
+	switch rv {
+	case dynamodb.ReturnValueAllOld, dynamodb.ReturnValueUpdatedOld:
+		src = old
+	case dynamodb.ReturnValueAllNew, dynamodb.ReturnValueUpdatedNew:
+		src = new
+	default:
+		return nil
+	}
+	if rv == dynamodb.ReturnValueAllOld || rv == dynamodb.ReturnValueAllNew {
+		return copyItem(src)
+	}
+	out := make(map[string]*dynamodb.AttributeValue)
+	for name := range updated {
+		if v, ok := src[name]; ok {
+			out[name] = copyAttr(v)
+		}
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+func conditionFailed() error {
+	return awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed", nil)
+}
+
+// checkCondition evaluates an optional condition expression against the current item
+func checkCondition(item memItem, exp *string, names map[string]*string, values map[string]*dynamodb.AttributeValue) error {
+	p := newExprParser(names, values)
+	var cond exprCondition
+	if exp != nil {
+		var err error
+		if cond, err = p.parseCondition(*exp); err != nil {
+			return err
+		}
+	}
+	if err := p.checkUnused(); err != nil {
+		return err
+	}
+	if cond == nil {
+		return nil
+	}
+	ok, err := cond.eval(item)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return conditionFailed()
+	}
+	return nil
+}
+
+func (m *memoryDB) Query(in *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	if err := in.Validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, err := m.table(in.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	var index *TableSchema
+	if in.IndexName != nil {
+		idx, ok := t.schema.Indexes[*in.IndexName]
+		if !ok {
+			return nil, validationError("The table does not have the specified index: " + *in.IndexName)
+		}
+		index = &idx
+	}
+
+	if in.KeyConditionExpression == nil {
+		return nil, validationError("Either the KeyConditions or KeyConditionExpression parameter must be specified in the request.")
+	}
+
+	p := newExprParser(in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	keyCond, err := p.parseCondition(*in.KeyConditionExpression)
+	if err != nil {
+		return nil, err
+	}
+	schema := t.schema
+	if index != nil {
+		schema = *index
+	}
+	if err := checkKeyCondition(keyCond, schema); err != nil {
+		return nil, err
+	}
+	var filter exprCondition
+	if in.FilterExpression != nil {
+		if filter, err = p.parseCondition(*in.FilterExpression); err != nil {
+			return nil, err
+		}
+	}
+	var proj []docPath
+	if in.ProjectionExpression != nil {
+		if proj, err = p.parseProjection(*in.ProjectionExpression); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	items, lastKey, count, scanned, err := t.read(memoryRead{
+		index:   index,
+		keyCond: keyCond,
+		filter:  filter,
+		proj:    proj,
+		start:   in.ExclusiveStartKey,
+		limit:   in.Limit,
+		reverse: in.ScanIndexForward != nil && !*in.ScanIndexForward})
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.QueryOutput{
+		Items:            items,
+		LastEvaluatedKey: lastKey,
+		Count:            &count,
+		ScannedCount:     &scanned}, nil
+}
+
+// checkKeyCondition rejects the key conditions dynamodb rejects: the hash key must be compared with = and
+// the only other condition allowed is a comparison, BETWEEN or begins_with on the range key, joined by AND
+func checkKeyCondition(cond exprCondition, schema TableSchema) error {
+	conds := []exprCondition{cond}
+	if and, ok := cond.(andCondition); ok {
+		conds = []exprCondition{and.a, and.b}
+	}
+
+	seen := make(map[string]bool)
+	for _, c := range conds {
+		var path exprOperand
+		op := ""
+		switch k := c.(type) {
+		case compareCondition:
+			path, op = k.a, k.op
+			if _, ok := k.b.(valueOperand); !ok {
+				return validationError("Invalid KeyConditionExpression: The key condition must compare a key attribute with a value")
+			}
+		case betweenCondition:
+			path, op = k.a, "BETWEEN"
+			_, low := k.low.(valueOperand)
+			_, high := k.high.(valueOperand)
+			if !low || !high {
+				return validationError("Invalid KeyConditionExpression: The key condition must compare a key attribute with a value")
+			}
+		case functionCondition:
+			if k.fn != "begins_with" {
+				return validationError("Invalid KeyConditionExpression: Invalid function name; function: " + k.fn)
+			}
+			path, op = pathOperand{k.path}, k.fn
+		case andCondition:
+			return validationError("Invalid KeyConditionExpression: KeyConditionExpressions must only contain one condition per key")
+		case orCondition:
+			return validationError("Invalid operator used in KeyConditionExpression: OR")
+		case notCondition:
+			return validationError("Invalid operator used in KeyConditionExpression: NOT")
+		default:
+			return validationError("Invalid KeyConditionExpression: Invalid operator used in KeyConditionExpression")
+		}
+
+		po, ok := path.(pathOperand)
+		if !ok || len(po.path) != 1 || po.path[0].isIndex {
+			return validationError("Invalid KeyConditionExpression: The key condition must compare a key attribute with a value")
+		}
+		name := po.path[0].name
+		switch {
+		case op == "<>":
+			return validationError("Unsupported operator on KeyConditionExpression: operator: <>")
+		case name != schema.HashKey && name != schema.RangeKey:
+			return validationError("Query condition missed key schema element: " + name)
+		case seen[name]:
+			return validationError("KeyConditionExpressions must only contain one condition per key")
+		case name == schema.HashKey && op != "=":
+			return validationError("Query key condition not supported")
+		}
+		seen[name] = true
+	}
+
+	if !seen[schema.HashKey] {
+		return validationError("Query condition missed key schema element: " + schema.HashKey)
+	}
+	return nil
+}
+
+// memoryRead holds the parsed parameters shared by Query and Scan
+type memoryRead struct {
+	index         *TableSchema
+	keyCond       exprCondition // nil for scans
+	filter        exprCondition
+	proj          []docPath
+	start         map[string]*dynamodb.AttributeValue
+	limit         *int64
+	reverse       bool
+	segment       int64
+	totalSegments int64
+}
+
+// inSegment reports if the item belongs to the requested scan segment
+func (t *memoryTable) inSegment(item memItem, r memoryRead) bool {
+	if r.totalSegments <= 0 {
+		return true
+	}
+	k, _ := t.encodeKey(item)
+	h := fnv.New32a()
+	h.Write([]byte(k))
+	return int64(h.Sum32())%r.totalSegments == r.segment
+}
+
+// matches reports if the item is part of the read before any filter is applied
+func (t *memoryTable) matches(item memItem, r memoryRead) (bool, error) {
+	if !t.inSegment(item, r) {
+		return false, nil
+	}
+	if r.keyCond == nil {
+		return true, nil
+	}
+	return r.keyCond.eval(item)
+}
+
+// read walks the table (or index) in key order, evaluating up to limit items after the start key
+func (t *memoryTable) read(r memoryRead) ([]map[string]*dynamodb.AttributeValue, map[string]*dynamodb.AttributeValue, int64, int64, error) {
+	items := t.sorted(r.index)
+	direction := 1
+	if r.reverse {
+		direction = -1
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+
+	out := []map[string]*dynamodb.AttributeValue{}
+	var lastKey map[string]*dynamodb.AttributeValue
+	var count, scanned int64
+	for i, item := range items {
+		if len(r.start) != 0 && compareKeys(item, r.start, t.keyNamesFor(r.index))*direction <= 0 {
+			continue
+		}
+
+		ok, err := t.matches(item, r)
+		if err != nil {
+			return nil, nil, 0, 0, err
+		}
+		if !ok {
+			continue
+		}
+		scanned++
+
+		if r.filter != nil {
+			if ok, err = r.filter.eval(item); err != nil {
+				return nil, nil, 0, 0, err
+			}
+		}
+		if ok {
+			if r.proj != nil {
+				item = project(item, r.proj)
+			}
+			out = append(out, copyItem(item))
+			count++
+		}
+
+		if r.limit != nil && scanned >= *r.limit {
+			for _, rest := range items[i+1:] {
+				if ok, _ := t.matches(rest, r); ok {
+					lastKey = t.keyAttributes(items[i], r.index)
+					break
+				}
+			}
+			break
+		}
+	}
+
+	return out, lastKey, count, scanned, nil
+}
+
+// keyNamesFor returns every key attribute name for the table and optional index
+func (t *memoryTable) keyNamesFor(index *TableSchema) []string {
+	names := t.schema.keyNames()
+	if index != nil {
+		names = append(index.keyNames(), names...)
+	}
+	return names
+}
+
+func (m *memoryDB) QueryPages(in *dynamodb.QueryInput, fn func(p *dynamodb.QueryOutput, lastPage bool) bool) error {
+	return m.QueryPagesWithContext(aws.BackgroundContext(), in, fn)
+}
+
+func (m *memoryDB) Scan(in *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	if err := in.Validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, err := m.table(in.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	r := memoryRead{start: in.ExclusiveStartKey, limit: in.Limit}
+	if in.IndexName != nil {
+		idx, ok := t.schema.Indexes[*in.IndexName]
+		if !ok {
+			return nil, validationError("The table does not have the specified index: " + *in.IndexName)
+		}
+		r.index = &idx
+	}
+	if in.TotalSegments != nil {
+		if in.Segment == nil || *in.Segment >= *in.TotalSegments {
+			return nil, validationError("The Segment parameter must be less than the TotalSegments parameter")
+		}
+		r.segment = *in.Segment
+		r.totalSegments = *in.TotalSegments
+	}
+
+	p := newExprParser(in.ExpressionAttributeNames, in.ExpressionAttributeValues)
+	if in.FilterExpression != nil {
+		if r.filter, err = p.parseCondition(*in.FilterExpression); err != nil {
+			return nil, err
+		}
+	}
+	if in.ProjectionExpression != nil {
+		if r.proj, err = p.parseProjection(*in.ProjectionExpression); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.checkUnused(); err != nil {
+		return nil, err
+	}
+
+	items, lastKey, count, scanned, err := t.read(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.ScanOutput{
+		Items:            items,
+		LastEvaluatedKey: lastKey,
+		Count:            &count,
+		ScannedCount:     &scanned}, nil
+}
+
+func (m *memoryDB) ScanPages(in *dynamodb.ScanInput, fn func(p *dynamodb.ScanOutput, lastPage bool) bool) error {
+	return m.ScanPagesWithContext(aws.BackgroundContext(), in, fn)
+}
+
+func (m *memoryDB) BatchGetItem(in *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	if err := in.Validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	total := 0
+	for _, ka := range in.RequestItems {
+		total += len(ka.Keys)
+	}
+	if total > 100 {
+		return nil, validationError("Too many items requested for the BatchGetItem call")
+	}
+
+	out := &dynamodb.BatchGetItemOutput{
+		Responses:       make(map[string][]map[string]*dynamodb.AttributeValue),
+		UnprocessedKeys: make(map[string]*dynamodb.KeysAndAttributes)}
+
+	for name, ka := range in.RequestItems {
+		t, err := m.table(&name)
+		if err != nil {
+			return nil, err
+		}
+
+		p := newExprParser(ka.ExpressionAttributeNames, nil)
+		var proj []docPath
+		if ka.ProjectionExpression != nil {
+			if proj, err = p.parseProjection(*ka.ProjectionExpression); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.checkUnused(); err != nil {
+			return nil, err
+		}
+
+		seen := make(map[string]bool)
+		items := []map[string]*dynamodb.AttributeValue{}
+		for _, key := range ka.Keys {
+			k, err := t.keyOf(key)
+			if err != nil {
+				return nil, err
+			}
+			if seen[k] {
+				return nil, validationError("Provided list of item keys contains duplicates")
+			}
+			seen[k] = true
+
+			if item, ok := t.items[k]; ok {
+				if proj != nil {
+					item = project(item, proj)
+				}
+				items = append(items, copyItem(item))
+			}
+		}
+		out.Responses[name] = items
+	}
+
+	return out, nil
+}
+
+func (m *memoryDB) BatchWriteItem(in *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	if err := in.Validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	total := 0
+	for _, writes := range in.RequestItems {
+		total += len(writes)
+	}
+	if total > 25 {
+		return nil, validationError("Too many items requested for the BatchWriteItem call")
+	}
+
+	// validate everything first, a batch write either runs completely or not at all
+	type write struct {
+		t    *memoryTable
+		key  string
+		item memItem
+	}
+	var pending []write
+	seen := make(map[*memoryTable]map[string]bool)
+	for name, writes := range in.RequestItems {
+		t, err := m.table(&name)
+		if err != nil {
+			return nil, err
+		}
+		seen[t] = make(map[string]bool)
+		for _, w := range writes {
+			var k string
+			var item memItem
+			switch {
+			case w.PutRequest != nil:
+				k, err = t.encodeKey(w.PutRequest.Item)
+				item = copyItem(w.PutRequest.Item)
+			case w.DeleteRequest != nil:
+				k, err = t.keyOf(w.DeleteRequest.Key)
+			default:
+				err = validationError("Supplied AttributeValue has more than one datatypes set, must contain exactly one of the supported datatypes")
+			}
+			if err != nil {
+				return nil, err
+			}
+			if seen[t][k] {
+				return nil, validationError("Provided list of item keys contains duplicates")
+			}
+			seen[t][k] = true
+			pending = append(pending, write{t, k, item})
+		}
+	}
+
+	for _, w := range pending {
+		if w.item != nil {
+			w.t.items[w.key] = w.item
+		} else {
+			delete(w.t.items, w.key)
+		}
+	}
+
+	return &dynamodb.BatchWriteItemOutput{UnprocessedItems: map[string][]*dynamodb.WriteRequest{}}, nil
+}
+
+// TransactWriteItems validates every action before applying any of them. If a condition fails the whole
+// transaction is cancelled and a reason is reported for each action, in order
+func (m *memoryDB) TransactWriteItems(in *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	if err := in.Validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(in.TransactItems) > 100 {
+		return nil, validationError("Member must have length less than or equal to 100")
+	}
+
+	writes := make([]memoryWrite, len(in.TransactItems))
+	reasons := make([]*dynamodb.CancellationReason, len(in.TransactItems))
+	seen := make(map[*memoryTable]map[string]bool)
+	cancelled := false
+
+	for i, ti := range in.TransactItems {
+		var w memoryWrite
+		var err error
+		switch {
+		case ti.Put != nil:
+			w, err = m.preparePut(ti.Put.TableName, ti.Put.Item, ti.Put.ConditionExpression, ti.Put.ExpressionAttributeNames, ti.Put.ExpressionAttributeValues)
+		case ti.Update != nil:
+			w, err = m.prepareUpdate(ti.Update.TableName, ti.Update.Key, ti.Update.UpdateExpression, ti.Update.ConditionExpression, ti.Update.ExpressionAttributeNames, ti.Update.ExpressionAttributeValues)
+		case ti.Delete != nil:
+			w, err = m.prepareDelete(ti.Delete.TableName, ti.Delete.Key, ti.Delete.ConditionExpression, ti.Delete.ExpressionAttributeNames, ti.Delete.ExpressionAttributeValues)
+		case ti.ConditionCheck != nil:
+			w, err = m.prepareCheck(ti.ConditionCheck.TableName, ti.ConditionCheck.Key, ti.ConditionCheck.ConditionExpression, ti.ConditionCheck.ExpressionAttributeNames, ti.ConditionCheck.ExpressionAttributeValues)
+		default:
+			return nil, validationError("TransactItems can only contain one of Check, Put, Update or Delete")
+		}
+
+		reasons[i] = &dynamodb.CancellationReason{Code: strPtr("None")}
+		if err != nil {
+			if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+				reasons[i] = &dynamodb.CancellationReason{Code: strPtr("ConditionalCheckFailed"), Message: strPtr(aerr.Message())}
+				cancelled = true
+				continue
+			}
+			return nil, err
+		}
+
+		if seen[w.t] == nil {
+			seen[w.t] = make(map[string]bool)
+		}
+		if seen[w.t][w.key] {
+			return nil, validationError("Transaction request cannot include multiple operations on one item")
+		}
+		seen[w.t][w.key] = true
+		writes[i] = w
+	}
+
+	if cancelled {
+		return nil, &dynamodb.TransactionCanceledException{
+			Message_:            strPtr("Transaction cancelled, please refer cancellation reasons for specific reasons"),
+			CancellationReasons: reasons}
+	}
+
+	for _, w := range writes {
+		w.apply()
+	}
+
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+// TransactGetItems reads every item under the lock, so the responses are a consistent snapshot
+func (m *memoryDB) TransactGetItems(in *dynamodb.TransactGetItemsInput) (*dynamodb.TransactGetItemsOutput, error) {
+	if err := in.Validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(in.TransactItems) > 100 {
+		return nil, validationError("Member must have length less than or equal to 100")
+	}
+
+	out := &dynamodb.TransactGetItemsOutput{}
+	for _, ti := range in.TransactItems {
+		t, err := m.table(ti.Get.TableName)
+		if err != nil {
+			return nil, err
+		}
+		k, err := t.keyOf(ti.Get.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		p := newExprParser(ti.Get.ExpressionAttributeNames, nil)
+		var proj []docPath
+		if ti.Get.ProjectionExpression != nil {
+			if proj, err = p.parseProjection(*ti.Get.ProjectionExpression); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.checkUnused(); err != nil {
+			return nil, err
+		}
+
+		resp := &dynamodb.ItemResponse{}
+		if item, ok := t.items[k]; ok {
+			if proj != nil {
+				item = project(item, proj)
+			}
+			resp.Item = copyItem(item)
+		}
+		out.Responses = append(out.Responses, resp)
+	}
+
+	return out, nil
+}
+
+// ctxErr mirrors the error the SDK returns for a request whose context is done
+func ctxErr(ctx aws.Context) error {
+	if err := ctx.Err(); err != nil {
+		return awserr.New(request.CanceledErrorCode, "request context canceled", err)
+	}
+	return nil
+}
+
+// The context aware versions check the context before touching any data, and paging stops
+// between pages once the context is done
+
+func (m *memoryDB) GetItemWithContext(ctx aws.Context, in *dynamodb.GetItemInput, _ ...request.Option) (*dynamodb.GetItemOutput, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	return m.GetItem(in)
+}
+
+func (m *memoryDB) PutItemWithContext(ctx aws.Context, in *dynamodb.PutItemInput, _ ...request.Option) (*dynamodb.PutItemOutput, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	return m.PutItem(in)
+}
+
+func (m *memoryDB) DeleteItemWithContext(ctx aws.Context, in *dynamodb.DeleteItemInput, _ ...request.Option) (*dynamodb.DeleteItemOutput, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	return m.DeleteItem(in)
+}
+
+func (m *memoryDB) UpdateItemWithContext(ctx aws.Context, in *dynamodb.UpdateItemInput, _ ...request.Option) (*dynamodb.UpdateItemOutput, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	return m.UpdateItem(in)
+}
+
+func (m *memoryDB) QueryWithContext(ctx aws.Context, in *dynamodb.QueryInput, _ ...request.Option) (*dynamodb.QueryOutput, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	return m.Query(in)
+}
+
+func (m *memoryDB) QueryPagesWithContext(ctx aws.Context, in *dynamodb.QueryInput, fn func(p *dynamodb.QueryOutput, lastPage bool) bool, _ ...request.Option) error {
+	input := *in
+	for {
+		out, err := m.QueryWithContext(ctx, &input)
+		if err != nil {
+			return err
+		}
+		last := len(out.LastEvaluatedKey) == 0
+		if !fn(out, last) || last {
+			return nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+func (m *memoryDB) ScanWithContext(ctx aws.Context, in *dynamodb.ScanInput, _ ...request.Option) (*dynamodb.ScanOutput, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	return m.Scan(in)
+}
+
+func (m *memoryDB) ScanPagesWithContext(ctx aws.Context, in *dynamodb.ScanInput, fn func(p *dynamodb.ScanOutput, lastPage bool) bool, _ ...request.Option) error {
+	input := *in
+	for {
+		out, err := m.ScanWithContext(ctx, &input)
+		if err != nil {
+			return err
+		}
+		last := len(out.LastEvaluatedKey) == 0
+		if !fn(out, last) || last {
+			return nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+func (m *memoryDB) BatchGetItemWithContext(ctx aws.Context, in *dynamodb.BatchGetItemInput, _ ...request.Option) (*dynamodb.BatchGetItemOutput, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	return m.BatchGetItem(in)
+}
+
+func (m *memoryDB) BatchWriteItemWithContext(ctx aws.Context, in *dynamodb.BatchWriteItemInput, _ ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	return m.BatchWriteItem(in)
+}
+
+func (m *memoryDB) TransactWriteItemsWithContext(ctx aws.Context, in *dynamodb.TransactWriteItemsInput, _ ...request.Option) (*dynamodb.TransactWriteItemsOutput, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	return m.TransactWriteItems(in)
+}
+
+func (m *memoryDB) TransactGetItemsWithContext(ctx aws.Context, in *dynamodb.TransactGetItemsInput, _ ...request.Option) (*dynamodb.TransactGetItemsOutput, error) {
+	if err := ctxErr(ctx); err != nil {
+		return nil, err
+	}
+	return m.TransactGetItems(in)
+}
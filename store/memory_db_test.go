@@ -0,0 +1,1314 @@
+package store
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/sethjback/godba/config"
+	godba "github.com/sethjback/godba/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func getMemoryStore() *DynamoDBDatastore {
+	return NewMemory(config.Store{
+		Tables: map[string]TableSchema{
+			"users":  TableSchema{HashKey: "id"},
+			"events": TableSchema{HashKey: "user", RangeKey: "ts", Indexes: map[string]TableSchema{"kind": TableSchema{HashKey: "kind", RangeKey: "ts"}}},
+		}})
+}
+
+func TestMemoryPutGet(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+
+	_, e := c.Run(Request{
+		Table:  "users",
+		Action: Put,
+		Key:    map[string]interface{}{"id": "1"},
+		Item:   map[string]interface{}{"name": "bob", "age": 42, "tags": []string{"a", "b"}}})
+	assert.Nil(e)
+
+	r, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	if assert.Equal(1, r.GetItemCount()) {
+		s, _ := r.GetStringItem(0, "name")
+		assert.Equal("bob", s)
+		n, _ := r.GetNumberItem(0, "age")
+		assert.Equal(42, n)
+		l, _ := r.GetStringListItem(0, "tags")
+		assert.Equal([]string{"a", "b"}, l)
+	}
+
+	r, e = c.Run(Request{Table: "users", Action: Get, LiveData: true, Key: map[string]interface{}{"id": "2"}})
+	assert.Nil(e)
+	assert.Equal(0, r.GetItemCount())
+
+	_, e = c.Run(Request{Table: "missing", Action: Get, LiveData: true, Key: map[string]interface{}{"id": "2"}})
+	assert.NotNil(e)
+}
+
+func TestMemoryPutCondition(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+
+	r := Request{
+		Table:  "users",
+		Action: Put,
+		Key:    map[string]interface{}{"id": "1"},
+		Item:   map[string]interface{}{"name": "bob"}}
+	r.And("id", NotExist, nil)
+
+	_, e := c.Run(r)
+	assert.Nil(e)
+
+	_, e = c.Run(r)
+	assert.NotNil(e)
+
+	r.RequestConditions = nil
+	r.And("name", Equal, "bob")
+	_, e = c.Run(r)
+	assert.Nil(e)
+}
+
+func TestMemoryUpdate(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+	c.CacheOff()
+
+	_, e := c.Run(Request{
+		Table:  "users",
+		Action: Put,
+		Key:    map[string]interface{}{"id": "1"},
+		Item: map[string]interface{}{
+			"profile": map[string]interface{}{"address": map[string]interface{}{"zip": "12345"}},
+			"list":    []string{"a", "b", "c"},
+			"old":     "remove me"}})
+	assert.Nil(e)
+
+	r := Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	r.AddUpdateValue("/profile/address/zip", Update, "54321").
+		AddUpdateValue("/list/1", Update, "B").
+		AddUpdateValue("/old", Delete, nil).
+		AddUpdateValue("name", Put, "bob")
+	_, e = c.Run(r)
+	assert.Nil(e)
+
+	// appending replaces the whole list, so it can not be combined with other changes to the list
+	r = Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	r.AddUpdateValue("/list/-", Put, "d")
+	_, e = c.Run(r)
+	assert.Nil(e)
+
+	res, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	var profile map[string]map[string]string
+	err, ok := res.UnmarshalItem(0, "profile", &profile)
+	assert.Nil(err)
+	assert.True(ok)
+	assert.Equal("54321", profile["address"]["zip"])
+	l, _ := res.GetStringListItem(0, "list")
+	assert.Equal([]string{"a", "B", "c", "d"}, l)
+	_, ok = res.GetItem(0, "old")
+	assert.False(ok)
+	s, _ := res.GetStringItem(0, "name")
+	assert.Equal("bob", s)
+
+	// the parent of a nested path has to exist
+	r = Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	r.AddUpdateValue("/missing/child", Put, "x")
+	_, e = c.Run(r)
+	assert.NotNil(e)
+}
+
+func TestMemoryDelete(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+
+	_, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "bob"}})
+	assert.Nil(e)
+	_, e = c.Run(Request{Table: "users", Action: Delete, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+
+	r, e := c.Run(Request{Table: "users", Action: Get, LiveData: true, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	assert.Equal(0, r.GetItemCount())
+}
+
+func putEvents(assert *assert.Assertions, c *DynamoDBDatastore) {
+	for i := 1; i <= 9; i++ {
+		kind := "click"
+		if i%3 == 0 {
+			kind = "view"
+		}
+		_, e := c.Run(Request{
+			Table:  "events",
+			Action: Put,
+			Key:    map[string]interface{}{"user": "u1", "ts": i},
+			Item:   map[string]interface{}{"kind": kind}})
+		assert.Nil(e)
+	}
+	_, e := c.Run(Request{Table: "events", Action: Put, Key: map[string]interface{}{"user": "u2", "ts": 1}, Item: map[string]interface{}{"kind": "view"}})
+	assert.Nil(e)
+}
+
+func TestMemoryQuery(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+	putEvents(assert, c)
+
+	r := Request{Table: "events", Action: Query}
+	r.And("user", Equal, "u1").And("ts", GreaterThan, 3)
+
+	res, e := c.Run(r)
+	assert.Nil(e)
+	if assert.Equal(6, res.GetItemCount()) {
+		for i := 0; i < 6; i++ {
+			n, _ := res.GetNumberItem(i, "ts")
+			assert.Equal(i+4, n)
+		}
+	}
+
+	r = Request{Table: "events", Action: QueryPager, Page: 1, PageSize: 10}
+	r.And("user", Equal, "u1").And("ts", GreaterThan, 3)
+	r.ResultFitler = []RequestCondition{RequestCondition{Field: "kind", Type: Equal, Value: "click"}}
+
+	res, e = c.Run(r)
+	assert.Nil(e)
+	if assert.Equal(4, res.GetItemCount()) {
+		for i, ts := range []int{4, 5, 7, 8} {
+			n, _ := res.GetNumberItem(i, "ts")
+			assert.Equal(ts, n)
+		}
+	}
+
+	r = Request{Table: "events", Action: Query, Index: "kind"}
+	r.And("kind", Equal, "view")
+	res, e = c.Run(r)
+	assert.Nil(e)
+	assert.Equal(4, res.GetItemCount())
+
+	r = Request{Table: "events", Action: QueryPager, Page: 2, PageSize: 4}
+	r.And("user", Equal, "u1")
+	res, e = c.Run(r)
+	assert.Nil(e)
+	if assert.Equal(4, res.GetItemCount()) {
+		n, _ := res.GetNumberItem(0, "ts")
+		assert.Equal(5, n)
+	}
+	assert.Equal(3, res.PageCount())
+}
+
+func TestMemoryKeyConditions(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+	putEvents(assert, c)
+
+	valid := [][]RequestCondition{
+		{Where("user", Equal, "u1")},
+		{Where("user", Equal, "u1"), Where("ts", LessOrEqual, 3)},
+		{Where("ts", Between, []int{2, 4}), Where("user", Equal, "u1")},
+	}
+	for _, conds := range valid {
+		res, e := c.Run(Request{Table: "events", Action: Query, RequestConditions: conds})
+		if assert.Nil(e, "%v", conds) {
+			assert.NotEqual(0, res.GetItemCount())
+		}
+	}
+
+	// the keys of an index replace the table's
+	r := Request{Table: "events", Action: Query, Index: "kind"}
+	r.And("kind", Equal, "view").And("ts", GreaterThan, 1)
+	res, e := c.Run(r)
+	if assert.Nil(e) {
+		assert.NotEqual(0, res.GetItemCount())
+	}
+	r = Request{Table: "events", Action: Query, Index: "kind"}
+	r.And("user", Equal, "u1")
+	_, e = c.Run(r)
+	assert.NotNil(e)
+
+	invalid := [][]RequestCondition{
+		{Where("name", Equal, "bob")},
+		{Where("ts", Equal, 1)},
+		{Where("user", GreaterThan, "u0")},
+		{Where("user", NotEqual, "u2")},
+		{Where("user", Equal, "u1"), Where("kind", Equal, "click")},
+		{Where("user", Equal, "u1"), Where("ts", GreaterThan, 1), Where("ts", LessThan, 5)},
+		{Where("user", Equal, "u1"), RequestCondition{Field: "user", Type: Equal, Relationship: Or, Value: "u2"}},
+		{Not(Where("user", Equal, "u1"))},
+		{Where("user", Equal, "u1"), Where("ts", Exist, nil)},
+		{Where("user", In, []string{"u1", "u2"})},
+	}
+	for _, conds := range invalid {
+		_, e = c.Run(Request{Table: "events", Action: Query, RequestConditions: conds})
+		if assert.NotNil(e, "%v", conds) {
+			assert.Equal(godba.ErrorQueryItem, godba.Code(e))
+		}
+	}
+}
+
+func TestMemoryQueryLastKey(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+	putEvents(assert, c)
+
+	r := Request{Table: "events", Action: Query, Limit: 4}
+	r.And("user", Equal, "u1")
+
+	var seen []int
+	for pages := 1; ; pages++ {
+		res, e := c.Run(r)
+		if !assert.Nil(e) {
+			return
+		}
+		for i := 0; i < res.GetItemCount(); i++ {
+			n, _ := res.GetNumberItem(i, "ts")
+			seen = append(seen, n)
+		}
+		r.LastKey = res.GetLastEvaluatedKey()
+		if r.LastKey == nil {
+			assert.Equal(3, pages)
+			break
+		}
+		assert.Equal(map[string]interface{}{"user": "u1", "ts": pages * 4}, r.LastKey)
+	}
+	assert.Equal([]int{1, 2, 3, 4, 5, 6, 7, 8, 9}, seen)
+}
+
+func TestMemoryScan(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+	putEvents(assert, c)
+
+	r := Request{Table: "events", Action: Scan}
+	r.ResultFitler = []RequestCondition{RequestCondition{Field: "kind", Type: Equal, Value: "view"}}
+	res, e := c.Run(r)
+	assert.Nil(e)
+	assert.Equal(4, res.GetItemCount())
+
+	r = Request{Table: "events", Action: Scan, Limit: 6}
+	res, e = c.Run(r)
+	assert.Nil(e)
+	assert.Equal(6, res.GetItemCount())
+	r.LastKey = res.GetLastEvaluatedKey()
+	if assert.NotNil(r.LastKey) {
+		res, e = c.Run(r)
+		assert.Nil(e)
+		assert.Equal(4, res.GetItemCount())
+		assert.Nil(res.GetLastEvaluatedKey())
+	}
+
+	r = Request{Table: "events", Action: ParallelScan, TotalSegments: 3, Workers: 2}
+	res, e = c.Run(r)
+	assert.Nil(e)
+	assert.Equal(10, res.GetItemCount())
+
+	seen := 0
+	for s := 0; s < 3; s++ {
+		res, e = c.Run(Request{Table: "events", Action: Scan, Segment: s, TotalSegments: 3})
+		assert.Nil(e)
+		seen += res.GetItemCount()
+	}
+	assert.Equal(10, seen, "segments should partition the table")
+}
+
+func TestMemoryBatch(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+
+	w := Request{Action: BatchWrite}
+	for i := 0; i < 40; i++ {
+		w.AddBatch(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": strconv.Itoa(i)}, Item: map[string]interface{}{"n": i}})
+	}
+	w.AddBatch(Request{Table: "events", Action: Put, Key: map[string]interface{}{"user": "u1", "ts": 1}})
+	_, e := c.Run(w)
+	assert.Nil(e)
+
+	g := Request{Action: BatchGet}
+	g.AddBatch(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "39"}}).
+		AddBatch(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "missing"}}).
+		AddBatch(Request{Table: "events", Action: Get, Key: map[string]interface{}{"user": "u1", "ts": 1}}).
+		AddBatch(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "39"}})
+	res, e := c.Run(g)
+	assert.Nil(e)
+	if assert.Equal(4, res.GetItemCount()) {
+		n, _ := res.GetNumberItem(0, "n")
+		assert.Equal(39, n)
+		_, ok := res.GetItem(1, "id")
+		assert.False(ok)
+		s, _ := res.GetStringItem(2, "user")
+		assert.Equal("u1", s)
+		n, _ = res.GetNumberItem(3, "n")
+		assert.Equal(39, n)
+	}
+
+	tx := c.StartTransaction()
+	_, e = tx.Run(Request{Action: BatchWrite, Batch: []Request{Request{Table: "users", Action: Delete, Key: map[string]interface{}{"id": "1"}}}})
+	assert.NotNil(e, "batch deletes can not be rolled back")
+	_, e = tx.Run(Request{Action: BatchWrite, Batch: []Request{Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "new"}}}})
+	assert.Nil(e)
+	assert.Nil(tx.Rollback())
+	res, e = c.Run(Request{Table: "users", Action: Get, LiveData: true, Key: map[string]interface{}{"id": "new"}})
+	assert.Nil(e)
+	assert.Equal(0, res.GetItemCount())
+
+	// rolling back a batch put that replaced an item puts the old item back
+	_, e = c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "old"}, Item: map[string]interface{}{"name": "bob", "tags": []string{"a"}}})
+	assert.Nil(e)
+	tx = c.StartTransaction()
+	_, e = tx.Run(Request{Action: BatchWrite, Batch: []Request{
+		Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "old"}, Item: map[string]interface{}{"name": "alice"}},
+		Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "new"}, Item: map[string]interface{}{"name": "carol"}}}})
+	assert.Nil(e)
+	res, e = c.Run(Request{Table: "users", Action: Get, LiveData: true, Key: map[string]interface{}{"id": "old"}})
+	assert.Nil(e)
+	s, _ := res.GetStringItem(0, "name")
+	assert.Equal("alice", s)
+	assert.Empty(tx.Rollback())
+
+	res, e = c.Run(Request{Table: "users", Action: Get, LiveData: true, Key: map[string]interface{}{"id": "old"}})
+	assert.Nil(e)
+	if assert.Equal(1, res.GetItemCount()) {
+		s, _ = res.GetStringItem(0, "name")
+		assert.Equal("bob", s)
+		assert.NotNil(res.(*dynamodbResult).items[0]["tags"])
+	}
+	res, e = c.Run(Request{Table: "users", Action: Get, LiveData: true, Key: map[string]interface{}{"id": "new"}})
+	assert.Nil(e)
+	assert.Equal(0, res.GetItemCount())
+
+	// the chunks written before one fails are rolled back
+	res, e = c.Run(Request{Table: "users", Action: Scan})
+	assert.Nil(e)
+	count := res.GetItemCount()
+	failing := &failingBatchDB{memoryDB: c.db.(*memoryDB), fail: 2}
+	c.db = failing
+	tx = c.StartTransaction()
+	b := Request{Action: BatchWrite}
+	for i := 0; i < 30; i++ {
+		b.AddBatch(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "batch" + strconv.Itoa(i)}})
+	}
+	_, e = tx.Run(b)
+	assert.Equal(godba.ErrorBatchWrite, godba.Code(e))
+	res, e = c.Run(Request{Table: "users", Action: Scan})
+	assert.Nil(e)
+	assert.Equal(count+25, res.GetItemCount())
+	assert.Empty(tx.Rollback())
+	res, e = c.Run(Request{Table: "users", Action: Scan})
+	assert.Nil(e)
+	assert.Equal(count, res.GetItemCount())
+}
+
+// failingBatchDB fails the fail-th BatchWriteItem call
+type failingBatchDB struct {
+	*memoryDB
+	fail  int
+	calls int
+}
+
+func (d *failingBatchDB) BatchWriteItemWithContext(ctx aws.Context, in *dynamodb.BatchWriteItemInput, opts ...request.Option) (*dynamodb.BatchWriteItemOutput, error) {
+	d.calls++
+	if d.calls == d.fail {
+		return nil, awserr.New("ValidationException", "testing", nil)
+	}
+	return d.memoryDB.BatchWriteItemWithContext(ctx, in, opts...)
+}
+
+func TestMemoryTransaction(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+
+	_, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "bob"}})
+	assert.Nil(e)
+
+	tx := c.StartTransaction()
+	_, e = tx.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "2"}, Item: map[string]interface{}{"name": "alice"}})
+	assert.Nil(e)
+	_, e = tx.Run(Request{Table: "users", Action: Delete, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	assert.Nil(tx.Rollback())
+
+	r, e := c.Run(Request{Table: "users", Action: Get, LiveData: true, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	s, _ := r.GetStringItem(0, "name")
+	assert.Equal("bob", s)
+
+	r, e = c.Run(Request{Table: "users", Action: Get, LiveData: true, Key: map[string]interface{}{"id": "2"}})
+	assert.Nil(e)
+	assert.Equal(0, r.GetItemCount())
+}
+
+func TestMemoryCache(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+
+	_, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "bob"}})
+	assert.Nil(e)
+	r1, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	r2, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	assert.True(r1 == r2, "second get should come from the cache")
+
+	c.ClearCache()
+	r3, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	assert.False(r1 == r3)
+}
+
+func TestMemoryExpressions(t *testing.T) {
+	assert := assert.New(t)
+
+	item := memItem{
+		"n":    &dynamodb.AttributeValue{N: aws.String("10")},
+		"s":    &dynamodb.AttributeValue{S: aws.String("hello")},
+		"ss":   &dynamodb.AttributeValue{SS: []*string{aws.String("a"), aws.String("b")}},
+		"list": &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{&dynamodb.AttributeValue{N: aws.String("1")}}},
+		"m":    &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{"x.y": &dynamodb.AttributeValue{S: aws.String("z")}}}}
+	names := map[string]*string{"#xy": aws.String("x.y")}
+	values := map[string]*dynamodb.AttributeValue{
+		":five": &dynamodb.AttributeValue{N: aws.String("5.0")},
+		":ten":  &dynamodb.AttributeValue{N: aws.String("10")},
+		":a":    &dynamodb.AttributeValue{S: aws.String("a")},
+		":he":   &dynamodb.AttributeValue{S: aws.String("he")},
+		":z":    &dynamodb.AttributeValue{S: aws.String("z")}}
+
+	tests := map[string]bool{
+		"n > :five":                            true,
+		"n = :ten AND s = :he":                 false,
+		"n = :ten AND (s = :he OR m.#xy = :z)": true,
+		"NOT n <> :ten":                        true,
+		"n BETWEEN :five AND :ten":             true,
+		"n IN (:five, :ten)":                   true,
+		"begins_with(s, :he)":                  true,
+		"contains(ss, :a)":                     true,
+		"size(list) < :five":                   true,
+		"attribute_exists(list[0])":            true,
+		"attribute_not_exists(list[1])":        true,
+		"n = :five OR s = :he AND n = :ten":    false,
+	}
+	for exp, expected := range tests {
+		p := newExprParser(names, values)
+		c, err := p.parseCondition(exp)
+		if assert.Nil(err, exp) {
+			ok, err := c.eval(item)
+			assert.Nil(err, exp)
+			assert.Equal(expected, ok, exp)
+		}
+	}
+
+	p := newExprParser(names, values)
+	_, err := p.parseCondition("n > :five")
+	assert.Nil(err)
+	err = p.checkUnused()
+	if assert.NotNil(err) {
+		assert.Equal(errCodeValidation, err.(awserr.Error).Code())
+	}
+
+	p = newExprParser(nil, values)
+	_, err = p.parseCondition("#undefined = :five")
+	assert.NotNil(err)
+
+	p = newExprParser(nil, values)
+	actions, err := p.parseUpdate("SET n = n + :five, list = list_append(list, list) REMOVE ss ADD s :a")
+	if assert.Nil(err) {
+		err = applyUpdate(memItem(copyItem(item)), actions)
+		if assert.NotNil(err, "ADD to a string must fail") {
+			assert.Equal(errCodeValidation, err.(awserr.Error).Code())
+		}
+	}
+
+	p = newExprParser(nil, values)
+	actions, err = p.parseUpdate("SET n = n + :five, list = list_append(list, list) REMOVE ss")
+	if assert.Nil(err) && assert.Nil(applyUpdate(item, actions)) {
+		assert.Equal("15", *item["n"].N)
+		assert.Len(item["list"].L, 2)
+		assert.Nil(item["ss"])
+	}
+}
+
+func TestMemoryContext(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+	putEvents(assert, c)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	pages := 0
+	err := c.db.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String("events"),
+		KeyConditionExpression:    aws.String("#u = :u"),
+		ExpressionAttributeNames:  map[string]*string{"#u": aws.String("user")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":u": &dynamodb.AttributeValue{S: aws.String("u1")}},
+		Limit:                     aws.Int64(2)},
+		func(p *dynamodb.QueryOutput, lastPage bool) bool {
+			pages++
+			cancel()
+			return true
+		})
+	if assert.NotNil(err) {
+		assert.Equal("RequestCanceled", err.(awserr.Error).Code())
+	}
+	assert.Equal(1, pages)
+
+	tx := c.StartTransaction()
+	_, e := tx.RunContext(context.Background(), Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{}})
+	assert.Nil(e)
+	_, e = tx.RunContext(ctx, Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "2"}, Item: map[string]interface{}{}})
+	assert.Equal(context.Canceled, e)
+	assert.Len(tx.RollbackContext(ctx), 1, "a cancelled context stops the rollback")
+	assert.Empty(tx.RollbackContext(context.Background()))
+}
+
+func TestMemoryErrors(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+
+	r := Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{}}
+	_, e := c.Run(r)
+	assert.Nil(e)
+
+	r.And("id", NotExist, nil)
+	_, e = c.Run(r)
+	assert.True(godba.IsConditionFailed(e))
+	assert.Equal(godba.ErrorConditionFailed, godba.Code(e))
+
+	_, e = c.Run(Request{Table: "missing", Action: Get, LiveData: true, Key: map[string]interface{}{"id": "1"}})
+	assert.True(godba.IsNotFound(e))
+	assert.False(godba.IsConditionFailed(e))
+
+	a := getAtomicStore()
+	_, e = a.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{}})
+	assert.Nil(e)
+	tx := a.StartTransaction()
+	_, e = tx.Run(r)
+	assert.Nil(e)
+	e = tx.Finish()
+	assert.True(godba.IsConditionFailed(e), "a cancelled transaction should report the failed condition")
+}
+
+func TestMemoryStructs(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+
+	for _, a := range []testAccount{
+		testAccount{ID: "1", Name: "bob", Balance: 10, Tags: []string{"a", "b"}},
+		testAccount{ID: "2", Name: "alice"}} {
+		r := Request{Table: "users", Action: Put}
+		assert.Nil(r.SetItemFrom(&a))
+		_, e := c.Run(r)
+		assert.Nil(e)
+	}
+
+	res, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	var a testAccount
+	if assert.Nil(res.UnmarshalRow(0, &a)) {
+		assert.Equal(testAccount{ID: "1", Name: "bob", Balance: 10, Tags: []string{"a", "b"}}, a)
+	}
+	assert.NotNil(res.UnmarshalRow(1, &a))
+
+	r := Request{Action: BatchGet}
+	r.AddBatch(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "2"}}).
+		AddBatch(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "3"}}).
+		AddBatch(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	res, e = c.Run(r)
+	assert.Nil(e)
+	var all []*testAccount
+	if assert.Nil(res.UnmarshalAll(&all)) && assert.Len(all, 3) {
+		assert.Equal("alice", all[0].Name)
+		assert.Nil(all[1])
+		assert.Equal(10, all[2].Balance)
+	}
+}
+
+func TestMemoryConditionOperators(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+	c.CacheOff()
+	putEvents(assert, c)
+
+	count := func(conditions ...RequestCondition) int {
+		r, e := c.Run(Request{Table: "events", Action: Scan, ResultFitler: conditions})
+		if !assert.Nil(e) {
+			return -1
+		}
+		return r.GetItemCount()
+	}
+
+	assert.Equal(3, count(RequestCondition{Field: "ts", Type: Between, Value: []int{2, 4}}))
+	assert.Equal(8, count(RequestCondition{Field: "ts", Type: GreaterOrEqual, Value: 2}))
+	assert.Equal(2, count(RequestCondition{Field: "ts", Type: LessOrEqual, Value: 1}))
+	assert.Equal(6, count(RequestCondition{Field: "kind", Type: NotEqual, Value: "view"}))
+	assert.Equal(2, count(RequestCondition{Field: "ts", Type: In, Value: []int{3, 9}}, RequestCondition{Field: "user", Type: Equal, Value: "u1", Relationship: And}))
+	assert.Equal(4, count(RequestCondition{Field: "kind", Type: Contains, Value: "ie"}))
+	assert.Equal(6, count(RequestCondition{Field: "kind", Type: SizeGreaterThan, Value: 4}))
+	assert.Equal(4, count(RequestCondition{Field: "kind", Type: SizeEquals, Value: 4}))
+	assert.Equal(10, count(RequestCondition{Field: "ts", Type: AttributeType, Value: "N"}))
+}
+
+func TestMemoryConditionTree(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+	putEvents(assert, c)
+
+	// (user = u1 AND ts < 3) OR (user = u2 AND NOT kind = click)
+	r := Request{Table: "events", Action: Scan}
+	r.Filter(AnyOf(
+		AllOf(Where("user", Equal, "u1"), Where("ts", LessThan, 3)),
+		AllOf(Where("user", Equal, "u2"), Not(Where("kind", Equal, "click")))))
+	res, e := c.Run(r)
+	assert.Nil(e)
+	assert.Equal(3, res.GetItemCount())
+
+	r = Request{Table: "events", Action: Scan}
+	r.Filter(Not(AnyOf(Where("kind", Equal, "view"), Where("ts", GreaterThan, 7))))
+	res, e = c.Run(r)
+	assert.Nil(e)
+	assert.Equal(5, res.GetItemCount())
+}
+
+func TestMemoryConditionPath(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+
+	_, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{
+		"profile": map[string]interface{}{"address": map[string]interface{}{"zip": "12345"}},
+		"tags":    []string{"admin", "beta"}}})
+	assert.Nil(e)
+
+	r := Request{Table: "users", Action: Scan}
+	r.Filter(Where("/profile/address/zip", Equal, "12345")).Filter(Where("/tags/1", Equal, "beta"))
+	res, e := c.Run(r)
+	assert.Nil(e)
+	assert.Equal(1, res.GetItemCount())
+
+	p := Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{}}
+	p.And("/profile/address/zip", Equal, "00000")
+	_, e = c.Run(p)
+	assert.True(godba.IsConditionFailed(e), "the nested condition should fail")
+}
+
+func TestMemoryTimeFormat(t *testing.T) {
+	assert := assert.New(t)
+	c := NewMemory(config.Store{
+		TimeFormat: TimeUnix,
+		Tables:     map[string]TableSchema{"events": TableSchema{HashKey: "user", RangeKey: "ts"}}})
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		_, e := c.Run(Request{Table: "events", Action: Put, Key: map[string]interface{}{"user": "u1", "ts": start.Add(time.Duration(i) * time.Hour)}, Item: map[string]interface{}{}})
+		assert.Nil(e)
+	}
+
+	r := Request{Table: "events", Action: Query}
+	r.And("user", Equal, "u1").And("ts", Between, []time.Time{start.Add(time.Hour), start.Add(3 * time.Hour)})
+	res, e := c.Run(r)
+	assert.Nil(e)
+	if assert.Equal(3, res.GetItemCount()) {
+		n, _ := res.GetNumberItem(0, "ts")
+		assert.Equal(int(start.Add(time.Hour).Unix()), n)
+	}
+}
+
+type testEvent struct {
+	User    string      `godba:"user,key"`
+	At      time.Time   `godba:"at,key"`
+	Seen    *time.Time  `godba:"seen,omitempty"`
+	History []time.Time `godba:"history"`
+	Meta    struct {
+		Updated time.Time `godba:"updated"`
+	} `godba:"meta"`
+}
+
+func TestMemoryTimeRoundTrip(t *testing.T) {
+	at := time.Date(2020, 1, 1, 12, 30, 0, 0, time.UTC)
+	for _, enc := range []TimeEncoding{TimeRFC3339, TimeUnix} {
+		assert := assert.New(t)
+		c := NewMemory(config.Store{
+			TimeFormat: enc,
+			Tables:     map[string]TableSchema{"events": TableSchema{HashKey: "user", RangeKey: "at"}}})
+
+		ev := testEvent{User: "u1", At: at, Seen: &at, History: []time.Time{at, at.Add(time.Hour)}}
+		ev.Meta.Updated = at.Add(time.Minute)
+		r := Request{Table: "events", Action: Put}
+		assert.Nil(r.SetItemFrom(ev))
+		_, e := c.Run(r)
+		assert.Nil(e)
+
+		res, e := c.Run(Request{Table: "events", Action: Get, Key: map[string]interface{}{"user": "u1", "at": at}})
+		if !assert.Nil(e) || !assert.Equal(1, res.GetItemCount(), "encoding %d", enc) {
+			continue
+		}
+		raw, _ := res.GetItem(0, "history")
+		if enc == TimeUnix {
+			n, ok := res.GetNumberItem(0, "at")
+			assert.True(ok)
+			assert.Equal(int(at.Unix()), n)
+			assert.Equal(strconv.FormatInt(at.Add(time.Hour).Unix(), 10), *raw.(*dynamodb.AttributeValue).L[1].N)
+		} else {
+			s, _ := res.GetStringItem(0, "at")
+			assert.Equal(at.Format(time.RFC3339Nano), s)
+			assert.Equal(at.Add(time.Hour).Format(time.RFC3339Nano), *raw.(*dynamodb.AttributeValue).L[1].S)
+		}
+
+		var out testEvent
+		if assert.Nil(res.UnmarshalRow(0, &out)) {
+			assert.Equal(ev, out, "encoding %d", enc)
+		}
+		var seen time.Time
+		e, ok := res.UnmarshalItem(0, "seen", &seen)
+		assert.Nil(e)
+		assert.True(ok)
+		assert.Equal(at, seen)
+
+		// conditions on the stored times, nested ones included, compare in the same encoding
+		u := Request{Table: "events", Action: Update, Key: map[string]interface{}{"user": "u1", "at": at}}
+		u.AddUpdateValue("/seen", Update, at.Add(time.Hour)).
+			And("seen", Equal, at).
+			And("/meta/updated", Equal, at.Add(time.Minute))
+		_, e = c.Run(u)
+		assert.Nil(e, "encoding %d", enc)
+
+		q := Request{Table: "events", Action: Query}
+		q.And("user", Equal, "u1").And("at", Between, []time.Time{at.Add(-time.Hour), at.Add(time.Hour)})
+		res, e = c.Run(q)
+		assert.Nil(e)
+		var all []testEvent
+		if assert.Nil(res.UnmarshalAll(&all)) && assert.Len(all, 1) {
+			assert.Equal(at.Add(time.Hour), *all[0].Seen)
+			assert.Equal(ev.History, all[0].History)
+		}
+	}
+}
+
+func TestMemoryUpdateActions(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+	c.CacheOff()
+
+	_, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"created": "yesterday"}})
+	assert.Nil(e)
+
+	// counters and sets are created the first time they are updated
+	for n := 0; n < 3; n++ {
+		r := Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+		r.AddUpdateValue("/views", Increment, 2).
+			AddUpdateValue("/tags", AddToSet, []string{"go", "db" + strconv.Itoa(n)}).
+			AddUpdateValue("/created", SetIfNotExists, "today").
+			AddUpdateValue("/first", SetIfNotExists, n)
+		_, e = c.Run(r)
+		assert.Nil(e)
+	}
+
+	r := Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	r.AddUpdateValue("/views", Decrement, 1).AddUpdateValue("/tags", RemoveFromSet, []string{"db0", "db1"})
+	_, e = c.Run(r)
+	assert.Nil(e)
+
+	res, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	n, _ := res.GetNumberItem(0, "views")
+	assert.Equal(5, n)
+	n, _ = res.GetNumberItem(0, "first")
+	assert.Equal(0, n)
+	s, _ := res.GetStringItem(0, "created")
+	assert.Equal("yesterday", s)
+	var tags []string
+	err, _ := res.UnmarshalItem(0, "tags", &tags)
+	assert.Nil(err)
+	assert.ElementsMatch([]string{"go", "db2"}, tags)
+}
+
+func TestMemoryListUpdates(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+	c.CacheOff()
+
+	_, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"list": []string{"b", "c"}}})
+	assert.Nil(e)
+
+	list := func() []string {
+		res, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+		assert.Nil(e)
+		l, _ := res.GetStringListItem(0, "list")
+		return l
+	}
+
+	r := Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	r.AddUpdateValue("/list", Append, []string{"d", "e"}).AddUpdateValue("/new", Prepend, "x")
+	_, e = c.Run(r)
+	assert.Nil(e)
+	assert.Equal([]string{"b", "c", "d", "e"}, list())
+
+	r = Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	r.AddUpdateValue("/list", Prepend, "a")
+	_, e = c.Run(r)
+	assert.Nil(e)
+	assert.Equal([]string{"a", "b", "c", "d", "e"}, list())
+
+	// inserts into the same list are applied in order
+	r = Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	r.AddUpdateValue("/list/1", Insert, "a1").AddUpdateValue("/list/6", Insert, "f").AddUpdateValue("/other/0", Insert, "y")
+	_, e = c.Run(r)
+	assert.Nil(e)
+	assert.Equal([]string{"a", "a1", "b", "c", "d", "e", "f"}, list())
+
+	res, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	l, _ := res.GetStringListItem(0, "other")
+	assert.Equal([]string{"y"}, l)
+	l, _ = res.GetStringListItem(0, "new")
+	assert.Equal([]string{"x"}, l)
+
+	r = Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	r.AddUpdateValue("/list/9", Insert, "z")
+	_, e = c.Run(r)
+	assert.Equal(godba.ErrorUpdateExpression, godba.Code(e))
+
+	// list changes are rolled back by restoring the list
+	tx := c.StartTransaction()
+	r = Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	r.AddUpdateValue("/list", Append, "g").AddUpdateValue("/list2/0", Insert, "z")
+	_, e = tx.Run(r)
+	assert.Nil(e)
+	r = Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	r.AddUpdateValue("/other/-", Put, "y2")
+	_, e = tx.Run(r)
+	assert.Nil(e)
+	assert.Nil(tx.Rollback())
+
+	res, e = c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	l, _ = res.GetStringListItem(0, "list")
+	assert.Equal([]string{"a", "a1", "b", "c", "d", "e", "f"}, l)
+	l, _ = res.GetStringListItem(0, "other")
+	assert.Equal([]string{"y"}, l)
+	_, ok := res.GetItem(0, "list2")
+	assert.False(ok)
+}
+
+func TestMemoryPatch(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+	c.CacheOff()
+
+	_, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{
+		"name":    "bob",
+		"tags":    []string{"a", "c"},
+		"address": map[string]interface{}{"zip": "12345"},
+		"old":     1}})
+	assert.Nil(e)
+
+	r := Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	assert.Nil(r.AddPatch([]byte(`[
+		{"op": "test", "path": "/name", "value": "bob"},
+		{"op": "add", "path": "/tags/1", "value": "b"},
+		{"op": "replace", "path": "/name", "value": "alice"},
+		{"op": "move", "from": "/address", "path": "/home"},
+		{"op": "copy", "from": "/old", "path": "/older"},
+		{"op": "add", "path": "/visits", "value": 12345678901234567890}
+	]`)))
+	_, e = c.Run(r)
+	assert.Nil(e)
+
+	res, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	s, _ := res.GetStringItem(0, "name")
+	assert.Equal("alice", s)
+	l, _ := res.GetStringListItem(0, "tags")
+	assert.Equal([]string{"a", "b", "c"}, l)
+	_, ok := res.GetItem(0, "address")
+	assert.False(ok)
+	var home map[string]string
+	err, _ := res.UnmarshalItem(0, "home", &home)
+	assert.Nil(err)
+	assert.Equal("12345", home["zip"])
+	n, _ := res.GetNumberItem(0, "older")
+	assert.Equal(1, n)
+	var visits dynamodbattribute.Number
+	err, _ = res.UnmarshalItem(0, "visits", &visits)
+	assert.Nil(err)
+	assert.Equal(dynamodbattribute.Number("12345678901234567890"), visits)
+
+	// a failed test is not bypassed by an Or among the request's own conditions
+	r = Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	r.And("name", Equal, "alice").Or("name", Equal, "carol")
+	assert.Nil(r.AddPatch([]byte(`[
+		{"op": "test", "path": "/name", "value": "bob"},
+		{"op": "replace", "path": "/name", "value": "dave"}
+	]`)))
+	_, e = c.Run(r)
+	assert.True(godba.IsConditionFailed(e))
+}
+
+func TestMemoryPatchNumericMembers(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+	c.CacheOff()
+
+	_, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{
+		"scores": map[string]interface{}{"2023": 10},
+		"years":  map[string]interface{}{"2023": map[string]interface{}{"tags": []string{"a", "c"}}}}})
+	assert.Nil(e)
+
+	patch := func(p string) error {
+		r := Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+		assert.Nil(r.AddPatch([]byte(p)))
+		_, e := c.Run(r)
+		return e
+	}
+	item := func() map[string]interface{} {
+		res, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+		assert.Nil(e)
+		return unmarshalItems(res.(*dynamodbResult).items[0])
+	}
+
+	// numeric segments are members of maps, and indexes of lists
+	assert.Nil(patch(`[
+		{"op": "add", "path": "/scores/2024", "value": 20},
+		{"op": "replace", "path": "/scores/2023", "value": 11},
+		{"op": "add", "path": "/years/2023/tags/1", "value": "b"},
+		{"op": "copy", "from": "/scores/2023", "path": "/best"}
+	]`))
+	assert.Equal(map[string]interface{}{"2023": float64(11), "2024": float64(20)}, item()["scores"])
+	assert.Equal(map[string]interface{}{"2023": map[string]interface{}{"tags": []interface{}{"a", "b", "c"}}}, item()["years"])
+	assert.Equal(float64(10), item()["best"], "the patch reads the item as it was before it")
+
+	assert.Nil(patch(`[{"op": "test", "path": "/scores/2023", "value": 11}, {"op": "remove", "path": "/scores/2024"}]`))
+	assert.Equal(map[string]interface{}{"2023": float64(11)}, item()["scores"])
+
+	// tests and existence checks of numeric members still stop the patch
+	for _, p := range []string{
+		`[{"op": "test", "path": "/scores/2023", "value": 99}, {"op": "remove", "path": "/scores/2023"}]`,
+		`[{"op": "replace", "path": "/scores/2030", "value": 1}]`,
+		`[{"op": "remove", "path": "/scores/2030"}]`} {
+		assert.True(godba.IsConditionFailed(patch(p)), p)
+	}
+	assert.Equal(map[string]interface{}{"2023": float64(11)}, item()["scores"])
+
+	// a rollback puts the map back
+	tx := c.StartTransaction()
+	r := Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	assert.Nil(r.AddPatch([]byte(`[{"op": "add", "path": "/scores/2025", "value": 30}]`)))
+	_, e = tx.Run(r)
+	assert.Nil(e)
+	assert.Len(item()["scores"], 2)
+	assert.Empty(tx.Rollback())
+	assert.Equal(map[string]interface{}{"2023": float64(11)}, item()["scores"])
+
+	// an atomic transaction can not read the item first
+	a := getAtomicStore()
+	tx = a.StartTransaction()
+	_, e = tx.Run(r)
+	assert.Equal(godba.ErrorUpdateExpression, godba.Code(e))
+	tx.Rollback()
+}
+
+func TestMemoryConditionalWrites(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+	c.CacheOff()
+
+	_, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"version": 1, "list": []string{"a"}}})
+	assert.Nil(e)
+
+	u := Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	u.AddUpdateValue("/version", Put, 2).And("version", Equal, 2)
+	_, e = c.Run(u)
+	assert.Equal(godba.ErrorConditionFailed, godba.Code(e))
+
+	u.RequestConditions = nil
+	u.And("version", Equal, 1)
+	_, e = c.Run(u)
+	assert.Nil(e)
+
+	// the request conditions and the insert guards must both hold
+	u = Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	u.AddUpdateValue("/list/0", Insert, "z").And("version", Equal, 1).Or("version", Equal, 3)
+	_, e = c.Run(u)
+	assert.True(godba.IsConditionFailed(e))
+
+	// failing patch tests stop the whole patch
+	u = Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	assert.Nil(u.AddPatch([]byte(`[{"op": "test", "path": "/version", "value": 1}, {"op": "remove", "path": "/list"}]`)))
+	_, e = c.Run(u)
+	assert.True(godba.IsConditionFailed(e))
+	u = Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	assert.Nil(u.AddPatch([]byte(`[{"op": "replace", "path": "/missing", "value": 1}]`)))
+	_, e = c.Run(u)
+	assert.True(godba.IsConditionFailed(e))
+
+	d := Request{Table: "users", Action: Delete, Key: map[string]interface{}{"id": "1"}}
+	d.And("version", Equal, 1)
+	_, e = c.Run(d)
+	assert.Equal(godba.ErrorConditionFailed, godba.Code(e))
+
+	res, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	n, _ := res.GetNumberItem(0, "version")
+	assert.Equal(2, n)
+	l, _ := res.GetStringListItem(0, "list")
+	assert.Equal([]string{"a"}, l)
+
+	d.RequestConditions = nil
+	d.And("version", Equal, 2)
+	_, e = c.Run(d)
+	assert.Nil(e)
+}
+
+func TestMemoryVersion(t *testing.T) {
+	assert := assert.New(t)
+	c := NewMemory(config.Store{
+		VersionAttribute: "version",
+		Tables:           map[string]TableSchema{"users": TableSchema{HashKey: "id"}}})
+	c.CacheOff()
+
+	getVersion := func() int {
+		res, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+		assert.Nil(e)
+		v, ok := res.GetVersion(0)
+		assert.True(ok)
+		return v
+	}
+
+	p := Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "bob"}}
+	_, e := c.Run(p)
+	assert.Nil(e)
+	assert.Equal(1, getVersion())
+
+	// the item exists, so creating it again fails
+	_, e = c.Run(p)
+	assert.Equal(godba.ErrorConditionFailed, godba.Code(e))
+
+	u := Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}, Version: 1}
+	u.AddUpdateValue("/name", Put, "alice")
+	_, e = c.Run(u)
+	assert.Nil(e)
+	assert.Equal(2, getVersion())
+
+	// a stale version is rejected
+	_, e = c.Run(u)
+	assert.True(godba.IsConditionFailed(e))
+
+	p.Version = 2
+	_, e = c.Run(p)
+	assert.Nil(e)
+	assert.Equal(3, getVersion())
+
+	res, e := getMemoryStore().Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	_, ok := res.GetVersion(0)
+	assert.False(ok, "the version is only exposed when the datastore has a version attribute")
+}
+
+func TestMemoryProjection(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+
+	for _, id := range []string{"1", "2"} {
+		_, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": id}, Item: map[string]interface{}{
+			"name":    "user" + id,
+			"bio":     "a long bio",
+			"address": map[string]interface{}{"zip": "12345", "lines": []string{"1 main st", "apt " + id}}}})
+		assert.Nil(e)
+	}
+
+	check := func(res Result, i int, id string) {
+		s, _ := res.GetStringItem(i, "name")
+		assert.Equal("user"+id, s)
+		_, ok := res.GetItem(i, "bio")
+		assert.False(ok)
+		var address map[string]interface{}
+		err, _ := res.UnmarshalItem(i, "address", &address)
+		assert.Nil(err)
+		assert.Equal(map[string]interface{}{"lines": []interface{}{"apt " + id}}, address)
+	}
+	projection := []string{"name", "/address/lines/1"}
+
+	res, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}, Projection: projection})
+	assert.Nil(e)
+	check(res, 0, "1")
+
+	// the partial item is not cached
+	res, e = c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	s, _ := res.GetStringItem(0, "bio")
+	assert.Equal("a long bio", s)
+
+	res, e = c.Run(Request{Table: "users", Action: Scan, Projection: projection})
+	assert.Nil(e)
+	if assert.Equal(2, res.GetItemCount()) {
+		_, ok := res.GetItem(0, "bio")
+		assert.False(ok)
+	}
+
+	b := Request{Action: BatchGet}
+	b.AddBatch(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "2"}, Projection: projection}).
+		AddBatch(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}, Projection: projection})
+	res, e = c.Run(b)
+	assert.Nil(e)
+	if assert.Equal(2, res.GetItemCount()) {
+		check(res, 0, "2")
+		check(res, 1, "1")
+	}
+
+	// a table is read with one projection, so requests with different ones get the paths of all of them
+	b.Batch[1].Projection = []string{"bio", "/address"}
+	res, e = c.Run(b)
+	assert.Nil(e)
+	if assert.Equal(2, res.GetItemCount()) {
+		s, _ = res.GetStringItem(1, "bio")
+		assert.Equal("a long bio", s)
+		s, _ = res.GetStringItem(0, "name")
+		assert.Equal("user2", s)
+		var address map[string]interface{}
+		err, _ := res.UnmarshalItem(1, "address", &address)
+		assert.Nil(err)
+		assert.Equal("12345", address["zip"])
+	}
+	b.Batch[1].Projection = nil
+	res, e = c.Run(b)
+	assert.Nil(e)
+	s, _ = res.GetStringItem(0, "bio")
+	assert.Equal("a long bio", s, "a request without a projection reads the whole item")
+
+	b.Action = TransactGet
+	b.Batch[1].Projection = []string{"bio"}
+	res, e = c.Run(b)
+	assert.Nil(e)
+	if assert.Equal(2, res.GetItemCount()) {
+		check(res, 0, "2")
+		s, _ = res.GetStringItem(1, "bio")
+		assert.Equal("a long bio", s)
+		_, ok := res.GetItem(1, "name")
+		assert.False(ok)
+	}
+}
+
+func TestMemoryReturnValues(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+
+	res, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "bob", "views": 1}})
+	assert.Nil(e)
+	assert.Nil(res.GetAttributes())
+
+	res, e = c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "alice", "views": 1}, ReturnValues: AllOld})
+	assert.Nil(e)
+	var old struct {
+		Name  string `godba:"name"`
+		Views int    `godba:"views"`
+	}
+	assert.Nil(res.UnmarshalAttributes(&old))
+	assert.Equal("bob", old.Name)
+	assert.Equal(1, old.Views)
+
+	// dynamodb only returns new or updated values for an Update
+	for _, rv := range []ReturnValue{UpdatedOld, AllNew, UpdatedNew} {
+		_, e = c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "2"}, Item: map[string]interface{}{"name": "carol"}, ReturnValues: rv})
+		assert.Equal(godba.ErrorInvalidRequest, godba.Code(e))
+		_, e = c.Run(Request{Table: "users", Action: Delete, Key: map[string]interface{}{"id": "1"}, ReturnValues: rv})
+		assert.Equal(godba.ErrorInvalidRequest, godba.Code(e))
+	}
+	res, e = c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "2"}})
+	assert.Nil(e)
+	assert.Equal(0, res.GetItemCount())
+
+	u := Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}, ReturnValues: UpdatedNew}
+	u.AddUpdateValue("/views", Increment, 2)
+	res, e = c.Run(u)
+	assert.Nil(e)
+	n, ok := res.GetNumberAttribute("views")
+	assert.True(ok)
+	assert.Equal(3, n)
+	_, ok = res.GetAttribute("name")
+	assert.False(ok, "only the updated attributes are returned")
+
+	u.ReturnValues = AllNew
+	res, e = c.Run(u)
+	assert.Nil(e)
+	assert.Equal(map[string]interface{}{"id": "1", "name": "alice", "views": float64(5)}, res.GetAttributes())
+
+	// transactions read the old item for the rollback, but only return it when asked to
+	tx := c.StartTransaction()
+	u.ReturnValues = None
+	res, e = tx.Run(u)
+	assert.Nil(e)
+	assert.Nil(res.GetAttributes())
+	_, ok = res.GetAttribute("views")
+	assert.False(ok)
+	u.ReturnValues = UpdatedNew
+	_, e = tx.Run(u)
+	assert.Equal(godba.ErrorInvalidRequest, godba.Code(e))
+	res, e = tx.Run(Request{Table: "users", Action: Delete, Key: map[string]interface{}{"id": "1"}, ReturnValues: AllOld})
+	assert.Nil(e)
+	s, _ := res.GetAttribute("name")
+	assert.Equal("alice", s)
+	assert.Nil(tx.Finish())
+}
+
+func TestMemoryUpdateRollback(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+	c.CacheOff()
+
+	item := map[string]interface{}{
+		"profile": map[string]interface{}{"address": map[string]interface{}{"zip": "12345"}, "tags": []string{"a", "b"}},
+		"views":   3,
+		"old":     "value"}
+	_, e := c.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: item})
+	assert.Nil(e)
+
+	raw := func(id string) map[string]*dynamodb.AttributeValue {
+		res, e := c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": id}})
+		assert.Nil(e)
+		if res.GetItemCount() == 0 {
+			return nil
+		}
+		return res.(*dynamodbResult).items[0]
+	}
+	before := raw("1")
+
+	tx := c.StartTransaction()
+	u := Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	u.AddUpdateValue("/profile/address/zip", Update, "54321").
+		AddUpdateValue("/profile/address/city", Put, "nowhere").
+		AddUpdateValue("/profile/tags/0", Delete, nil).
+		AddUpdateValue("/views", Increment, 2).
+		AddUpdateValue("/labels", AddToSet, []string{"x"}).
+		AddUpdateValue("/old", Delete, nil)
+	_, e = tx.Run(u)
+	assert.Nil(e)
+	u = Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "2"}}
+	u.AddUpdateValue("/views", Increment, 1)
+	_, e = tx.Run(u)
+	assert.Nil(e)
+
+	assert.Empty(tx.Rollback())
+	assert.Equal(before, raw("1"))
+	assert.Nil(raw("2"), "the item created by the update should be deleted")
+
+	// the version is restored along with the rest of the update
+	v := NewMemory(config.Store{VersionAttribute: "version", Tables: map[string]TableSchema{"users": TableSchema{HashKey: "id"}}})
+	_, e = v.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "bob"}})
+	assert.Nil(e)
+	tx = v.StartTransaction()
+	u = Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}, Version: 1}
+	u.AddUpdateValue("/name", Put, "alice")
+	_, e = tx.Run(u)
+	assert.Nil(e)
+	assert.Empty(tx.Rollback())
+	res, e := v.Run(Request{Table: "users", Action: Get, LiveData: true, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	n, _ := res.GetVersion(0)
+	assert.Equal(1, n)
+	s, _ := res.GetStringItem(0, "name")
+	assert.Equal("bob", s)
+}
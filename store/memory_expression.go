@@ -0,0 +1,1429 @@
+package store
+
+import (
+	"bytes"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+/**
+
+Expression support for the in-memory DBer
+
+The memory store understands the same condition, key condition, filter, update and projection
+expression grammar that DynamoDB does, so requests built by this package are evaluated exactly as
+they would be by the real service.
+
+**/
+
+type memItem map[string]*dynamodb.AttributeValue
+
+const errCodeValidation = "ValidationException"
+
+func validationError(msg string) error {
+	return awserr.New(errCodeValidation, msg, nil)
+}
+
+// pathElem is a single step in a document path: either a map key or a list index
+type pathElem struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+type docPath []pathElem
+
+func (p docPath) String() string {
+	s := ""
+	for i, e := range p {
+		if e.isIndex {
+			s += "[" + strconv.Itoa(e.index) + "]"
+			continue
+		}
+		if i > 0 {
+			s += "."
+		}
+		s += e.name
+	}
+	return s
+}
+
+/*
+
+Tokenizer
+
+*/
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokName  // #placeholder
+	tokValue // :placeholder
+	tokNumber
+	tokPunct
+)
+
+type exprToken struct {
+	kind tokenKind
+	text string
+}
+
+func isIdentChar(r byte) bool {
+	return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
+
+func tokenize(exp string) ([]exprToken, error) {
+	var toks []exprToken
+	i := 0
+	for i < len(exp) {
+		c := exp[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '#' || c == ':':
+			j := i + 1
+			for j < len(exp) && isIdentChar(exp[j]) {
+				j++
+			}
+			if j == i+1 {
+				return nil, validationError("Invalid expression: syntax error near \"" + exp[i:] + "\"")
+			}
+			kind := tokName
+			if c == ':' {
+				kind = tokValue
+			}
+			toks = append(toks, exprToken{kind, exp[i:j]})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(exp) && exp[j] >= '0' && exp[j] <= '9' {
+				j++
+			}
+			toks = append(toks, exprToken{tokNumber, exp[i:j]})
+			i = j
+		case isIdentChar(c):
+			j := i
+			for j < len(exp) && isIdentChar(exp[j]) {
+				j++
+			}
+			toks = append(toks, exprToken{tokIdent, exp[i:j]})
+			i = j
+		case c == '<' || c == '>':
+			if i+1 < len(exp) && (exp[i+1] == '=' || (c == '<' && exp[i+1] == '>')) {
+				toks = append(toks, exprToken{tokPunct, exp[i : i+2]})
+				i += 2
+			} else {
+				toks = append(toks, exprToken{tokPunct, exp[i : i+1]})
+				i++
+			}
+		case strings.IndexByte("()[],.=+-", c) >= 0:
+			toks = append(toks, exprToken{tokPunct, exp[i : i+1]})
+			i++
+		default:
+			return nil, validationError("Invalid expression: unexpected character \"" + string(c) + "\"")
+		}
+	}
+	return append(toks, exprToken{kind: tokEOF}), nil
+}
+
+/*
+
+Parser
+
+*/
+
+// exprParser parses the expressions of a single DBer call. The names and values maps are the
+// ExpressionAttributeNames and ExpressionAttributeValues of that call, and every placeholder that
+// is referenced is recorded so unused ones can be reported the way DynamoDB does
+type exprParser struct {
+	toks       []exprToken
+	pos        int
+	names      map[string]*string
+	values     map[string]*dynamodb.AttributeValue
+	usedNames  map[string]bool
+	usedValues map[string]bool
+}
+
+func newExprParser(names map[string]*string, values map[string]*dynamodb.AttributeValue) *exprParser {
+	return &exprParser{
+		names:      names,
+		values:     values,
+		usedNames:  make(map[string]bool),
+		usedValues: make(map[string]bool),
+	}
+}
+
+func (p *exprParser) reset(exp string) error {
+	toks, err := tokenize(exp)
+	if err != nil {
+		return err
+	}
+	p.toks = toks
+	p.pos = 0
+	return nil
+}
+
+// checkUnused returns an error if any name or value placeholder was supplied but not referenced
+func (p *exprParser) checkUnused() error {
+	var unused []string
+	for k := range p.values {
+		if !p.usedValues[k] {
+			unused = append(unused, k)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		return validationError("Value provided in ExpressionAttributeValues unused in expressions: keys: {" + strings.Join(unused, ", ") + "}")
+	}
+	for k := range p.names {
+		if !p.usedNames[k] {
+			unused = append(unused, k)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		return validationError("Value provided in ExpressionAttributeNames unused in expressions: keys: {" + strings.Join(unused, ", ") + "}")
+	}
+	return nil
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.toks[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *exprParser) isPunct(s string) bool {
+	t := p.peek()
+	return t.kind == tokPunct && t.text == s
+}
+
+func (p *exprParser) isKeyword(s string) bool {
+	t := p.peek()
+	return t.kind == tokIdent && strings.EqualFold(t.text, s)
+}
+
+// isCall reports whether the upcoming tokens are a function call
+func (p *exprParser) isCall() bool {
+	return p.peek().kind == tokIdent && p.toks[p.pos+1].kind == tokPunct && p.toks[p.pos+1].text == "("
+}
+
+func (p *exprParser) expect(s string) error {
+	t := p.next()
+	if t.kind != tokPunct || t.text != s {
+		return p.syntaxError(t)
+	}
+	return nil
+}
+
+func (p *exprParser) syntaxError(t exprToken) error {
+	if t.kind == tokEOF {
+		return validationError("Invalid expression: unexpected end of expression")
+	}
+	return validationError("Invalid expression: syntax error; token: \"" + t.text + "\"")
+}
+
+func (p *exprParser) parsePath() (docPath, error) {
+	var path docPath
+	name, err := p.parseName()
+	if err != nil {
+		return nil, err
+	}
+	path = append(path, pathElem{name: name})
+	for {
+		switch {
+		case p.isPunct("."):
+			p.next()
+			name, err := p.parseName()
+			if err != nil {
+				return nil, err
+			}
+			path = append(path, pathElem{name: name})
+		case p.isPunct("["):
+			p.next()
+			t := p.next()
+			if t.kind != tokNumber {
+				return nil, p.syntaxError(t)
+			}
+			i, _ := strconv.Atoi(t.text)
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			path = append(path, pathElem{index: i, isIndex: true})
+		default:
+			return path, nil
+		}
+	}
+}
+
+func (p *exprParser) parseName() (string, error) {
+	t := p.next()
+	switch t.kind {
+	case tokIdent:
+		return t.text, nil
+	case tokName:
+		n, ok := p.names[t.text]
+		if !ok || n == nil {
+			return "", validationError("Invalid expression: An expression attribute name used in the document path is not defined; attribute name: " + t.text)
+		}
+		p.usedNames[t.text] = true
+		return *n, nil
+	}
+	return "", p.syntaxError(t)
+}
+
+func (p *exprParser) parseValue() (*dynamodb.AttributeValue, error) {
+	t := p.next()
+	if t.kind != tokValue {
+		return nil, p.syntaxError(t)
+	}
+	v, ok := p.values[t.text]
+	if !ok || v == nil {
+		return nil, validationError("Invalid expression: An expression attribute value used in expression is not defined; attribute value: " + t.text)
+	}
+	p.usedValues[t.text] = true
+	return v, nil
+}
+
+// parseOperand parses a path, value or operand function. updateFns allows the functions that are only
+// valid on the right hand side of a SET action
+func (p *exprParser) parseOperand(updateFns bool) (exprOperand, error) {
+	if p.peek().kind == tokValue {
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return valueOperand{v}, nil
+	}
+
+	if p.isCall() {
+		fn := strings.ToLower(p.next().text)
+		p.next()
+		var op exprOperand
+		switch {
+		case fn == "size":
+			path, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			op = sizeOperand{path}
+		case fn == "if_not_exists" && updateFns:
+			path, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+			def, err := p.parseOperand(updateFns)
+			if err != nil {
+				return nil, err
+			}
+			op = ifNotExistsOperand{path, def}
+		case fn == "list_append" && updateFns:
+			a, err := p.parseOperand(updateFns)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+			b, err := p.parseOperand(updateFns)
+			if err != nil {
+				return nil, err
+			}
+			op = listAppendOperand{a, b}
+		default:
+			return nil, validationError("Invalid expression: Invalid function name; function: " + fn)
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return op, nil
+	}
+
+	path, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	return pathOperand{path}, nil
+}
+
+// parseCondition parses a complete condition expression
+func (p *exprParser) parseCondition(exp string) (exprCondition, error) {
+	if err := p.reset(exp); err != nil {
+		return nil, err
+	}
+	c, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.syntaxError(t)
+	}
+	return c, nil
+}
+
+func (p *exprParser) parseOr() (exprCondition, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orCondition{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprCondition, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("AND") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andCondition{left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseNot() (exprCondition, error) {
+	if p.isKeyword("NOT") {
+		p.next()
+		c, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notCondition{c}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprCondition, error) {
+	if p.isPunct("(") {
+		p.next()
+		c, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+
+	if p.isCall() {
+		fn := strings.ToLower(p.peek().text)
+		switch fn {
+		case "attribute_exists", "attribute_not_exists", "attribute_type", "begins_with", "contains":
+			p.next()
+			p.next()
+			path, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			c := functionCondition{fn: fn, path: path}
+			if fn != "attribute_exists" && fn != "attribute_not_exists" {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+				if c.arg, err = p.parseOperand(false); err != nil {
+					return nil, err
+				}
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return c, nil
+		}
+	}
+
+	left, err := p.parseOperand(false)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.isKeyword("BETWEEN"):
+		p.next()
+		low, err := p.parseOperand(false)
+		if err != nil {
+			return nil, err
+		}
+		if !p.isKeyword("AND") {
+			return nil, p.syntaxError(p.peek())
+		}
+		p.next()
+		high, err := p.parseOperand(false)
+		if err != nil {
+			return nil, err
+		}
+		return betweenCondition{left, low, high}, nil
+	case p.isKeyword("IN"):
+		p.next()
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		c := inCondition{operand: left}
+		for {
+			o, err := p.parseOperand(false)
+			if err != nil {
+				return nil, err
+			}
+			c.list = append(c.list, o)
+			if !p.isPunct(",") {
+				break
+			}
+			p.next()
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+
+	t := p.next()
+	if t.kind != tokPunct {
+		return nil, p.syntaxError(t)
+	}
+	switch t.text {
+	case "=", "<>", "<", "<=", ">", ">=":
+		right, err := p.parseOperand(false)
+		if err != nil {
+			return nil, err
+		}
+		return compareCondition{t.text, left, right}, nil
+	}
+	return nil, p.syntaxError(t)
+}
+
+// updateAction is a single action from an update expression
+type updateAction struct {
+	clause string // SET, REMOVE, ADD or DELETE
+	path   docPath
+	value  exprOperand
+}
+
+// parseUpdate parses an update expression into its individual actions
+func (p *exprParser) parseUpdate(exp string) ([]updateAction, error) {
+	if err := p.reset(exp); err != nil {
+		return nil, err
+	}
+	if p.peek().kind == tokEOF {
+		return nil, validationError("Invalid UpdateExpression: The expression can not be empty;")
+	}
+
+	var actions []updateAction
+	seen := make(map[string]bool)
+	for p.peek().kind != tokEOF {
+		t := p.next()
+		clause := strings.ToUpper(t.text)
+		if t.kind != tokIdent || (clause != "SET" && clause != "REMOVE" && clause != "ADD" && clause != "DELETE") {
+			return nil, p.syntaxError(t)
+		}
+		if seen[clause] {
+			return nil, validationError("Invalid UpdateExpression: The \"" + clause + "\" section can only be used once in an update expression;")
+		}
+		seen[clause] = true
+
+		for {
+			path, err := p.parsePath()
+			if err != nil {
+				return nil, err
+			}
+			a := updateAction{clause: clause, path: path}
+			switch clause {
+			case "SET":
+				if err := p.expect("="); err != nil {
+					return nil, err
+				}
+				left, err := p.parseOperand(true)
+				if err != nil {
+					return nil, err
+				}
+				a.value = left
+				if p.isPunct("+") || p.isPunct("-") {
+					op := p.next().text
+					right, err := p.parseOperand(true)
+					if err != nil {
+						return nil, err
+					}
+					a.value = arithOperand{op, left, right}
+				}
+			case "ADD", "DELETE":
+				v, err := p.parseValue()
+				if err != nil {
+					return nil, err
+				}
+				a.value = valueOperand{v}
+			}
+			actions = append(actions, a)
+
+			if !p.isPunct(",") {
+				break
+			}
+			p.next()
+		}
+	}
+
+	return actions, nil
+}
+
+// parseProjection parses a comma separated list of document paths
+func (p *exprParser) parseProjection(exp string) ([]docPath, error) {
+	if err := p.reset(exp); err != nil {
+		return nil, err
+	}
+	var paths []docPath
+	for {
+		path, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+		if !p.isPunct(",") {
+			break
+		}
+		p.next()
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.syntaxError(t)
+	}
+	return paths, nil
+}
+
+/*
+
+Evaluation
+
+*/
+
+type exprOperand interface {
+	value(item memItem) (*dynamodb.AttributeValue, error)
+}
+
+type pathOperand struct{ path docPath }
+
+func (o pathOperand) value(item memItem) (*dynamodb.AttributeValue, error) {
+	return resolvePath(item, o.path), nil
+}
+
+type valueOperand struct{ v *dynamodb.AttributeValue }
+
+func (o valueOperand) value(item memItem) (*dynamodb.AttributeValue, error) {
+	return o.v, nil
+}
+
+type sizeOperand struct{ path docPath }
+
+func (o sizeOperand) value(item memItem) (*dynamodb.AttributeValue, error) {
+	v := resolvePath(item, o.path)
+	if v == nil {
+		return nil, nil
+	}
+	var n int
+	switch {
+	case v.S != nil:
+		n = utf8.RuneCountInString(*v.S)
+	case v.B != nil:
+		n = len(v.B)
+	case v.SS != nil:
+		n = len(v.SS)
+	case v.NS != nil:
+		n = len(v.NS)
+	case v.BS != nil:
+		n = len(v.BS)
+	case v.M != nil:
+		n = len(v.M)
+	case v.L != nil:
+		n = len(v.L)
+	default:
+		return nil, validationError("Invalid ConditionExpression: Incorrect operand type for operator or function; operator or function: size")
+	}
+	return &dynamodb.AttributeValue{N: strPtr(strconv.Itoa(n))}, nil
+}
+
+type ifNotExistsOperand struct {
+	path docPath
+	def  exprOperand
+}
+
+func (o ifNotExistsOperand) value(item memItem) (*dynamodb.AttributeValue, error) {
+	if v := resolvePath(item, o.path); v != nil {
+		return v, nil
+	}
+	return o.def.value(item)
+}
+
+type listAppendOperand struct{ a, b exprOperand }
+
+func (o listAppendOperand) value(item memItem) (*dynamodb.AttributeValue, error) {
+	a, err := o.a.value(item)
+	if err != nil {
+		return nil, err
+	}
+	b, err := o.b.value(item)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil || b == nil || a.L == nil || b.L == nil {
+		return nil, validationError("Invalid UpdateExpression: Incorrect operand type for operator or function; operator or function: list_append")
+	}
+	l := make([]*dynamodb.AttributeValue, 0, len(a.L)+len(b.L))
+	l = append(l, a.L...)
+	return &dynamodb.AttributeValue{L: append(l, b.L...)}, nil
+}
+
+type arithOperand struct {
+	op   string
+	a, b exprOperand
+}
+
+func (o arithOperand) value(item memItem) (*dynamodb.AttributeValue, error) {
+	a, err := o.a.value(item)
+	if err != nil {
+		return nil, err
+	}
+	b, err := o.b.value(item)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil || b == nil {
+		return nil, validationError("The provided expression refers to an attribute that does not exist in the item")
+	}
+	if a.N == nil || b.N == nil {
+		return nil, validationError("Invalid UpdateExpression: Incorrect operand type for operator or function; operator: " + o.op)
+	}
+	x, ok1 := parseNumber(*a.N)
+	y, ok2 := parseNumber(*b.N)
+	if !ok1 || !ok2 {
+		return nil, validationError("A value provided cannot be converted into a number")
+	}
+	if o.op == "+" {
+		x.Add(x, y)
+	} else {
+		x.Sub(x, y)
+	}
+	return &dynamodb.AttributeValue{N: strPtr(formatNumber(x))}, nil
+}
+
+type exprCondition interface {
+	eval(item memItem) (bool, error)
+}
+
+type andCondition struct{ a, b exprCondition }
+
+func (c andCondition) eval(item memItem) (bool, error) {
+	ok, err := c.a.eval(item)
+	if err != nil || !ok {
+		return false, err
+	}
+	return c.b.eval(item)
+}
+
+type orCondition struct{ a, b exprCondition }
+
+func (c orCondition) eval(item memItem) (bool, error) {
+	ok, err := c.a.eval(item)
+	if err != nil || ok {
+		return ok, err
+	}
+	return c.b.eval(item)
+}
+
+type notCondition struct{ c exprCondition }
+
+func (c notCondition) eval(item memItem) (bool, error) {
+	ok, err := c.c.eval(item)
+	return !ok, err
+}
+
+type compareCondition struct {
+	op   string
+	a, b exprOperand
+}
+
+func (c compareCondition) eval(item memItem) (bool, error) {
+	a, err := c.a.value(item)
+	if err != nil {
+		return false, err
+	}
+	b, err := c.b.value(item)
+	if err != nil {
+		return false, err
+	}
+	switch c.op {
+	case "=":
+		return a != nil && b != nil && attrEqual(a, b), nil
+	case "<>":
+		return a == nil || b == nil || !attrEqual(a, b), nil
+	}
+	cmp, ok := attrCompare(a, b)
+	if !ok {
+		return false, nil
+	}
+	switch c.op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	}
+	return cmp >= 0, nil
+}
+
+type betweenCondition struct{ a, low, high exprOperand }
+
+func (c betweenCondition) eval(item memItem) (bool, error) {
+	a, err := c.a.value(item)
+	if err != nil {
+		return false, err
+	}
+	low, err := c.low.value(item)
+	if err != nil {
+		return false, err
+	}
+	high, err := c.high.value(item)
+	if err != nil {
+		return false, err
+	}
+	if cmp, ok := attrCompare(low, high); ok && cmp > 0 {
+		return false, validationError("Invalid ConditionExpression: The BETWEEN operator requires upper bound to be greater than or equal to lower bound")
+	}
+	lc, ok1 := attrCompare(a, low)
+	hc, ok2 := attrCompare(a, high)
+	return ok1 && ok2 && lc >= 0 && hc <= 0, nil
+}
+
+type inCondition struct {
+	operand exprOperand
+	list    []exprOperand
+}
+
+func (c inCondition) eval(item memItem) (bool, error) {
+	a, err := c.operand.value(item)
+	if err != nil || a == nil {
+		return false, err
+	}
+	for _, o := range c.list {
+		v, err := o.value(item)
+		if err != nil {
+			return false, err
+		}
+		if v != nil && attrEqual(a, v) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type functionCondition struct {
+	fn   string
+	path docPath
+	arg  exprOperand
+}
+
+func (c functionCondition) eval(item memItem) (bool, error) {
+	v := resolvePath(item, c.path)
+	switch c.fn {
+	case "attribute_exists":
+		return v != nil, nil
+	case "attribute_not_exists":
+		return v == nil, nil
+	}
+
+	arg, err := c.arg.value(item)
+	if err != nil || v == nil || arg == nil {
+		return false, err
+	}
+
+	switch c.fn {
+	case "attribute_type":
+		if arg.S == nil {
+			return false, validationError("Invalid ConditionExpression: Incorrect operand type for operator or function; operator or function: attribute_type")
+		}
+		return attrType(v) == *arg.S, nil
+	case "begins_with":
+		switch {
+		case v.S != nil && arg.S != nil:
+			return strings.HasPrefix(*v.S, *arg.S), nil
+		case v.B != nil && arg.B != nil:
+			return bytes.HasPrefix(v.B, arg.B), nil
+		}
+		return false, nil
+	}
+
+	// contains
+	switch {
+	case v.S != nil && arg.S != nil:
+		return strings.Contains(*v.S, *arg.S), nil
+	case v.B != nil && arg.B != nil:
+		return bytes.Contains(v.B, arg.B), nil
+	case v.SS != nil && arg.S != nil:
+		for _, s := range v.SS {
+			if *s == *arg.S {
+				return true, nil
+			}
+		}
+	case v.NS != nil && arg.N != nil:
+		for _, n := range v.NS {
+			if numbersEqual(*n, *arg.N) {
+				return true, nil
+			}
+		}
+	case v.BS != nil && arg.B != nil:
+		for _, b := range v.BS {
+			if bytes.Equal(b, arg.B) {
+				return true, nil
+			}
+		}
+	case v.L != nil:
+		for _, e := range v.L {
+			if attrEqual(e, arg) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+/*
+
+AttributeValue helpers
+
+*/
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func parseNumber(n string) (*big.Rat, bool) {
+	return new(big.Rat).SetString(n)
+}
+
+// formatNumber renders a number the way DynamoDB returns it: no exponent and no trailing zeros
+func formatNumber(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	s := strings.TrimRight(r.FloatString(38), "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+func numbersEqual(a, b string) bool {
+	x, ok1 := parseNumber(a)
+	y, ok2 := parseNumber(b)
+	return ok1 && ok2 && x.Cmp(y) == 0
+}
+
+func attrType(v *dynamodb.AttributeValue) string {
+	switch {
+	case v.S != nil:
+		return "S"
+	case v.N != nil:
+		return "N"
+	case v.B != nil:
+		return "B"
+	case v.BOOL != nil:
+		return "BOOL"
+	case v.NULL != nil:
+		return "NULL"
+	case v.SS != nil:
+		return "SS"
+	case v.NS != nil:
+		return "NS"
+	case v.BS != nil:
+		return "BS"
+	case v.L != nil:
+		return "L"
+	case v.M != nil:
+		return "M"
+	}
+	return ""
+}
+
+// attrCompare orders two scalar values of the same type. The second return is false if the values
+// can not be compared
+func attrCompare(a, b *dynamodb.AttributeValue) (int, bool) {
+	if a == nil || b == nil {
+		return 0, false
+	}
+	switch {
+	case a.N != nil && b.N != nil:
+		x, ok1 := parseNumber(*a.N)
+		y, ok2 := parseNumber(*b.N)
+		if !ok1 || !ok2 {
+			return 0, false
+		}
+		return x.Cmp(y), true
+	case a.S != nil && b.S != nil:
+		return strings.Compare(*a.S, *b.S), true
+	case a.B != nil && b.B != nil:
+		return bytes.Compare(a.B, b.B), true
+	}
+	return 0, false
+}
+
+// attrEqual compares two values of any type. Sets are compared without regard to order
+func attrEqual(a, b *dynamodb.AttributeValue) bool {
+	if attrType(a) != attrType(b) {
+		return false
+	}
+	switch {
+	case a.S != nil:
+		return *a.S == *b.S
+	case a.N != nil:
+		return numbersEqual(*a.N, *b.N)
+	case a.B != nil:
+		return bytes.Equal(a.B, b.B)
+	case a.BOOL != nil:
+		return *a.BOOL == *b.BOOL
+	case a.NULL != nil:
+		return true
+	case a.SS != nil:
+		return sameSet(setStrings(a), setStrings(b))
+	case a.NS != nil:
+		return sameSet(setStrings(a), setStrings(b))
+	case a.BS != nil:
+		return sameSet(setStrings(a), setStrings(b))
+	case a.L != nil:
+		if len(a.L) != len(b.L) {
+			return false
+		}
+		for i := range a.L {
+			if !attrEqual(a.L[i], b.L[i]) {
+				return false
+			}
+		}
+		return true
+	case a.M != nil:
+		if len(a.M) != len(b.M) {
+			return false
+		}
+		for k, v := range a.M {
+			if o, ok := b.M[k]; !ok || !attrEqual(v, o) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// setStrings returns the members of a set as comparable strings (numbers are normalized)
+func setStrings(v *dynamodb.AttributeValue) []string {
+	var out []string
+	for _, s := range v.SS {
+		out = append(out, *s)
+	}
+	for _, n := range v.NS {
+		if r, ok := parseNumber(*n); ok {
+			out = append(out, r.RatString())
+		} else {
+			out = append(out, *n)
+		}
+	}
+	for _, b := range v.BS {
+		out = append(out, string(b))
+	}
+	return out
+}
+
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	m := make(map[string]bool, len(a))
+	for _, s := range a {
+		m[s] = true
+	}
+	for _, s := range b {
+		if !m[s] {
+			return false
+		}
+	}
+	return true
+}
+
+// copyAttr returns a deep copy of an attribute value
+func copyAttr(v *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if v == nil {
+		return nil
+	}
+	c := &dynamodb.AttributeValue{}
+	if v.S != nil {
+		c.S = strPtr(*v.S)
+	}
+	if v.N != nil {
+		c.N = strPtr(*v.N)
+	}
+	if v.B != nil {
+		c.B = append([]byte{}, v.B...)
+	}
+	if v.BOOL != nil {
+		b := *v.BOOL
+		c.BOOL = &b
+	}
+	if v.NULL != nil {
+		b := *v.NULL
+		c.NULL = &b
+	}
+	for _, s := range v.SS {
+		c.SS = append(c.SS, strPtr(*s))
+	}
+	for _, n := range v.NS {
+		c.NS = append(c.NS, strPtr(*n))
+	}
+	for _, b := range v.BS {
+		c.BS = append(c.BS, append([]byte{}, b...))
+	}
+	if v.L != nil {
+		c.L = make([]*dynamodb.AttributeValue, len(v.L))
+		for i, e := range v.L {
+			c.L[i] = copyAttr(e)
+		}
+	}
+	if v.M != nil {
+		c.M = copyItem(v.M)
+	}
+	return c
+}
+
+func copyItem(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	if item == nil {
+		return nil
+	}
+	c := make(map[string]*dynamodb.AttributeValue, len(item))
+	for k, v := range item {
+		c[k] = copyAttr(v)
+	}
+	return c
+}
+
+// resolvePath finds the value at path in the item, or nil if it does not exist
+func resolvePath(item memItem, path docPath) *dynamodb.AttributeValue {
+	v := item[path[0].name]
+	for _, e := range path[1:] {
+		if v == nil {
+			return nil
+		}
+		if e.isIndex {
+			if v.L == nil || e.index >= len(v.L) {
+				return nil
+			}
+			v = v.L[e.index]
+		} else {
+			if v.M == nil {
+				return nil
+			}
+			v = v.M[e.name]
+		}
+	}
+	return v
+}
+
+func invalidUpdatePath() error {
+	return validationError("The document path provided in the update expression is invalid for update")
+}
+
+// setPath stores val at path. The parent of the path must already exist; setting a list index past
+// the end of the list appends to it
+func setPath(item memItem, path docPath, val *dynamodb.AttributeValue) error {
+	if len(path) == 1 {
+		item[path[0].name] = val
+		return nil
+	}
+	parent := resolvePath(item, path[:len(path)-1])
+	last := path[len(path)-1]
+	switch {
+	case parent == nil:
+		return invalidUpdatePath()
+	case last.isIndex && parent.L != nil:
+		if last.index >= len(parent.L) {
+			parent.L = append(parent.L, val)
+		} else {
+			parent.L[last.index] = val
+		}
+	case !last.isIndex && parent.M != nil:
+		parent.M[last.name] = val
+	default:
+		return invalidUpdatePath()
+	}
+	return nil
+}
+
+// removePath deletes the value at path if it exists. List elements after a removed index shift down
+func removePath(item memItem, path docPath) error {
+	if len(path) == 1 {
+		delete(item, path[0].name)
+		return nil
+	}
+	parent := resolvePath(item, path[:len(path)-1])
+	last := path[len(path)-1]
+	switch {
+	case parent == nil:
+		return nil
+	case last.isIndex && parent.L != nil:
+		if last.index < len(parent.L) {
+			parent.L = append(parent.L[:last.index], parent.L[last.index+1:]...)
+		}
+	case !last.isIndex && parent.M != nil:
+		delete(parent.M, last.name)
+	default:
+		return invalidUpdatePath()
+	}
+	return nil
+}
+
+// applyUpdate runs the update actions against item. All operands are evaluated against the item as
+// it was before the update, as DynamoDB does
+func applyUpdate(item memItem, actions []updateAction) error {
+	orig := memItem(copyItem(item))
+
+	vals := make([]*dynamodb.AttributeValue, len(actions))
+	for i, a := range actions {
+		if a.value == nil {
+			continue
+		}
+		v, err := a.value.value(orig)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			return validationError("The provided expression refers to an attribute that does not exist in the item")
+		}
+		vals[i] = copyAttr(v)
+	}
+
+	// removals from the same list have to run from the highest index down so the
+	// indexes refer to the original positions
+	order := make([]int, len(actions))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(x, y int) bool {
+		a, b := actions[order[x]], actions[order[y]]
+		if a.clause != "REMOVE" || b.clause != "REMOVE" {
+			return false
+		}
+		la, lb := a.path[len(a.path)-1], b.path[len(b.path)-1]
+		return la.isIndex && lb.isIndex && la.index > lb.index
+	})
+
+	for _, i := range order {
+		a := actions[i]
+		var err error
+		switch a.clause {
+		case "SET":
+			err = setPath(item, a.path, vals[i])
+		case "REMOVE":
+			err = removePath(item, a.path)
+		case "ADD":
+			err = addToPath(item, a.path, vals[i])
+		case "DELETE":
+			err = deleteFromPath(item, a.path, vals[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addToPath(item memItem, path docPath, val *dynamodb.AttributeValue) error {
+	cur := resolvePath(item, path)
+	if cur == nil {
+		if val.N == nil && val.SS == nil && val.NS == nil && val.BS == nil {
+			return validationError("Invalid UpdateExpression: Incorrect operand type for operator or function; operator: ADD")
+		}
+		return setPath(item, path, val)
+	}
+	switch {
+	case cur.N != nil && val.N != nil:
+		x, ok1 := parseNumber(*cur.N)
+		y, ok2 := parseNumber(*val.N)
+		if !ok1 || !ok2 {
+			return validationError("A value provided cannot be converted into a number")
+		}
+		cur.N = strPtr(formatNumber(x.Add(x, y)))
+	case cur.SS != nil && val.SS != nil:
+		cur.SS = unionSet(cur.SS, val.SS, false)
+	case cur.NS != nil && val.NS != nil:
+		cur.NS = unionSet(cur.NS, val.NS, true)
+	case cur.BS != nil && val.BS != nil:
+		for _, b := range val.BS {
+			found := false
+			for _, e := range cur.BS {
+				if bytes.Equal(b, e) {
+					found = true
+				}
+			}
+			if !found {
+				cur.BS = append(cur.BS, b)
+			}
+		}
+	default:
+		return validationError("Invalid UpdateExpression: Incorrect operand type for operator or function; operator: ADD")
+	}
+	return nil
+}
+
+func deleteFromPath(item memItem, path docPath, val *dynamodb.AttributeValue) error {
+	cur := resolvePath(item, path)
+	if cur == nil {
+		return nil
+	}
+	switch {
+	case cur.SS != nil && val.SS != nil:
+		cur.SS = subtractSet(cur.SS, val.SS, false)
+	case cur.NS != nil && val.NS != nil:
+		cur.NS = subtractSet(cur.NS, val.NS, true)
+	case cur.BS != nil && val.BS != nil:
+		var keep [][]byte
+		for _, e := range cur.BS {
+			found := false
+			for _, b := range val.BS {
+				if bytes.Equal(b, e) {
+					found = true
+				}
+			}
+			if !found {
+				keep = append(keep, e)
+			}
+		}
+		cur.BS = keep
+	default:
+		return validationError("Invalid UpdateExpression: Incorrect operand type for operator or function; operator: DELETE")
+	}
+	// DynamoDB does not store empty sets
+	if cur.SS == nil && cur.NS == nil && cur.BS == nil {
+		return removePath(item, path)
+	}
+	return nil
+}
+
+func setMember(s string, numeric bool) string {
+	if numeric {
+		if r, ok := parseNumber(s); ok {
+			return r.RatString()
+		}
+	}
+	return s
+}
+
+func unionSet(cur, add []*string, numeric bool) []*string {
+	have := make(map[string]bool)
+	for _, s := range cur {
+		have[setMember(*s, numeric)] = true
+	}
+	for _, s := range add {
+		if !have[setMember(*s, numeric)] {
+			have[setMember(*s, numeric)] = true
+			cur = append(cur, strPtr(*s))
+		}
+	}
+	return cur
+}
+
+func subtractSet(cur, del []*string, numeric bool) []*string {
+	drop := make(map[string]bool)
+	for _, s := range del {
+		drop[setMember(*s, numeric)] = true
+	}
+	var keep []*string
+	for _, s := range cur {
+		if !drop[setMember(*s, numeric)] {
+			keep = append(keep, s)
+		}
+	}
+	return keep
+}
+
+// project returns a copy of the item containing only the given paths
+func project(item memItem, paths []docPath) memItem {
+	out := make(memItem)
+	for _, path := range paths {
+		v := resolvePath(item, path)
+		if v == nil {
+			continue
+		}
+		projectInto(out, item, path, copyAttr(v))
+	}
+	return out
+}
+
+// projectInto copies the structure leading to path from src into dst, then stores v at the end of it.
+// Projected list elements are compacted in the order they are requested
+func projectInto(dst memItem, src memItem, path docPath, v *dynamodb.AttributeValue) {
+	if len(path) == 1 {
+		dst[path[0].name] = v
+		return
+	}
+	root, ok := dst[path[0].name]
+	if !ok {
+		root = emptyLike(src[path[0].name])
+		dst[path[0].name] = root
+	}
+	cur := root
+	srcCur := src[path[0].name]
+	for i, e := range path[1:] {
+		last := i == len(path)-2
+		var srcNext *dynamodb.AttributeValue
+		if e.isIndex {
+			srcNext = srcCur.L[e.index]
+		} else {
+			srcNext = srcCur.M[e.name]
+		}
+		if last {
+			if e.isIndex {
+				cur.L = append(cur.L, v)
+			} else {
+				cur.M[e.name] = v
+			}
+			return
+		}
+		var next *dynamodb.AttributeValue
+		if e.isIndex {
+			next = emptyLike(srcNext)
+			cur.L = append(cur.L, next)
+		} else {
+			if next = cur.M[e.name]; next == nil {
+				next = emptyLike(srcNext)
+				cur.M[e.name] = next
+			}
+		}
+		cur = next
+		srcCur = srcNext
+	}
+}
+
+func emptyLike(v *dynamodb.AttributeValue) *dynamodb.AttributeValue {
+	if v.L != nil {
+		return &dynamodb.AttributeValue{L: []*dynamodb.AttributeValue{}}
+	}
+	return &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{}}
+}
@@ -0,0 +1,364 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	godba "github.com/sethjback/godba/errors"
+)
+
+// a single operation in an rfc6902 JSON Patch document
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// AddPatch translates an rfc6902 JSON Patch document into the request's Updates. add, remove, replace,
+// move and copy become update values, and test, along with the existence checks the rfc requires, become
+// RequestConditions.
+// The whole patch is sent as a single update, so every operation sees the item as it was before the
+// patch: operations can not depend on each other and must not change overlapping paths.
+// Numeric path segments are list indexes or map members depending on the item, so a patch that has
+// them reads the item when it runs, and can not be used in an Atomic transaction
+func (r *Request) AddPatch(patch []byte) error {
+	var ops []patchOperation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return dbError(godba.ErrorUpdateOperation, "", r.Table, "Invalid patch", err)
+	}
+	r.patch = true
+
+	// the request's own conditions are grouped, so an Or among them can not bypass the patch's checks
+	conditions := r.RequestConditions
+	r.RequestConditions = nil
+	defer func() {
+		if len(conditions) != 0 && len(r.RequestConditions) != 0 {
+			r.RequestConditions = append([]RequestCondition{RequestCondition{Group: conditions}}, r.RequestConditions...)
+		} else if len(conditions) != 0 {
+			r.RequestConditions = conditions
+		}
+	}()
+
+	for i, op := range ops {
+		if err := r.addPatchOperation(op); err != nil {
+			return dbError(godba.ErrorUpdateOperation, "", r.Table, "Invalid patch", errors.New("operation "+strconv.Itoa(i)+": "+err.Error()))
+		}
+	}
+
+	return nil
+}
+
+func (r *Request) addPatchOperation(op patchOperation) error {
+	if !strings.HasPrefix(op.Path, "/") {
+		return errors.New("path " + op.Path + " must start with /")
+	}
+	if op.From != "" && !strings.HasPrefix(op.From, "/") {
+		return errors.New("from " + op.From + " must start with /")
+	}
+
+	switch op.Op {
+	case "add", "replace", "test":
+		value, err := patchValue(op.Value)
+		if err != nil {
+			return err
+		}
+		switch op.Op {
+		case "add":
+			// resolvePatch makes an add at a list index an Insert
+			r.AddUpdateValue(op.Path, Put, value)
+		case "replace":
+			r.And(op.Path, Exist, nil)
+			r.AddUpdateValue(op.Path, Update, value)
+		case "test":
+			r.And(op.Path, Equal, value)
+		}
+	case "remove":
+		r.And(op.Path, Exist, nil)
+		r.AddUpdateValue(op.Path, Delete, nil)
+	case "move", "copy":
+		if op.From == "" {
+			return errors.New(op.Op + " requires from")
+		}
+		if op.Op == "move" && strings.HasPrefix(op.Path+"/", op.From+"/") {
+			return errors.New("can not move " + op.From + " into itself")
+		}
+		r.And(op.From, Exist, nil)
+		r.Updates = append(r.Updates, UpdateValue{Action: Put, Path: op.Path, From: op.From})
+		if op.Op == "move" {
+			r.AddUpdateValue(op.From, Delete, nil)
+		}
+	default:
+		return errors.New("unknown op " + op.Op)
+	}
+
+	return nil
+}
+
+// resolvePatch resolves the numeric path segments of a patch against the current item. Paths always read
+// them as list indexes, but in rfc6901 they name a map member when the parent is a map.
+// An add at a list index becomes an Insert. A map with a numeric member in a path is updated as a whole,
+// like resolveInserts does for lists, and the patch's conditions on its members are checked against the
+// item read, guarded by a condition that the map has not changed since
+func resolvePatch(ctx context.Context, db DBer, r Request, key map[string]*dynamodb.AttributeValue) (Request, error) {
+	numeric := false
+	for _, v := range r.Updates {
+		numeric = numeric || hasIndex(v.Path) || hasIndex(v.From)
+	}
+	for _, c := range r.RequestConditions {
+		numeric = numeric || hasIndex(c.Field)
+	}
+	if !numeric {
+		return r, nil
+	}
+
+	out, e := db.GetItemWithContext(ctx, &dynamodb.GetItemInput{TableName: aws.String(r.Table), Key: key, ConsistentRead: aws.Bool(true)})
+	if e != nil {
+		return r, dbError(godba.ErrorGetItem, "GetItem", r.Table, "Could not read the item to patch", e)
+	}
+	item := out.Item
+
+	invalid := func(err error) (Request, error) {
+		return r, dbError(godba.ErrorUpdateExpression, "UpdateItem", r.Table, "Could not update item", err)
+	}
+
+	var guards []RequestCondition
+	guarded := make(map[string]bool)
+	guard := func(path string) {
+		if !guarded[path] {
+			guarded[path] = true
+			old, _ := attributeAtPath(item, path)
+			guards = append(guards, RequestCondition{Field: path, Type: Equal, Value: old, Relationship: And})
+		}
+	}
+
+	var conditions []RequestCondition
+	for i, c := range r.RequestConditions {
+		path, ok := numericMember(item, c.Field)
+		// the patch's own conditions are all joined by And, others are left as they are
+		or := c.Relationship == Or || (i+1 < len(r.RequestConditions) && r.RequestConditions[i+1].Relationship == Or)
+		if !ok || c.Group != nil || or {
+			conditions = append(conditions, c)
+			continue
+		}
+		if path == "/" {
+			return invalid(errors.New("Invalid condition: " + c.Field + " is a numeric attribute name"))
+		}
+
+		v, exists := attributeAtPath(item, c.Field)
+		var holds bool
+		switch c.Type {
+		case Exist:
+			holds = exists
+		case NotExist:
+			holds = !exists
+		case Equal:
+			av, err := encodeValue(c.Value)
+			if err != nil {
+				return r, dbError(godba.ErrorMarshalItem, "UpdateItem", r.Table, "Could not update item", err)
+			}
+			holds = exists && attrEqual(v, av)
+		default:
+			return invalid(errors.New("Invalid condition: " + c.Type.String() + " on the numeric map member " + c.Field))
+		}
+		if holds == c.Negate {
+			return r, dbError(godba.ErrorConditionFailed, "UpdateItem", r.Table, "Could not update item", errors.New("the condition on "+c.Field+" does not hold"))
+		}
+		guard(path)
+	}
+
+	updates := make([]UpdateValue, 0, len(r.Updates))
+	maps := make(map[string]*dynamodb.AttributeValue) // the updated copies of the maps with numeric members
+	for _, v := range r.Updates {
+		path, member := numericMember(item, v.Path)
+		_, fromMember := numericMember(item, v.From)
+		parent, _ := attributeAtPath(item, v.Path[:strings.LastIndex(v.Path, "/")])
+		insert := v.Action == Put && !member && isIndex(v.Path[strings.LastIndex(v.Path, "/")+1:]) && parent != nil && parent.L != nil
+
+		if v.From != "" && (member || fromMember || insert) {
+			// the value is read from the item, an update of the whole map can not refer to another path
+			fv, ok := attributeAtPath(item, v.From)
+			if !ok {
+				return r, dbError(godba.ErrorConditionFailed, "UpdateItem", r.Table, "Could not update item", errors.New(v.From+" does not exist"))
+			}
+			v = UpdateValue{Action: v.Action, Path: v.Path, Value: fv}
+		}
+
+		switch {
+		case member:
+			if path == "/" {
+				return invalid(errors.New("Invalid update: " + v.Path + " is a numeric attribute name"))
+			}
+			m, ok := maps[path]
+			if !ok {
+				old, _ := attributeAtPath(item, path)
+				m = copyAttr(old)
+				maps[path] = m
+				guard(path)
+				updates = append(updates, UpdateValue{Action: Put, Path: path, Value: m})
+			}
+			if err := applyPatchUpdate(m, strings.Split(v.Path[len(path):], "/")[1:], v); err != nil {
+				return invalid(err)
+			}
+		case insert:
+			// adding at a list index shifts the rest of the list
+			v.Action = Insert
+			updates = append(updates, v)
+		default:
+			updates = append(updates, v)
+		}
+	}
+
+	r.Updates = updates
+	r.RequestConditions = append(conditions, guards...)
+	return r, nil
+}
+
+// hasIndex reports whether a path has a numeric segment
+func hasIndex(path string) bool {
+	if !strings.HasPrefix(path, "/") {
+		return false
+	}
+	for _, seg := range strings.Split(path, "/")[1:] {
+		if isIndex(seg) {
+			return true
+		}
+	}
+	return false
+}
+
+// numericMember returns the path of the first map in item that path reaches a member with a numeric name
+// of, "/" for the item itself. ok is false if there is none, as far as the path exists
+func numericMember(item map[string]*dynamodb.AttributeValue, path string) (string, bool) {
+	if !strings.HasPrefix(path, "/") {
+		return "", false
+	}
+	cur := &dynamodb.AttributeValue{M: item}
+	segs := strings.Split(path, "/")[1:]
+	for i, seg := range segs {
+		switch {
+		case cur.M != nil:
+			if isIndex(seg) {
+				return "/" + strings.Join(segs[:i], "/"), true
+			}
+			cur = cur.M[unescapePathSegment(seg)]
+		case cur.L != nil:
+			n, err := strconv.Atoi(seg)
+			if err != nil || n < 0 || n >= len(cur.L) {
+				return "", false
+			}
+			cur = cur.L[n]
+		default:
+			return "", false
+		}
+		if cur == nil {
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// applyPatchUpdate applies a Put, Update, Insert or Delete to the value at segs inside v, a copy being
+// updated as a whole. Segments are map members or list indexes depending on what they are in
+func applyPatchUpdate(v *dynamodb.AttributeValue, segs []string, u UpdateValue) error {
+	for _, seg := range segs[:len(segs)-1] {
+		switch {
+		case v.M != nil:
+			v = v.M[unescapePathSegment(seg)]
+		case v.L != nil:
+			n, err := strconv.Atoi(seg)
+			if err != nil || n < 0 || n >= len(v.L) {
+				return errors.New("Invalid update: " + u.Path + " does not exist")
+			}
+			v = v.L[n]
+		default:
+			v = nil
+		}
+		if v == nil {
+			return errors.New("Invalid update: " + u.Path + " does not exist")
+		}
+	}
+
+	var value *dynamodb.AttributeValue
+	if u.Action != Delete {
+		av, err := encodeValue(u.Value)
+		if err != nil {
+			return errors.New("Unable to marshal item: " + err.Error())
+		}
+		value = av
+	}
+
+	last := segs[len(segs)-1]
+	switch {
+	case v.M != nil:
+		switch u.Action {
+		case Put, Update, Insert:
+			v.M[unescapePathSegment(last)] = value
+		case Delete:
+			delete(v.M, unescapePathSegment(last))
+		default:
+			return errors.New("Invalid update at " + u.Path + ": only patch operations can change a map with numeric members")
+		}
+	case v.L != nil:
+		n, err := strconv.Atoi(last)
+		if last == "-" {
+			n, err = len(v.L), nil
+		}
+		if err != nil || n < 0 || n > len(v.L) || (n == len(v.L) && u.Action != Put && u.Action != Insert) {
+			return errors.New("Invalid update: " + u.Path + " is not a list index")
+		}
+		switch u.Action {
+		case Put, Insert:
+			// patches add to lists by inserting
+			v.L = append(v.L[:n], append([]*dynamodb.AttributeValue{value}, v.L[n:]...)...)
+		case Update:
+			v.L[n] = value
+		case Delete:
+			v.L = append(v.L[:n], v.L[n+1:]...)
+		default:
+			return errors.New("Invalid update at " + u.Path + ": only patch operations can change a map with numeric members")
+		}
+	default:
+		return errors.New("Invalid update: " + u.Path + " is not in a map or list")
+	}
+	return nil
+}
+
+// patchValue decodes the value of an operation. Numbers are kept as their json text so they are
+// stored exactly
+func patchValue(raw json.RawMessage) (interface{}, error) {
+	if len(raw) == 0 {
+		return nil, errors.New("value is required")
+	}
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return patchNumbers(v), nil
+}
+
+// patchNumbers converts the json.Numbers in a decoded value, which would be encoded as strings, to dynamodb numbers
+func patchNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		return dynamodbattribute.Number(t)
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = patchNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = patchNumbers(e)
+		}
+	}
+	return v
+}
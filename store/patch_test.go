@@ -0,0 +1,70 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	godba "github.com/sethjback/godba/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddPatch(t *testing.T) {
+	assert := assert.New(t)
+
+	r := Request{Table: "test", Action: Update}
+	err := r.AddPatch([]byte(`[
+		{"op": "test", "path": "/version", "value": 3},
+		{"op": "add", "path": "/tags/-", "value": "new"},
+		{"op": "add", "path": "/list/1", "value": {"a": [1.5, "b"]}},
+		{"op": "add", "path": "/name", "value": null},
+		{"op": "remove", "path": "/old"},
+		{"op": "replace", "path": "/a~1b", "value": true},
+		{"op": "move", "from": "/src", "path": "/dst"},
+		{"op": "copy", "from": "/c1", "path": "/c2"}
+	]`))
+	assert.Nil(err)
+
+	assert.Equal([]UpdateValue{
+		UpdateValue{Action: Put, Path: "/tags/-", Value: "new"},
+		UpdateValue{Action: Put, Path: "/list/1", Value: map[string]interface{}{"a": []interface{}{dynamodbattribute.Number("1.5"), "b"}}},
+		UpdateValue{Action: Put, Path: "/name"},
+		UpdateValue{Action: Delete, Path: "/old"},
+		UpdateValue{Action: Update, Path: "/a~1b", Value: true},
+		UpdateValue{Action: Put, Path: "/dst", From: "/src"},
+		UpdateValue{Action: Delete, Path: "/src"},
+		UpdateValue{Action: Put, Path: "/c2", From: "/c1"}}, r.Updates)
+
+	assert.Equal([]RequestCondition{
+		RequestCondition{Field: "/version", Type: Equal, Value: dynamodbattribute.Number("3")},
+		RequestCondition{Field: "/old", Type: Exist},
+		RequestCondition{Field: "/a~1b", Type: Exist},
+		RequestCondition{Field: "/src", Type: Exist},
+		RequestCondition{Field: "/c1", Type: Exist}}, r.RequestConditions)
+
+	// the request's own conditions are grouped so an Or among them can not bypass the patch's checks
+	r = Request{Table: "test", Action: Update}
+	r.And("role", Equal, "admin").Or("role", Equal, "user")
+	own := r.RequestConditions
+	assert.Nil(r.AddPatch([]byte(`[{"op": "test", "path": "/name", "value": "alice"}]`)))
+	assert.Equal([]RequestCondition{
+		RequestCondition{Group: own},
+		RequestCondition{Field: "/name", Type: Equal, Value: "alice"}}, r.RequestConditions)
+
+	r = Request{Table: "test", Action: Update}
+	r.And("role", Equal, "admin")
+	assert.Nil(r.AddPatch([]byte(`[{"op": "add", "path": "/name", "value": "alice"}]`)))
+	assert.Equal([]RequestCondition{RequestCondition{Field: "role", Type: Equal, Value: "admin"}}, r.RequestConditions)
+
+	invalid := []string{
+		`{"op": "add"}`,
+		`[{"op": "add", "path": "/a"}]`,
+		`[{"op": "add", "path": "a", "value": 1}]`,
+		`[{"op": "move", "path": "/a"}]`,
+		`[{"op": "move", "from": "/a", "path": "/a/b"}]`,
+		`[{"op": "merge", "path": "/a", "value": 1}]`}
+	for _, p := range invalid {
+		r = Request{Table: "test", Action: Update}
+		err = r.AddPatch([]byte(p))
+		assert.Equal(godba.ErrorUpdateOperation, godba.Code(err), p)
+	}
+}
@@ -1,8 +1,17 @@
 package store
 
+import (
+	"errors"
+	"reflect"
+	"strconv"
+
+	godba "github.com/sethjback/godba/errors"
+)
+
 type Action int32
 type Condition int32
 type Relationship int32
+type ReturnValue int32
 
 // Actions
 const (
@@ -12,8 +21,48 @@ const (
 	Delete
 	Query
 	QueryPager
+	Scan
+	ParallelScan
+	BatchGet
+	BatchWrite
+	TransactGet
+
+	// update actions, for UpdateValue.Action in addition to Put, Update and Delete
+	Increment      // add a number to the attribute, which starts at 0 if missing
+	Decrement      // subtract a number from the attribute, which starts at 0 if missing
+	AddToSet       // add values to a string, number or binary set, creating it if missing
+	RemoveFromSet  // remove values from a set
+	SetIfNotExists // set the attribute only if it does not exist yet
+	Append         // add to the end of a list, creating it if missing. The elements of a slice are added individually
+	Prepend        // add to the start of a list, creating it if missing. The elements of a slice are added individually
+	Insert         // insert a single value before the list index at the end of the path
+)
+
+// ReturnValues
+const (
+	None       ReturnValue = iota
+	AllOld                 // the whole item as it was before the request
+	UpdatedOld             // for Update, the old values of the updated attributes
+	AllNew                 // for Update, the whole item after the update
+	UpdatedNew             // for Update, the new values of the updated attributes
 )
 
+var returnValueNames = map[ReturnValue]string{
+	None:       "NONE",
+	AllOld:     "ALL_OLD",
+	UpdatedOld: "UPDATED_OLD",
+	AllNew:     "ALL_NEW",
+	UpdatedNew: "UPDATED_NEW",
+}
+
+// String returns the dynamodb name of the setting
+func (r ReturnValue) String() string {
+	if n, ok := returnValueNames[r]; ok {
+		return n
+	}
+	return "ReturnValue(" + strconv.Itoa(int(r)) + ")"
+}
+
 // Conditions
 const (
 	Exist Condition = iota
@@ -22,8 +71,42 @@ const (
 	LessThan
 	Equal
 	BeginsWith
+	NotEqual
+	GreaterOrEqual
+	LessOrEqual
+	Between         // Value is a slice of the lower and upper bound, inclusive
+	In              // Value is a slice of up to 100 values
+	Contains        // the string attribute contains the substring, or the set or list contains the value
+	SizeGreaterThan // Value is an int compared with the size of the string, binary, set, list or map
+	SizeEquals
+	AttributeType // Value is a dynamodb type: S, SS, N, NS, B, BS, BOOL, NULL, L or M
 )
 
+var conditionNames = map[Condition]string{
+	Exist:           "Exist",
+	NotExist:        "NotExist",
+	GreaterThan:     "GreaterThan",
+	LessThan:        "LessThan",
+	Equal:           "Equal",
+	BeginsWith:      "BeginsWith",
+	NotEqual:        "NotEqual",
+	GreaterOrEqual:  "GreaterOrEqual",
+	LessOrEqual:     "LessOrEqual",
+	Between:         "Between",
+	In:              "In",
+	Contains:        "Contains",
+	SizeGreaterThan: "SizeGreaterThan",
+	SizeEquals:      "SizeEquals",
+	AttributeType:   "AttributeType",
+}
+
+func (c Condition) String() string {
+	if n, ok := conditionNames[c]; ok {
+		return n
+	}
+	return "Condition(" + strconv.Itoa(int(c)) + ")"
+}
+
 // Relsationships
 const (
 	And Relationship = iota
@@ -37,24 +120,67 @@ type Request struct {
 	Key               map[string]interface{} // The index for the item
 	Item              map[string]interface{} // For PUT operations the data to insert into the database
 	Updates           []UpdateValue          // For Update operations, the updates to perform
+	Batch             []Request              // For BatchGet and TransactGet the Get requests, for BatchWrite the Put and Delete requests, to run together
 	PageSize          int                    // size of the pages to return
 	Page              int                    // For query, limit the results to this number
 	Index             string                 // the index to use
-	ReturnValues      string
+	ReturnValues      ReturnValue            // For Put, Update and Delete, the attributes to return. See Result.GetAttributes
 	ConsistentRead    bool
 	LiveData          bool
-	Limit             int
-	LastKey           map[string]interface{} // For queries that were limited, the last evaluated key
+	Limit             int                    // For queries, the maximum number of items to evaluate
+	Segment           int                    // For Scan, the segment to read when TotalSegments is set
+	TotalSegments     int                    // For Scan and ParallelScan, the number of segments to split the table into
+	Workers           int                    // For ParallelScan, the number of segments read concurrently. Defaults to TotalSegments
+	LastKey           map[string]interface{} // For queries that were limited, the last evaluated key (see Result.GetLastEvaluatedKey)
+	Cursor            string                 // For queries that were limited, a signed cursor from Result.GetCursor. Takes precedence over LastKey
 	RequestConditions []RequestCondition
-	ResultFitler      []RequestCondition
+	Projection        []string           // For Get, Query, Scan, BatchGet and TransactGet, the attribute names or rfc6901 paths to read. Defaults to the whole item
+	Version           int                // For Put and Update with a datastore Version attribute, the version the item had when it was read. 0 for new items
+	ResultFitler      []RequestCondition // For Query, QueryPager and Scan, conditions the returned items must match
+	patch             bool               // set by AddPatch, numeric path segments are resolved against the item, see resolvePatch
+	source            interface{}        // set by SetItemFrom, the struct the item was marshalled from. Its times are encoded with the datastore's TimeEncoding
 }
 
-// RequestCondition specifies conditions that must be true for the request to take place
+// RequestCondition specifies conditions that must be true for the request to take place.
+// Conditions are joined to the one before them by their Relationship. A condition with a Group is the
+// group's conditions in parentheses, which is how (a AND b) OR c is expressed
 type RequestCondition struct {
 	Field        string
 	Type         Condition
 	Relationship Relationship
 	Value        interface{}
+	Group        []RequestCondition // when set, Field, Type and Value are ignored
+	Negate       bool               // the condition must not be true
+}
+
+// Where returns a single condition, for use in a group
+func Where(field string, condition Condition, value interface{}) RequestCondition {
+	return RequestCondition{Field: field, Type: condition, Value: value}
+}
+
+// AllOf groups conditions that must all be true
+func AllOf(conditions ...RequestCondition) RequestCondition {
+	return group(And, conditions)
+}
+
+// AnyOf groups conditions where at least one must be true
+func AnyOf(conditions ...RequestCondition) RequestCondition {
+	return group(Or, conditions)
+}
+
+func group(relationship Relationship, conditions []RequestCondition) RequestCondition {
+	g := make([]RequestCondition, len(conditions))
+	for i, c := range conditions {
+		c.Relationship = relationship
+		g[i] = c
+	}
+	return RequestCondition{Group: g}
+}
+
+// Not negates a condition or group
+func Not(c RequestCondition) RequestCondition {
+	c.Negate = !c.Negate
+	return c
 }
 
 func (r RequestCondition) RelationshipString() string {
@@ -73,6 +199,7 @@ type UpdateValue struct {
 	Action Action
 	Path   string
 	Value  interface{}
+	From   string // for Put and Update, the path of an attribute whose value is copied instead of Value
 }
 
 // AddKey adds a RequestItem to the Key and returns the request
@@ -93,21 +220,74 @@ func (r *Request) AddItem(name string, value interface{}) *Request {
 	return r
 }
 
+// SetItemFrom marshals a struct into the request. Fields tagged with key are added to the Key,
+// everything else replaces the Item
+func (r *Request) SetItemFrom(v interface{}) error {
+	av, err := structEncoder().Encode(v)
+	if err != nil {
+		return dbError(godba.ErrorMarshalItem, "", r.Table, "Could not marshal item", err)
+	}
+	if av.M == nil {
+		return dbError(godba.ErrorMarshalItem, "", r.Table, "Could not marshal item", errors.New("SetItemFrom requires a struct or map"))
+	}
+
+	keys := keyFields(reflect.ValueOf(v))
+	r.source = v
+	r.Item = make(map[string]interface{})
+	for name, attr := range av.M {
+		if kv, ok := keys[name]; ok {
+			r.AddKey(name, kv)
+			continue
+		}
+		// the attribute value is passed through by marshalItems as is, which keeps set types intact
+		r.Item[name] = attr
+	}
+
+	return nil
+}
+
+// AddBatch adds a request to the batch
+func (r *Request) AddBatch(request Request) *Request {
+	r.Batch = append(r.Batch, request)
+	return r
+}
+
 // AddCondition adds a request condition
 func (r *Request) AddCondition(field string, condition Condition, relationship Relationship, value interface{}) *Request {
-	r.RequestConditions = append(r.RequestConditions, RequestCondition{field, condition, relationship, value})
+	r.RequestConditions = append(r.RequestConditions, RequestCondition{Field: field, Type: condition, Relationship: relationship, Value: value})
 	return r
 }
 
 // And adds a request "and" condition
 func (r *Request) And(field string, condition Condition, value interface{}) *Request {
-	r.RequestConditions = append(r.RequestConditions, RequestCondition{field, condition, And, value})
+	r.RequestConditions = append(r.RequestConditions, RequestCondition{Field: field, Type: condition, Relationship: And, Value: value})
 	return r
 }
 
 // And adds a request "or" condition
 func (r *Request) Or(field string, condition Condition, value interface{}) *Request {
-	r.RequestConditions = append(r.RequestConditions, RequestCondition{field, condition, Or, value})
+	r.RequestConditions = append(r.RequestConditions, RequestCondition{Field: field, Type: condition, Relationship: Or, Value: value})
+	return r
+}
+
+// AndWhere adds a condition or group built with Where, AllOf, AnyOf or Not, joined with "and"
+func (r *Request) AndWhere(c RequestCondition) *Request {
+	c.Relationship = And
+	r.RequestConditions = append(r.RequestConditions, c)
+	return r
+}
+
+// OrWhere adds a condition or group built with Where, AllOf, AnyOf or Not, joined with "or"
+func (r *Request) OrWhere(c RequestCondition) *Request {
+	c.Relationship = Or
+	r.RequestConditions = append(r.RequestConditions, c)
+	return r
+}
+
+// Filter adds a condition or group to the ResultFitler, joined with "and"
+func (r *Request) Filter(c RequestCondition) *Request {
+	c.Relationship = And
+	r.ResultFitler = append(r.ResultFitler, c)
 	return r
 }
 
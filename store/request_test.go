@@ -3,6 +3,7 @@ package store
 import (
 	"testing"
 
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -54,3 +55,62 @@ func TestAdd(t *testing.T) {
 	assert.Equal(1, i)
 
 }
+
+type testAccount struct {
+	ID      string   `godba:"id,key"`
+	Name    string   `godba:"name"`
+	Balance int      `godba:"balance,omitempty"`
+	Tags    []string `godba:"tags,stringset,omitempty"`
+	Secret  string   `godba:"-"`
+}
+
+func TestSetItemFrom(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &Request{}
+	err := r.SetItemFrom(testAccount{ID: "a1", Name: "bob", Tags: []string{"x"}, Secret: "s"})
+	assert.Nil(err)
+	assert.Equal(map[string]interface{}{"id": "a1"}, r.Key)
+	assert.Len(r.Item, 2)
+	assert.Contains(r.Item, "name")
+	assert.Contains(r.Item, "tags")
+
+	item, err := marshalItems(r.Item)
+	if assert.Nil(err) {
+		assert.Equal("bob", *item["name"].S)
+		assert.Len(item["tags"].SS, 1)
+	}
+
+	assert.NotNil(r.SetItemFrom("not a struct"))
+}
+
+func TestConditionTree(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &Request{}
+	r.And("a", Equal, 1).
+		OrWhere(AllOf(Where("b", Equal, 2), Not(Where("c", Exist, nil)))).
+		AndWhere(Not(AnyOf(Where("d", Equal, 3), Where("e", Equal, 4))))
+
+	vals := make(map[string]*dynamodb.AttributeValue)
+	names := make(map[string]*string)
+	exp, err := buildConditionExpression(r.RequestConditions, vals, names)
+	assert.Nil(err)
+	assert.Equal("#ename0 = :val0 OR (#ename1 = :val1 AND NOT (attribute_exists(#ename2))) AND NOT (#ename3 = :val2 OR #ename4 = :val3)", exp)
+	assert.Len(vals, 4)
+	assert.Len(names, 5)
+	assert.Equal("e", *names["#ename4"])
+	assert.Equal("3", *vals[":val2"].N)
+
+	r = &Request{}
+	r.Filter(AnyOf())
+	_, err = buildConditionExpression(r.ResultFitler, vals, names)
+	assert.NotNil(err)
+}
+
+func TestReturnValueString(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("NONE", None.String())
+	assert.Equal("UPDATED_NEW", UpdatedNew.String())
+	assert.Equal("ReturnValue(9)", ReturnValue(9).String())
+}
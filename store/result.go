@@ -20,12 +20,36 @@ type Result interface {
 	// UnmarshalItem attemps to translate item into the interface, second argument indicates if the item was found
 	UnmarshalItem(int, string, interface{}) (error, bool)
 
+	// UnmarshalRow decodes a whole item into a struct, using `godba` struct tags for the attribute names
+	UnmarshalRow(int, interface{}) error
+
+	// UnmarshalAll decodes every item into a pointer to a slice of structs
+	UnmarshalAll(interface{}) error
+
+	// GetAttributes returns the attributes returned by a Put, Update or Delete, see Request.ReturnValues
+	GetAttributes() map[string]interface{}
+
+	// GetAttribute returns a single returned attribute, second argument indicates if it was returned
+	GetAttribute(string) (interface{}, bool)
+
+	// GetNumberAttribute returns a returned attribute as an int, second argument indicates if it was returned
+	GetNumberAttribute(string) (int, bool)
+
+	// UnmarshalAttributes decodes the returned attributes into a struct, using `godba` struct tags for the attribute names
+	UnmarshalAttributes(interface{}) error
+
+	// GetVersion returns an item's optimistic locking version, second argument indicates if the item has one
+	GetVersion(int) (int, bool)
+
 	// GetItemCount returns the item count
 	GetItemCount() int
 
 	// GetLastEvaluatedKey returns the last evaluated key from a request
 	GetLastEvaluatedKey() map[string]interface{}
 
+	// GetCursor returns an opaque, signed token for the last evaluated key that can be sent back as Request.Cursor
+	GetCursor() string
+
 	// PageCount returns the total number of pages for a query pages result
 	PageCount() int
 }
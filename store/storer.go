@@ -1,11 +1,15 @@
 package store
 
+import "context"
+
 type Storer interface {
 	Run(request Request) (Result, error)
-	StartTransaction()
-	FinishTransaction()
-	Rollback() []error
+	RunContext(ctx context.Context, request Request) (Result, error)
+	StartTransaction() Tx
+	Recover() []error
+	RecoverContext(ctx context.Context) []error
 	ClearCache()
 	CacheOff()
 	CacheOn()
+	CacheStats() CacheStats
 }
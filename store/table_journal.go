@@ -0,0 +1,144 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// TableJournal is a Journal kept in a dynamodb table with a string hash key named journal and a string
+// range key named entry. Several journals can share the table as long as they have different names, and
+// processes that run at the same time need their own name
+type TableJournal struct {
+	db    DBer
+	table string
+	name  string
+	mu    sync.Mutex
+	seq   map[string]int
+}
+
+// NewTableJournal returns the journal called name in table. db is usually a *dynamodb.DynamoDB
+func NewTableJournal(db DBer, table, name string) *TableJournal {
+	return &TableJournal{db: db, table: table, name: name, seq: make(map[string]int)}
+}
+
+// Begin starts a transaction. Nothing is written until its first entry
+func (j *TableJournal) Begin(ctx context.Context) (string, error) {
+	tx, err := newTransactionID()
+	if err != nil {
+		return "", err
+	}
+	j.mu.Lock()
+	j.seq[tx] = 0
+	j.mu.Unlock()
+	return tx, nil
+}
+
+// Append puts the entry in the table. Its range key is the transaction id and a sequence number, so a
+// transaction's entries sort in the order they were appended
+func (j *TableJournal) Append(ctx context.Context, tx string, entry JournalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	seq := j.seq[tx]
+	j.seq[tx] = seq + 1
+	j.mu.Unlock()
+
+	_, err = j.db.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(j.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			"journal": &dynamodb.AttributeValue{S: aws.String(j.name)},
+			"entry":   &dynamodb.AttributeValue{S: aws.String(fmt.Sprintf("%s#%010d", tx, seq))},
+			"data":    &dynamodb.AttributeValue{S: aws.String(string(data))}}})
+	return err
+}
+
+// items reads the journal's items, or a single transaction's when tx is set
+func (j *TableJournal) items(ctx context.Context, tx string) ([]map[string]*dynamodb.AttributeValue, error) {
+	in := &dynamodb.QueryInput{
+		TableName:                aws.String(j.table),
+		ConsistentRead:           aws.Bool(true),
+		KeyConditionExpression:   aws.String("#journal = :journal"),
+		ExpressionAttributeNames: map[string]*string{"#journal": aws.String("journal")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":journal": &dynamodb.AttributeValue{S: aws.String(j.name)}}}
+	if tx != "" {
+		in.KeyConditionExpression = aws.String("#journal = :journal AND begins_with(#entry, :tx)")
+		in.ExpressionAttributeNames["#entry"] = aws.String("entry")
+		in.ExpressionAttributeValues[":tx"] = &dynamodb.AttributeValue{S: aws.String(tx + "#")}
+	}
+
+	var items []map[string]*dynamodb.AttributeValue
+	err := j.db.QueryPagesWithContext(ctx, in, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		items = append(items, page.Items...)
+		return true
+	})
+	return items, err
+}
+
+// Entries queries the transaction's items
+func (j *TableJournal) Entries(ctx context.Context, tx string) ([]JournalEntry, error) {
+	items, err := j.items(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]JournalEntry, len(items))
+	for i, item := range items {
+		if item["data"] == nil || item["data"].S == nil {
+			return nil, fmt.Errorf("journal entry %s has no data", aws.StringValue(item["entry"].S))
+		}
+		if err := json.Unmarshal([]byte(*item["data"].S), &entries[i]); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// End deletes the transaction's items
+func (j *TableJournal) End(ctx context.Context, tx string) error {
+	items, err := j.items(ctx, tx)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		_, err := j.db.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(j.table),
+			Key:       map[string]*dynamodb.AttributeValue{"journal": item["journal"], "entry": item["entry"]}})
+		if err != nil {
+			return err
+		}
+	}
+
+	j.mu.Lock()
+	delete(j.seq, tx)
+	j.mu.Unlock()
+	return nil
+}
+
+// Open returns the transactions that have items in the table
+func (j *TableJournal) Open(ctx context.Context) ([]string, error) {
+	items, err := j.items(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var txs []string
+	seen := make(map[string]bool)
+	for _, item := range items {
+		tx := strings.SplitN(aws.StringValue(item["entry"].S), "#", 2)[0]
+		if !seen[tx] {
+			seen[tx] = true
+			txs = append(txs, tx)
+		}
+	}
+	return txs, nil
+}
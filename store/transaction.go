@@ -0,0 +1,591 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	godba "github.com/sethjback/godba/errors"
+)
+
+// TransactionMode controls how the Tx returned by StartTransaction runs, finishes and rolls back
+type TransactionMode int32
+
+const (
+	// Compensating runs writes immediately and records them. Rollback undoes them with reversing
+	// requests, which can leave partial writes behind if the process dies part way through, unless
+	// there is a TransactionJournal to Recover them from
+	Compensating TransactionMode = iota
+
+	// Atomic buffers Put, Update, Delete and BatchWrite requests and commits them all at once with
+	// TransactWriteItems when the transaction finishes
+	Atomic
+)
+
+// transactItemLimit is the most actions a single TransactWriteItems call accepts
+const transactItemLimit = 100
+
+// a write buffered in an atomic transaction
+type transactItem struct {
+	request Request
+	item    *dynamodb.TransactWriteItem
+}
+
+// Tx is a transaction started by StartTransaction. It has its own operation log and read cache, so each
+// concurrent caller of a datastore can run its own transaction. It is finished by either Finish or Rollback
+type Tx interface {
+	Run(request Request) (Result, error)
+	RunContext(ctx context.Context, request Request) (Result, error)
+	Finish() error
+	FinishContext(ctx context.Context) error
+	Rollback() []error
+	RollbackContext(ctx context.Context) []error
+}
+
+// dynamodbTx implements Tx for a DynamoDBDatastore
+type dynamodbTx struct {
+	c             *DynamoDBDatastore
+	mu            sync.Mutex // held while a request runs, so the requests of a transaction run one at a time
+	done          bool
+	ops           []op // successful writes, in Compensating mode
+	pending       []transactItem
+	cache         *readCache
+	journalTx     string // the id of the transaction in the journal, once it has recorded a write
+	journalWrites int    // the number of writes journaled, each entry is numbered so it can be marked
+}
+
+// errTransactionDone is returned for a request run in a transaction that has finished or been rolled back
+var errTransactionDone = errors.New("the transaction has already finished")
+
+// Run runs a request as part of the transaction
+func (t *dynamodbTx) Run(request Request) (Result, error) {
+	return t.RunContext(context.Background(), request)
+}
+
+// RunContext is Run with a context, see DynamoDBDatastore.RunContext
+func (t *dynamodbTx) RunContext(ctx context.Context, request Request) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return nil, dbError(godba.ErrorInvalidRequest, "", request.Table, "Could not run request", errTransactionDone)
+	}
+	return t.c.run(ctx, t, t.c.prepare(request))
+}
+
+// buffer queues a write for an atomic transaction
+func (t *dynamodbTx) buffer(request Request) (Result, error) {
+	requests := []Request{request}
+	if request.Action == BatchWrite {
+		requests = request.Batch
+	}
+
+	for _, r := range requests {
+		item, err := transactWriteItem(r)
+		if err != nil {
+			return nil, err
+		}
+		t.pending = append(t.pending, transactItem{r, item})
+		if t.cache != nil {
+			t.cache.removeWritten(r)
+		}
+	}
+
+	return &dynamodbResult{}, nil
+}
+
+// record adds a successful write to the transaction
+func (t *dynamodbTx) record(o op) {
+	t.ops = append(t.ops, o)
+}
+
+// journal appends the request that reverses o to the journal, as write number write. check and written tell
+// later if o was applied, see stamp. It returns write, or -1 if there was nothing to reverse
+func (t *dynamodbTx) journal(ctx context.Context, o op, write int, check string, written *dynamodb.AttributeValue) (int, error) {
+	reverse := reverseOp(o)
+	if reverse == nil {
+		return -1, nil
+	}
+	entry, err := newJournalEntry(*reverse)
+	if err != nil {
+		return -1, dbError(godba.ErrorJournal, "", o.request.Table, "Could not record the write in the transaction journal", err)
+	}
+	entry.Write, entry.Check, entry.Written = write, check, written
+	if err := t.appendJournal(ctx, o.request.Table, entry); err != nil {
+		return -1, err
+	}
+	return write, nil
+}
+
+// markJournal records that write number write was applied, or that it was not
+func (t *dynamodbTx) markJournal(ctx context.Context, table string, write int, applied bool) error {
+	return t.appendJournal(ctx, table, JournalEntry{Write: write, Applied: applied, Cancel: !applied})
+}
+
+// beginJournal starts the journal's transaction, if it has not been already
+func (t *dynamodbTx) beginJournal(ctx context.Context, table string) error {
+	if t.journalTx != "" {
+		return nil
+	}
+	var err error
+	if t.journalTx, err = t.c.journal.Begin(ctx); err != nil {
+		return dbError(godba.ErrorJournal, "", table, "Could not record the write in the transaction journal", err)
+	}
+	return nil
+}
+
+// appendJournal appends an entry, starting the journal's transaction on the first one
+func (t *dynamodbTx) appendJournal(ctx context.Context, table string, entry JournalEntry) error {
+	if err := t.beginJournal(ctx, table); err != nil {
+		return err
+	}
+	if err := t.c.journal.Append(ctx, t.journalTx, entry); err != nil {
+		return dbError(godba.ErrorJournal, "", table, "Could not record the write in the transaction journal", err)
+	}
+	return nil
+}
+
+// journalWrite journals a Put, Update or Delete before it is sent, so a crash at any point after the
+// write leaves the entry that undoes it behind. The item is read first to build the entry, and the
+// returned request only succeeds if the item has not changed since. It returns the number of the write,
+// or -1 if nothing was journaled. Once the write's outcome is known it should be marked, see markJournal
+func (t *dynamodbTx) journalWrite(ctx context.Context, request Request) (_ Request, write int, err error) {
+	current, err := get(ctx, t.c.db, Request{Table: request.Table, Action: Get, Key: request.Key, ConsistentRead: true})
+	if err != nil {
+		return request, -1, err
+	}
+	var old map[string]*dynamodb.AttributeValue
+	if len(current.items) != 0 {
+		old = current.items[0]
+	}
+
+	conditions := []RequestCondition{t.unchanged(request.Key, old)}
+	if len(request.RequestConditions) != 0 {
+		// grouped so an Or among them can not bypass the check
+		conditions = append([]RequestCondition{RequestCondition{Group: request.RequestConditions}}, conditions...)
+	}
+	request.RequestConditions = conditions
+
+	write = t.journalWrites
+	t.journalWrites++
+	request, check, written, err := t.stamp(ctx, request, write, t.c.version != "")
+	if err != nil {
+		return request, -1, err
+	}
+	write, err = t.journal(ctx, op{request, &dynamodbResult{attributes: old}}, write, check, written)
+	return request, write, err
+}
+
+// journalBatch journals the puts of a BatchWrite, with the items they replace. It returns the batch with its
+// puts stamped, BatchWriteItem can not bump a version, and the number of each write or -1 if there was
+// nothing to reverse
+func (t *dynamodbTx) journalBatch(ctx context.Context, request Request, replaced []map[string]*dynamodb.AttributeValue) (_ Request, writes []int, err error) {
+	batch := make([]Request, len(request.Batch))
+	writes = make([]int, len(request.Batch))
+	for i, b := range request.Batch {
+		write := t.journalWrites
+		t.journalWrites++
+		b, check, written, err := t.stamp(ctx, b, write, false)
+		if err != nil {
+			return request, nil, err
+		}
+		if writes[i], err = t.journal(ctx, op{b, &dynamodbResult{attributes: replaced[i]}}, write, check, written); err != nil {
+			return request, nil, err
+		}
+		batch[i] = b
+	}
+	request.Batch = batch
+	return request, writes, nil
+}
+
+// stamp makes a write leave a value behind that tells if it was applied: the version a Put or Update sets
+// when versioned, otherwise a hash of the write that is added to the item in JournalHashAttribute. It returns
+// the request, the attribute that holds the value and the value, which is nil for a Delete
+func (t *dynamodbTx) stamp(ctx context.Context, request Request, write int, versioned bool) (_ Request, check string, written *dynamodb.AttributeValue, err error) {
+	if request.Action == Delete {
+		return request, firstKey(request.Key), nil, nil
+	}
+	if versioned {
+		return request, t.c.version, &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(request.Version + 1))}, nil
+	}
+
+	if err := t.beginJournal(ctx, request.Table); err != nil {
+		return request, "", nil, err
+	}
+	entry, err := newJournalEntry(request)
+	if err != nil {
+		return request, "", nil, dbError(godba.ErrorJournal, "", request.Table, "Could not record the write in the transaction journal", err)
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return request, "", nil, dbError(godba.ErrorJournal, "", request.Table, "Could not record the write in the transaction journal", err)
+	}
+	sum := sha256.Sum256(append([]byte(t.journalTx+"/"+strconv.Itoa(write)+"/"), data...))
+	hash := hex.EncodeToString(sum[:16])
+
+	if request.Action == Put {
+		item := make(map[string]interface{}, len(request.Item)+1)
+		for k, v := range request.Item {
+			item[k] = v
+		}
+		item[JournalHashAttribute] = hash
+		request.Item = item
+	} else {
+		request.Updates = append(append([]UpdateValue{}, request.Updates...), UpdateValue{Action: Put, Path: attributePath(JournalHashAttribute), Value: hash})
+	}
+	return request, JournalHashAttribute, &dynamodb.AttributeValue{S: aws.String(hash)}, nil
+}
+
+// unchanged holds while the item is as it was read in old: it still has the same version, or the same hash
+// when the datastore has no VersionAttribute, or it still does not exist when old is empty. A change made
+// without bumping the version, or without a journal when there is no version, is not detected
+func (t *dynamodbTx) unchanged(key map[string]interface{}, old map[string]*dynamodb.AttributeValue) RequestCondition {
+	if len(old) == 0 {
+		return Where(attributePath(firstKey(key)), NotExist, nil)
+	}
+	attribute := t.c.version
+	if attribute == "" {
+		attribute = JournalHashAttribute
+	}
+	if v, ok := old[attribute]; ok {
+		return Where(attributePath(attribute), Equal, v)
+	}
+	return Where(attributePath(attribute), NotExist, nil)
+}
+
+// firstKey returns the first of a key's attribute names in sorted order, any of them tells if an item exists
+func firstKey(key map[string]interface{}) string {
+	names := make([]string, 0, len(key))
+	for name := range key {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+// notApplied reports if a write's error means it was certainly not applied: dynamodb rejected it, or it
+// could not be built. Other errors, like a timeout, may come after the write was applied
+func notApplied(err error) bool {
+	if godba.IsConditionFailed(err) {
+		return true
+	}
+	var ae awserr.Error
+	if errors.As(err, &ae) && ae.Code() == "ValidationException" {
+		return true
+	}
+	switch godba.Code(err) {
+	case godba.ErrorMarshalItem, godba.ErrorRequestCondition, godba.ErrorUpdateExpression, godba.ErrorUpdateOperation, godba.ErrorInvalidRequest:
+		return true
+	}
+	return false
+}
+
+// end marks the transaction done and returns its state. ok is false if it already was
+func (t *dynamodbTx) end() (ops []op, pending []transactItem, journalTx string, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return nil, nil, "", false
+	}
+	ops, pending, journalTx = t.ops, t.pending, t.journalTx
+	t.done = true
+	t.ops = nil
+	t.pending = nil
+	t.cache = nil
+	return ops, pending, journalTx, true
+}
+
+// Finish ends the transaction. In Atomic mode the buffered writes are committed in a single
+// TransactWriteItems call: either all of them are applied or, if dynamodb cancels the transaction, none are
+// and the *TransactionCanceledError in the returned error's chain explains why
+func (t *dynamodbTx) Finish() error {
+	return t.FinishContext(context.Background())
+}
+
+// FinishContext is Finish with a context for the commit
+func (t *dynamodbTx) FinishContext(ctx context.Context) error {
+	_, pending, journalTx, ok := t.end()
+	if !ok {
+		return nil
+	}
+
+	if journalTx != "" {
+		if err := t.c.journal.End(ctx, journalTx); err != nil {
+			return dbError(godba.ErrorJournal, "", "", "Could not close the transaction journal", err)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	err := transactWrite(ctx, t.c.db, pending)
+	for _, p := range pending {
+		t.c.invalidate(nil, p.request)
+	}
+	return err
+}
+
+// Rollback runs through successfully completed requests and reverses them, the most recent first
+// If there are any errors when performing the reversing function, they are returned.
+// In Atomic mode nothing has been written yet, so the buffered writes are discarded
+func (t *dynamodbTx) Rollback() []error {
+	return t.RollbackContext(context.Background())
+}
+
+// RollbackContext is Rollback with a context for the reversing requests. It should usually not be the
+// context of the request that failed, a rollback that is cancelled part way through leaves partial writes behind.
+// With a TransactionJournal the writes are reversed from their journal entries, which also cover the writes
+// that failed in a way that may have been applied, like a timeout
+func (t *dynamodbTx) RollbackContext(ctx context.Context) []error {
+	ops, _, journalTx, ok := t.end()
+	if !ok {
+		return nil
+	}
+
+	var errs []error
+	if journalTx != "" {
+		entries, err := t.c.journal.Entries(ctx, journalTx)
+		if err == nil {
+			return t.c.compensate(ctx, journalTx, journalRequests(entries))
+		}
+		// the recorded writes are still reversed, the journal is left open for Recover
+		errs = append(errs, dbError(godba.ErrorJournal, "", "", "Could not read the transaction journal", err))
+		journalTx = ""
+	}
+
+	reverse := make([]Request, 0, len(ops))
+	for _, op := range ops {
+		if r := reverseOp(op); r != nil {
+			reverse = append(reverse, *r)
+		}
+	}
+
+	return append(errs, t.c.compensate(ctx, journalTx, reverse)...)
+}
+
+// CancellationReason explains what happened to a single request when a transaction was cancelled
+type CancellationReason struct {
+	Request Request
+	Code    string // "None" if the request itself was fine
+	Message string
+}
+
+// TransactionCanceledError is the cause of the error returned when dynamodb refuses an atomic transaction,
+// use errors.As to get it. Reasons has an entry for every buffered request, in the order they were run
+type TransactionCanceledError struct {
+	Reasons []CancellationReason
+	err     error
+}
+
+func (e *TransactionCanceledError) Error() string {
+	msg := "Transaction cancelled"
+	for i, r := range e.Reasons {
+		if r.Code == "None" || r.Code == "" {
+			continue
+		}
+		msg += " [request " + strconv.Itoa(i) + ": " + r.Code
+		if r.Message != "" {
+			msg += " " + r.Message
+		}
+		msg += "]"
+	}
+	return msg
+}
+
+// Unwrap returns the dynamodb exception, so godba.IsConditionFailed sees through the error
+func (e *TransactionCanceledError) Unwrap() error {
+	return e.err
+}
+
+// transactWriteItem translates a Put, Update or Delete request, including its RequestConditions, into
+// a TransactWriteItem
+func transactWriteItem(r Request) (*dynamodb.TransactWriteItem, error) {
+	expValMap := make(map[string]*dynamodb.AttributeValue)
+	expNameMap := make(map[string]*string)
+	ti := &dynamodb.TransactWriteItem{}
+
+	switch r.Action {
+	case Put:
+		item := make(map[string]interface{})
+		for k, v := range r.Item {
+			item[k] = v
+		}
+		for k, v := range r.Key {
+			item[k] = v
+		}
+		av, err := marshalItems(item)
+		if err != nil {
+			return nil, dbError(godba.ErrorMarshalItem, "TransactWriteItems", r.Table, "Could not add put to the transaction", err)
+		}
+		condexp, err := buildConditionExpression(r.RequestConditions, expValMap, expNameMap)
+		if err != nil {
+			return nil, dbError(godba.ErrorRequestCondition, "TransactWriteItems", r.Table, "Could not add put to the transaction", err)
+		}
+		ti.Put = &dynamodb.Put{TableName: aws.String(r.Table), Item: av}
+		if condexp != "" {
+			ti.Put.ConditionExpression = aws.String(condexp)
+		}
+		if len(expValMap) != 0 {
+			ti.Put.ExpressionAttributeValues = expValMap
+		}
+		if len(expNameMap) != 0 {
+			ti.Put.ExpressionAttributeNames = expNameMap
+		}
+	case Delete:
+		key, err := marshalItems(r.Key)
+		if err != nil {
+			return nil, dbError(godba.ErrorMarshalItem, "TransactWriteItems", r.Table, "Could not add delete to the transaction", err)
+		}
+		condexp, err := buildConditionExpression(r.RequestConditions, expValMap, expNameMap)
+		if err != nil {
+			return nil, dbError(godba.ErrorRequestCondition, "TransactWriteItems", r.Table, "Could not add delete to the transaction", err)
+		}
+		ti.Delete = &dynamodb.Delete{TableName: aws.String(r.Table), Key: key}
+		if condexp != "" {
+			ti.Delete.ConditionExpression = aws.String(condexp)
+		}
+		if len(expValMap) != 0 {
+			ti.Delete.ExpressionAttributeValues = expValMap
+		}
+		if len(expNameMap) != 0 {
+			ti.Delete.ExpressionAttributeNames = expNameMap
+		}
+	case Update:
+		key, err := marshalItems(r.Key)
+		if err != nil {
+			return nil, dbError(godba.ErrorMarshalItem, "TransactWriteItems", r.Table, "Could not add update to the transaction", err)
+		}
+		if r.patch {
+			for _, v := range r.Updates {
+				if hasIndex(v.Path) || hasIndex(v.From) {
+					return nil, dbError(godba.ErrorUpdateExpression, "TransactWriteItems", r.Table, "Could not add update to the transaction", errors.New("Invalid update: the patch path "+v.Path+" needs the current item, it can only be used in a single Update request"))
+				}
+			}
+		}
+		updateExp, err := buildUpdateExpression(r.Updates, expValMap, expNameMap)
+		if err != nil {
+			return nil, dbError(godba.ErrorUpdateExpression, "TransactWriteItems", r.Table, "Could not add update to the transaction", err)
+		}
+		if updateExp == "" {
+			return nil, dbError(godba.ErrorUpdateExpression, "TransactWriteItems", r.Table, "Could not add update to the transaction", errors.New("no updates"))
+		}
+		condexp, err := buildConditionExpression(r.RequestConditions, expValMap, expNameMap)
+		if err != nil {
+			return nil, dbError(godba.ErrorRequestCondition, "TransactWriteItems", r.Table, "Could not add update to the transaction", err)
+		}
+		ti.Update = &dynamodb.Update{TableName: aws.String(r.Table), Key: key, UpdateExpression: aws.String(updateExp)}
+		if condexp != "" {
+			ti.Update.ConditionExpression = aws.String(condexp)
+		}
+		if len(expValMap) != 0 {
+			ti.Update.ExpressionAttributeValues = expValMap
+		}
+		if len(expNameMap) != 0 {
+			ti.Update.ExpressionAttributeNames = expNameMap
+		}
+	default:
+		return nil, dbError(godba.ErrorInvalidRequest, "TransactWriteItems", r.Table, "Could not add request to the transaction", errors.New("only Put, Update, Delete and BatchWrite can be part of an atomic transaction"))
+	}
+
+	return ti, nil
+}
+
+// transactTable returns the table of a transaction's writes, or an empty string if they are in several tables
+func transactTable(items []transactItem) string {
+	table := ""
+	for i, item := range items {
+		if i > 0 && item.request.Table != table {
+			return ""
+		}
+		table = item.request.Table
+	}
+	return table
+}
+
+// transactWrite commits the buffered writes of an atomic transaction
+func transactWrite(ctx context.Context, db DBer, items []transactItem) error {
+	if len(items) > transactItemLimit {
+		return dbError(godba.ErrorInvalidRequest, "TransactWriteItems", "", "Unable to commit the transaction", errors.New("a transaction can contain at most "+strconv.Itoa(transactItemLimit)+" writes"))
+	}
+
+	in := &dynamodb.TransactWriteItemsInput{}
+	for _, i := range items {
+		in.TransactItems = append(in.TransactItems, i.item)
+	}
+
+	_, e := db.TransactWriteItemsWithContext(ctx, in)
+	if e == nil {
+		return nil
+	}
+
+	if tce, ok := e.(*dynamodb.TransactionCanceledException); ok {
+		re := &TransactionCanceledError{err: tce}
+		for i, item := range items {
+			reason := CancellationReason{Request: item.request}
+			if i < len(tce.CancellationReasons) {
+				reason.Code = aws.StringValue(tce.CancellationReasons[i].Code)
+				reason.Message = aws.StringValue(tce.CancellationReasons[i].Message)
+			}
+			re.Reasons = append(re.Reasons, reason)
+		}
+		return dbError(godba.ErrorTransaction, "TransactWriteItems", transactTable(items), "Transaction cancelled", re)
+	}
+
+	return dbError(godba.ErrorTransaction, "TransactWriteItems", transactTable(items), "Unable to commit the transaction", e)
+}
+
+// transactGet reads the items for the Get requests in r.Batch with a single TransactGetItems call, so
+// they are a consistent snapshot. Result items are in the same order as the requests, missing items are empty
+func transactGet(ctx context.Context, db DBer, r Request) (*dynamodbResult, error) {
+	if len(r.Batch) > transactItemLimit {
+		return nil, dbError(godba.ErrorInvalidRequest, "TransactGetItems", "", "Could not get items", errors.New("a transaction can contain at most "+strconv.Itoa(transactItemLimit)+" reads"))
+	}
+
+	in := &dynamodb.TransactGetItemsInput{}
+	for _, b := range r.Batch {
+		if b.Action != Get {
+			return nil, dbError(godba.ErrorInvalidRequest, "TransactGetItems", b.Table, "Could not get items", errors.New("TransactGet only supports Get requests"))
+		}
+		key, err := marshalItems(b.Key)
+		if err != nil {
+			return nil, dbError(godba.ErrorMarshalItem, "TransactGetItems", b.Table, "Could not get items", err)
+		}
+		get := &dynamodb.Get{TableName: aws.String(b.Table), Key: key}
+		if len(b.Projection) != 0 {
+			get.ExpressionAttributeNames = make(map[string]*string)
+			proj, err := buildProjectionExpression(b.Projection, get.ExpressionAttributeNames)
+			if err != nil {
+				return nil, dbError(godba.ErrorProjection, "TransactGetItems", b.Table, "Could not get items", err)
+			}
+			get.ProjectionExpression = aws.String(proj)
+		}
+		in.TransactItems = append(in.TransactItems, &dynamodb.TransactGetItem{Get: get})
+	}
+
+	out, e := db.TransactGetItemsWithContext(ctx, in)
+	if e != nil {
+		return nil, dbError(godba.ErrorTransaction, "TransactGetItems", "", "Unable to retrieve items from the database", e)
+	}
+
+	result := &dynamodbResult{items: make([]map[string]*dynamodb.AttributeValue, len(r.Batch))}
+	for i, resp := range out.Responses {
+		if i < len(result.items) && resp != nil {
+			result.items[i] = resp.Item
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,197 @@
+package store
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/sethjback/godba/config"
+	godba "github.com/sethjback/godba/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func getAtomicStore() *DynamoDBDatastore {
+	return NewMemory(config.Store{
+		Transactions: Atomic,
+		Tables: map[string]TableSchema{
+			"users": TableSchema{HashKey: "id"}}})
+}
+
+func TestTransactWriteItem(t *testing.T) {
+	assert := assert.New(t)
+
+	r := Request{Table: "test", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	r.AddUpdateValue("/old", Delete, nil).AddUpdateValue("/name", Put, "bob")
+	r.And("version", Equal, 1)
+
+	ti, err := transactWriteItem(r)
+	if assert.Nil(err) && assert.NotNil(ti.Update) {
+		assert.Equal("SET #1ename0 = :val0 REMOVE #0ename0", *ti.Update.UpdateExpression)
+		assert.Equal("#ename2 = :val1", *ti.Update.ConditionExpression)
+		assert.Equal(map[string]*dynamodb.AttributeValue{
+			":val0": &dynamodb.AttributeValue{S: aws.String("bob")},
+			":val1": &dynamodb.AttributeValue{N: aws.String("1")}}, ti.Update.ExpressionAttributeValues)
+		assert.Equal(map[string]*string{
+			"#0ename0": aws.String("old"),
+			"#1ename0": aws.String("name"),
+			"#ename2":  aws.String("version")}, ti.Update.ExpressionAttributeNames)
+	}
+
+	r = Request{Table: "test", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"name": "bob"}}
+	ti, err = transactWriteItem(r)
+	if assert.Nil(err) && assert.NotNil(ti.Put) {
+		assert.Nil(ti.Put.ConditionExpression)
+		assert.Equal("1", *ti.Put.Item["id"].S)
+	}
+	assert.Nil(r.Item["id"], "the request item should not be modified")
+
+	_, err = transactWriteItem(Request{Table: "test", Action: Get})
+	assert.NotNil(err)
+}
+
+func TestAtomicTransaction(t *testing.T) {
+	assert := assert.New(t)
+	c := getAtomicStore()
+	c.CacheOff()
+
+	tx := c.StartTransaction()
+	_, e := tx.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "1"}, Item: map[string]interface{}{"n": 1}})
+	assert.Nil(e)
+	_, e = tx.Run(Request{Action: BatchWrite, Batch: []Request{
+		Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": "2"}}}})
+	assert.Nil(e)
+
+	// nothing is written until the transaction finishes
+	r, e := tx.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	assert.Equal(0, r.GetItemCount())
+
+	assert.Nil(tx.Finish())
+	r, e = c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "1"}})
+	assert.Nil(e)
+	assert.Equal(1, r.GetItemCount())
+	r, e = c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "2"}})
+	assert.Nil(e)
+	assert.Equal(1, r.GetItemCount())
+
+	// a failed condition cancels every write
+	tx = c.StartTransaction()
+	_, e = tx.Run(Request{Table: "users", Action: Delete, Key: map[string]interface{}{"id": "2"}})
+	assert.Nil(e)
+	u := Request{Table: "users", Action: Update, Key: map[string]interface{}{"id": "1"}}
+	u.AddUpdateValue("/n", Update, 2).And("n", Equal, 5)
+	_, e = tx.Run(u)
+	assert.Nil(e)
+
+	e = tx.Finish()
+	if assert.NotNil(e) {
+		assert.Equal(godba.ErrorConditionFailed, godba.Code(e))
+		var ge *godba.Error
+		if assert.True(errors.As(e, &ge)) {
+			assert.Equal("TransactWriteItems", ge.Op)
+			assert.Equal("users", ge.Table)
+		}
+		var tce *TransactionCanceledError
+		if assert.True(errors.As(e, &tce)) && assert.Len(tce.Reasons, 2) {
+			assert.Equal("None", tce.Reasons[0].Code)
+			assert.Equal("ConditionalCheckFailed", tce.Reasons[1].Code)
+			assert.Equal(Update, tce.Reasons[1].Request.Action)
+		}
+	}
+	r, e = c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "2"}})
+	assert.Nil(e)
+	assert.Equal(1, r.GetItemCount(), "the delete must not be applied")
+
+	// rollback discards the buffered writes
+	tx = c.StartTransaction()
+	_, e = tx.Run(Request{Table: "users", Action: Delete, Key: map[string]interface{}{"id": "2"}})
+	assert.Nil(e)
+	assert.Nil(tx.Rollback())
+	assert.Nil(tx.Finish())
+	r, e = c.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "2"}})
+	assert.Nil(e)
+	assert.Equal(1, r.GetItemCount())
+
+	// reads are not part of the transaction
+	tx = c.StartTransaction()
+	_, e = tx.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": "2"}})
+	assert.Nil(e)
+	assert.Nil(tx.Finish())
+}
+
+func TestConcurrentTransactions(t *testing.T) {
+	assert := assert.New(t)
+	c := getMemoryStore()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(id string, commit bool) {
+			defer wg.Done()
+			tx := c.StartTransaction()
+			_, e := tx.Run(Request{Table: "users", Action: Put, Key: map[string]interface{}{"id": id}, Item: map[string]interface{}{"n": 1}})
+			assert.Nil(e)
+			r, e := tx.Run(Request{Table: "users", Action: Get, Key: map[string]interface{}{"id": id}})
+			if assert.Nil(e) {
+				assert.Equal(1, r.GetItemCount())
+			}
+			if commit {
+				assert.Nil(tx.Finish())
+			} else {
+				assert.Empty(tx.Rollback())
+			}
+
+			// requests outside a transaction share the datastore's cache
+			_, e = c.Run(Request{Table: "users", Action: Get, LiveData: !commit, Key: map[string]interface{}{"id": "shared"}})
+			assert.Nil(e)
+			c.ClearCache()
+		}(strconv.Itoa(i), i%2 == 0)
+	}
+	wg.Wait()
+
+	for i := 0; i < 20; i++ {
+		r, e := c.Run(Request{Table: "users", Action: Get, LiveData: true, Key: map[string]interface{}{"id": strconv.Itoa(i)}})
+		assert.Nil(e)
+		if i%2 == 0 {
+			assert.Equal(1, r.GetItemCount(), "committed transaction %d should be kept", i)
+		} else {
+			assert.Equal(0, r.GetItemCount(), "rolled back transaction %d should be undone", i)
+		}
+	}
+}
+
+func TestTransactGet(t *testing.T) {
+	assert := assert.New(t)
+	c := NewMemory(config.Store{
+		Tables: map[string]TableSchema{
+			"accounts": TableSchema{HashKey: "id"},
+			"settings": TableSchema{HashKey: "account"}}})
+
+	_, e := c.Run(Request{Table: "accounts", Action: Put, Key: map[string]interface{}{"id": "a1"}, Item: map[string]interface{}{"balance": 10}})
+	assert.Nil(e)
+	_, e = c.Run(Request{Table: "settings", Action: Put, Key: map[string]interface{}{"account": "a1"}, Item: map[string]interface{}{"theme": "dark"}})
+	assert.Nil(e)
+
+	r := Request{Action: TransactGet}
+	r.AddBatch(Request{Table: "settings", Action: Get, Key: map[string]interface{}{"account": "a1"}}).
+		AddBatch(Request{Table: "accounts", Action: Get, Key: map[string]interface{}{"id": "missing"}}).
+		AddBatch(Request{Table: "accounts", Action: Get, Key: map[string]interface{}{"id": "a1"}})
+
+	res, e := c.Run(r)
+	assert.Nil(e)
+	if assert.Equal(3, res.GetItemCount()) {
+		s, _ := res.GetStringItem(0, "theme")
+		assert.Equal("dark", s)
+		_, ok := res.GetItem(1, "id")
+		assert.False(ok)
+		n, _ := res.GetNumberItem(2, "balance")
+		assert.Equal(10, n)
+	}
+
+	r.Batch[0].Action = Put
+	_, e = c.Run(r)
+	assert.NotNil(e)
+}